@@ -0,0 +1,475 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command cel-playground evaluates CEL expressions, validating admission policies and webhook match conditions, audits
+// policies against cluster dumps, and runs policy test suites, offline. Inputs are read from files, or from stdin when the path is '-'. The repl command
+// evaluates expressions interactively, and the lsp command serves the Language Server Protocol over stdio.
+//
+// The exit code is 0 when the expression holds, the policy admits the request or the tests pass, 1 when the
+// expression is false, the policy denies the request, some audited object violates the policy or a test fails, and 2
+// on errors.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/undistro/cel-playground/eval"
+	"github.com/undistro/cel-playground/k8s"
+	"github.com/undistro/cel-playground/lsp"
+	"github.com/undistro/cel-playground/utils"
+)
+
+const (
+	exitPassed = 0
+	exitDenied = 1
+	exitError  = 2
+)
+
+const usage = `Usage: cel-playground <command> [flags]
+
+Commands:
+  eval      evaluate a CEL expression
+  vap       evaluate a validating admission policy
+  webhooks  evaluate the match conditions of a webhook configuration
+  audit     evaluate a validating admission policy against every object of a cluster dump
+  test      run policy test suites
+  repl      evaluate CEL expressions interactively
+  lsp       serve the Language Server Protocol over stdin and stdout
+
+Run 'cel-playground <command> -h' for the flags of a command.
+`
+
+// result is the outcome of a command: its JSON output, the table printing it and the exit code it reflects.
+type result struct {
+	output string
+	table  func(w io.Writer, output string) error
+	code   int
+}
+
+type command func(args []string, in *inputs) (*result, error)
+
+var commands = map[string]command{
+	"eval":     evalCommand,
+	"vap":      vapCommand,
+	"webhooks": webhooksCommand,
+	"audit":    auditCommand,
+	"test":     testCommand,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(stderr, usage)
+		return exitError
+	}
+	if args[0] == "repl" {
+		return replCommand(args[1:], stdin, stdout, stderr)
+	}
+	if args[0] == "lsp" {
+		if err := lsp.NewServer().Serve(stdin, stdout); err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return exitError
+		}
+		return exitPassed
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %s\n\n%s", args[0], usage)
+		return exitError
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("o", "table", "output format: json, yaml or table")
+	in := &inputs{flags: flags, stdin: stdin}
+	res, err := cmd(args[1:], in)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitError
+	}
+	if err == nil {
+		err = write(stdout, *format, res)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return exitError
+	}
+	return res.code
+}
+
+// inputs reads the inputs of a command from files, stdin being read at most once.
+type inputs struct {
+	flags     *flag.FlagSet
+	stdin     io.Reader
+	stdinUsed bool
+}
+
+func (in *inputs) file(name, usage string) *string {
+	return in.flags.String(name, "", usage+" (file path, '-' for stdin)")
+}
+
+func (in *inputs) read(name, path string) ([]byte, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		if in.stdinUsed {
+			return nil, fmt.Errorf("failed to read %s: stdin is already used by another input", name)
+		}
+		in.stdinUsed = true
+		data, err := io.ReadAll(in.stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from stdin: %w", name, err)
+		}
+		return data, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// readAll reads the inputs by name, in order.
+func (in *inputs) readAll(names []string, paths []*string) ([][]byte, error) {
+	data := make([][]byte, len(names))
+	for i, name := range names {
+		var err error
+		if data[i], err = in.read(name, *paths[i]); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func evalCommand(args []string, in *inputs) (*result, error) {
+	expression := in.flags.String("e", "", "CEL expression, instead of -f")
+	expressionFile := in.file("f", "CEL expression")
+	input := in.file("input", "input variables, YAML or JSON")
+	declarations := in.file("declarations", "types of the variables, YAML")
+	descriptors := in.file("descriptors", "FileDescriptorSet, binary or base64")
+	unknowns := in.file("unknowns", "paths of the unknown attributes, YAML list")
+	trace := in.flags.Bool("trace", false, "record the value of every subexpression")
+	lint := in.flags.Bool("lint", false, "report the findings of the lint rules")
+	batch := in.flags.Bool("batch", false, "evaluate against each document of the input, or each item of a List")
+	if err := in.flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	data, err := in.readAll([]string{"the expression", "the input", "the declarations", "the descriptors", "the unknowns"},
+		[]*string{expressionFile, input, declarations, descriptors, unknowns})
+	if err != nil {
+		return nil, err
+	}
+	exp := *expression
+	if *expressionFile != "" {
+		exp = string(data[0])
+	}
+	if strings.TrimSpace(exp) == "" {
+		return nil, errors.New("an expression is required, use -e or -f")
+	}
+
+	request := &eval.Request{Expression: exp, Trace: *trace, Lint: *lint}
+	var batchInputs []eval.BatchInput
+	if *batch {
+		if batchInputs, err = eval.BatchInputs(data[1]); err != nil {
+			return nil, err
+		}
+	} else if request.Input, err = utils.Decode(data[1]); err != nil {
+		return nil, fmt.Errorf("failed to decode input: %w", err)
+	}
+	if len(data[2]) > 0 {
+		if request.Declarations, err = eval.ParseDeclarations(data[2]); err != nil {
+			return nil, err
+		}
+	}
+	if len(data[3]) > 0 {
+		if request.Descriptors, err = eval.ParseDescriptors(data[3]); err != nil {
+			return nil, err
+		}
+	}
+	if len(data[4]) > 0 {
+		if request.Unknowns, err = eval.ParseUnknowns(data[4]); err != nil {
+			return nil, err
+		}
+	}
+
+	if *batch {
+		return evalBatch(request, batchInputs)
+	}
+	response, err := eval.Evaluate(context.Background(), request)
+	if err != nil {
+		return nil, err
+	}
+	output, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the output: %w", err)
+	}
+	res := &result{output: string(output), table: evalTable, code: exitPassed}
+	if response.Result == false {
+		res.code = exitDenied
+	}
+	return res, nil
+}
+
+// evalBatch evaluates the expression of the request against each input, the exit code reflects the failed and false
+// items.
+func evalBatch(request *eval.Request, inputs []eval.BatchInput) (*result, error) {
+	response, err := eval.EvaluateBatch(context.Background(), request, inputs)
+	if err != nil {
+		return nil, err
+	}
+	output, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the output: %w", err)
+	}
+	res := &result{output: string(output), table: batchTable, code: exitPassed}
+	switch {
+	case response.Summary.Errors > 0:
+		res.code = exitError
+	case response.Summary.False > 0:
+		res.code = exitDenied
+	}
+	return res, nil
+}
+
+func k8sFlags(in *inputs) (trace, lint *bool) {
+	return in.flags.Bool("trace", false, "record the value of every subexpression"),
+		in.flags.Bool("lint", false, "report the findings of the lint rules")
+}
+
+func k8sOptions(trace, lint bool) []k8s.Option {
+	opts := []k8s.Option{}
+	if trace {
+		opts = append(opts, k8s.WithTrace())
+	}
+	if lint {
+		opts = append(opts, k8s.WithLint())
+	}
+	return opts
+}
+
+func vapCommand(args []string, in *inputs) (*result, error) {
+	names := []string{"the policy", "the object", "the old object", "the namespace", "the request", "the authorizer", "the params"}
+	paths := []*string{
+		in.file("policy", "validating admission policy"),
+		in.file("object", "object of the request"),
+		in.file("old-object", "existing object"),
+		in.file("namespace", "namespace of the object"),
+		in.file("request", "admission request attributes"),
+		in.file("authorizer", "authorization decisions"),
+		in.file("params", "parameter resource"),
+	}
+	trace, lint := k8sFlags(in)
+	if err := in.flags.Parse(args); err != nil {
+		return nil, err
+	}
+	data, err := in.readAll(names, paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(data[0]) == 0 {
+		return nil, errors.New("a policy is required, use -policy")
+	}
+
+	opts := k8sOptions(*trace, *lint)
+	if len(data[6]) > 0 {
+		opts = append(opts, k8s.WithParams(data[6]))
+	}
+	output, err := k8s.EvalValidatingAdmissionPolicy(data[0], data[2], data[1], data[3], data[4], data[5], opts...)
+	if err != nil {
+		return nil, err
+	}
+	var response k8s.EvalResponse
+	if err := json.Unmarshal([]byte(output), &response); err != nil {
+		return nil, fmt.Errorf("failed to decode the output: %w", err)
+	}
+	failClosed := k8s.FailsClosed(data[0])
+	res := &result{output: output, code: exitPassed, table: func(w io.Writer, output string) error {
+		return policyTable(w, output, failClosed)
+	}}
+	if !response.Allowed(failClosed) {
+		res.code = exitDenied
+	}
+	return res, nil
+}
+
+func webhooksCommand(args []string, in *inputs) (*result, error) {
+	names := []string{"the webhook configuration", "the object", "the old object", "the request", "the authorizer"}
+	paths := []*string{
+		in.file("webhooks", "webhook configuration"),
+		in.file("object", "object of the request"),
+		in.file("old-object", "existing object"),
+		in.file("request", "admission request attributes"),
+		in.file("authorizer", "authorization decisions"),
+	}
+	trace, lint := k8sFlags(in)
+	if err := in.flags.Parse(args); err != nil {
+		return nil, err
+	}
+	data, err := in.readAll(names, paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(data[0]) == 0 {
+		return nil, errors.New("a webhook configuration is required, use -webhooks")
+	}
+
+	output, err := k8s.EvalWebhook(data[0], data[2], data[1], data[3], data[4], k8sOptions(*trace, *lint)...)
+	if err != nil {
+		return nil, err
+	}
+	var response k8s.EvalResponse
+	if err := json.Unmarshal([]byte(output), &response); err != nil {
+		return nil, fmt.Errorf("failed to decode the output: %w", err)
+	}
+	res := &result{output: output, table: webhooksTable, code: exitPassed}
+	for _, matchConditions := range response.WebhookMatchConditions {
+		for _, matchCondition := range matchConditions {
+			if matchCondition.IsError {
+				res.code = exitError
+			}
+		}
+	}
+	return res, nil
+}
+
+func auditCommand(args []string, in *inputs) (*result, error) {
+	policy := in.file("policy", "validating admission policy")
+	objects := in.flags.String("objects", "", "objects to audit, e.g. the output of 'kubectl get -A -o yaml' "+
+		"(file or directory path, '-' for stdin)")
+	params := in.file("params", "parameter resource")
+	create := in.flags.Bool("create", false, "audit the creation of the objects rather than their update")
+	if err := in.flags.Parse(args); err != nil {
+		return nil, err
+	}
+	data, err := in.readAll([]string{"the policy", "the params"}, []*string{policy, params})
+	if err != nil {
+		return nil, err
+	}
+	if len(data[0]) == 0 {
+		return nil, errors.New("a policy is required, use -policy")
+	}
+	if *objects == "" {
+		return nil, errors.New("objects are required, use -objects")
+	}
+	objectsData, err := in.readObjects(*objects)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []k8s.Option{}
+	if len(data[1]) > 0 {
+		opts = append(opts, k8s.WithParams(data[1]))
+	}
+	output, err := k8s.AuditValidatingAdmissionPolicy(data[0], objectsData, *create, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var response k8s.AuditResponse
+	if err := json.Unmarshal([]byte(output), &response); err != nil {
+		return nil, fmt.Errorf("failed to decode the output: %w", err)
+	}
+	res := &result{output: output, table: auditTable, code: exitPassed}
+	switch {
+	case response.Summary.Errors > 0:
+		res.code = exitError
+	case response.Summary.Violating > 0:
+		res.code = exitDenied
+	}
+	return res, nil
+}
+
+// readObjects reads the objects from a file, stdin, or the YAML and JSON files of a directory and its subdirectories,
+// as a single YAML stream.
+func (in *inputs) readObjects(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if path == "-" || err != nil || !info.IsDir() {
+		return in.read("the objects", path)
+	}
+	var stream bytes.Buffer
+	err = filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		switch filepath.Ext(file) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		stream.WriteString("---\n")
+		stream.Write(data)
+		stream.WriteString("\n")
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the objects: %w", err)
+	}
+	return stream.Bytes(), nil
+}
+
+func testCommand(args []string, in *inputs) (*result, error) {
+	in.flags.Usage = func() {
+		fmt.Fprintln(in.flags.Output(), "Usage: cel-playground test [flags] <suite>... ('-' for stdin)")
+		in.flags.PrintDefaults()
+	}
+	if err := in.flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if in.flags.NArg() == 0 {
+		return nil, errors.New("at least one test suite is required")
+	}
+
+	suites := map[string]*k8s.TestSuiteResult{}
+	var order []string
+	code := exitPassed
+	for _, path := range in.flags.Args() {
+		data, err := in.read("the test suite", path)
+		if err != nil {
+			return nil, err
+		}
+		suiteResult, err := k8s.RunTestSuite(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if suiteResult.Failed > 0 {
+			code = exitDenied
+		}
+		suites[path] = suiteResult
+		order = append(order, path)
+	}
+	out, err := json.Marshal(suites)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the output: %w", err)
+	}
+	return &result{output: string(out), code: code, table: func(w io.Writer, output string) error {
+		return testTable(w, order, suites)
+	}}, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	const input = "object:\n  replicas: 2\n"
+	tests := []struct {
+		name       string
+		args       []string
+		stdin      string
+		wantCode   int
+		wantStdout string
+		wantStderr string
+	}{{
+		name:       "table",
+		args:       []string{"eval", "-e", "object.replicas > 1", "-input", "-"},
+		stdin:      input,
+		wantCode:   exitPassed,
+		wantStdout: "RESULT  true\nTYPE    bool\nCOST    3\n",
+	}, {
+		name:       "json",
+		args:       []string{"eval", "-o", "json", "-e", "object.replicas > 1", "-input", "-"},
+		stdin:      input,
+		wantCode:   exitPassed,
+		wantStdout: "{\n  \"result\": true,\n  \"type\": \"bool\",\n  \"cost\": 3\n}\n",
+	}, {
+		name:       "yaml",
+		args:       []string{"eval", "-o", "yaml", "-e", "object.replicas > 1", "-input", "-"},
+		stdin:      input,
+		wantCode:   exitPassed,
+		wantStdout: "result: true\ntype: bool\ncost: 3\n",
+	}, {
+		name:       "expression from stdin",
+		args:       []string{"eval", "-o", "json", "-f", "-"},
+		stdin:      "1 + 2",
+		wantCode:   exitPassed,
+		wantStdout: "{\n  \"result\": \"3\",\n  \"type\": \"int\",\n  \"cost\": 1\n}\n",
+	}, {
+		name:       "false expression",
+		args:       []string{"eval", "-e", "object.replicas > 5", "-input", "-"},
+		stdin:      input,
+		wantCode:   exitDenied,
+		wantStdout: "RESULT  false\nTYPE    bool\nCOST    3\n",
+	}, {
+		name:       "denied request",
+		args:       []string{"vap", "-policy", "../../k8s/testdata/vap/policy1.yaml", "-object", "../../k8s/testdata/vap/updated1.yaml"},
+		wantCode:   exitDenied,
+		wantStdout: "KIND        NAME  RESULT  MESSAGE\nvalidation  -     false   All production deployments should be HA with at least three replicas\n\nDENIED\n",
+	}, {
+		name:     "passing test suite",
+		args:     []string{"test", "../../k8s/testdata/suite/replicas.yaml"},
+		wantCode: exitPassed,
+		wantStdout: "../../k8s/testdata/suite/replicas.yaml\n" +
+			"  PASS  within the default limit\n" +
+			"  PASS  above the limit of the params\n" +
+			"  PASS  requests of nodes are not matched\n" +
+			"3 passed, 0 failed\n",
+	}, {
+		name:       "evaluation error",
+		args:       []string{"eval", "-e", "object.missing", "-input", "-"},
+		stdin:      input,
+		wantCode:   exitError,
+		wantStderr: "error: failed to evaluate: no such key: missing\n",
+	}, {
+		name:       "compilation error",
+		args:       []string{"eval", "-e", "a &&"},
+		wantCode:   exitError,
+		wantStderr: "error: failed to compile the CEL expression",
+	}, {
+		name:       "invalid input",
+		args:       []string{"eval", "-e", "true", "-input", "-"},
+		stdin:      "[1, 2]",
+		wantCode:   exitError,
+		wantStderr: "error: failed to decode input",
+	}, {
+		name:       "stdin used twice",
+		args:       []string{"eval", "-f", "-", "-input", "-"},
+		stdin:      input,
+		wantCode:   exitError,
+		wantStderr: "error: failed to read the input: stdin is already used by another input\n",
+	}, {
+		name:       "missing expression",
+		args:       []string{"eval"},
+		wantCode:   exitError,
+		wantStderr: "error: an expression is required, use -e or -f\n",
+	}, {
+		name:       "unknown output format",
+		args:       []string{"eval", "-o", "xml", "-e", "true"},
+		wantCode:   exitError,
+		wantStderr: "error: unknown output format xml, expecting json, yaml or table\n",
+	}, {
+		name:       "unknown flag",
+		args:       []string{"eval", "-x"},
+		wantCode:   exitError,
+		wantStderr: "flag provided but not defined: -x",
+	}, {
+		name:       "unknown command",
+		args:       []string{"nope"},
+		wantCode:   exitError,
+		wantStderr: "unknown command nope\n\n" + usage,
+	}, {
+		name:       "no command",
+		wantCode:   exitError,
+		wantStderr: usage,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+			if code != tt.wantCode {
+				t.Errorf("Expected exit code %d, received %d, stderr %q", tt.wantCode, code, stderr.String())
+			}
+			if got := stdout.String(); got != tt.wantStdout {
+				t.Errorf("Expected stdout\n%s\nreceived\n%s", tt.wantStdout, got)
+			}
+			if got := stderr.String(); !strings.HasPrefix(got, tt.wantStderr) || tt.wantStderr == "" && got != "" {
+				t.Errorf("Expected stderr starting with %q, received %q", tt.wantStderr, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/undistro/cel-playground/eval"
+	"github.com/undistro/cel-playground/k8s"
+	"github.com/undistro/cel-playground/utils"
+)
+
+// write prints the result in the format: json, yaml or table.
+func write(w io.Writer, format string, res *result) error {
+	switch format {
+	case "json":
+		var out bytes.Buffer
+		if err := json.Indent(&out, []byte(res.output), "", "  "); err != nil {
+			return fmt.Errorf("failed to indent the output: %w", err)
+		}
+		out.WriteByte('\n')
+		_, err := out.WriteTo(w)
+		return err
+	case "yaml":
+		return writeYAML(w, res.output)
+	case "table":
+		return res.table(w, res.output)
+	default:
+		return fmt.Errorf("unknown output format %s, expecting json, yaml or table", format)
+	}
+}
+
+// writeYAML converts the JSON output into block style YAML, keeping the order of the fields.
+func writeYAML(w io.Writer, output string) error {
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(output), &node); err != nil {
+		return fmt.Errorf("failed to decode the output: %w", err)
+	}
+	clearStyle(&node)
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return fmt.Errorf("failed to encode the output: %w", err)
+	}
+	return encoder.Close()
+}
+
+// clearStyle drops the flow and quoting styles of JSON, strings which would not be read back as strings stay quoted.
+func clearStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearStyle(child)
+	}
+}
+
+func evalTable(w io.Writer, output string) error {
+	var response eval.EvalResponse
+	if err := json.Unmarshal([]byte(output), &response); err != nil {
+		return fmt.Errorf("failed to decode the output: %w", err)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if response.Residual != "" {
+		fmt.Fprintf(tw, "RESIDUAL\t%s\n", response.Residual)
+	} else {
+		fmt.Fprintf(tw, "RESULT\t%s\n", value(response.Result))
+	}
+	if response.Type != "" {
+		fmt.Fprintf(tw, "TYPE\t%s\n", response.Type)
+	}
+	if response.Cost != nil {
+		fmt.Fprintf(tw, "COST\t%d\n", *response.Cost)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return diagnosticsTable(w, response.Diagnostics)
+}
+
+// policyTable prints a row per expression of a validating admission policy and whether the request is admitted.
+func policyTable(w io.Writer, output string, failClosed bool) error {
+	var response k8s.EvalResponse
+	if err := json.Unmarshal([]byte(output), &response); err != nil {
+		return fmt.Errorf("failed to decode the output: %w", err)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tNAME\tRESULT\tMESSAGE")
+	variablesRows(tw, response.MatchConditionsVariables)
+	resultsRows(tw, "matchCondition", response.MatchConditions)
+	variablesRows(tw, response.ValidationVariables)
+	resultsRows(tw, "validation", response.Validations)
+	resultsRows(tw, "auditAnnotation", response.AuditAnnotations)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	switch {
+	case !response.Matched():
+		fmt.Fprintln(w, "\nNOT MATCHED: the request is admitted")
+	case response.Allowed(failClosed):
+		fmt.Fprintln(w, "\nALLOWED")
+	default:
+		fmt.Fprintln(w, "\nDENIED")
+	}
+	return diagnosticsTable(w, response.Diagnostics)
+}
+
+// webhooksTable prints a row per match condition of each webhook and whether the webhook would be called.
+func webhooksTable(w io.Writer, output string) error {
+	var response k8s.EvalResponse
+	if err := json.Unmarshal([]byte(output), &response); err != nil {
+		return fmt.Errorf("failed to decode the output: %w", err)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "WEBHOOK\tNAME\tRESULT\tCALLED")
+	matched := response.WebhooksMatched()
+	for i, matchConditions := range response.WebhookMatchConditions {
+		for _, matchCondition := range matchConditions {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%t\n", i+1, name(matchCondition.Name), outcome(matchCondition), matched[i])
+		}
+		if len(matchConditions) == 0 {
+			fmt.Fprintf(tw, "%d\t-\t-\t%t\n", i+1, matched[i])
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return diagnosticsTable(w, response.Diagnostics)
+}
+
+// testTable prints a line per test case, the expectations which were not met and the totals of each suite.
+func testTable(w io.Writer, order []string, suites map[string]*k8s.TestSuiteResult) error {
+	for i, path := range order {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		suite := suites[path]
+		fmt.Fprintln(w, path)
+		for _, testCase := range suite.Cases {
+			status := "PASS"
+			if !testCase.Passed {
+				status = "FAIL"
+			}
+			fmt.Fprintf(w, "  %s  %s\n", status, testCase.Name)
+			if testCase.Error != "" {
+				fmt.Fprintf(w, "        error: %s\n", testCase.Error)
+			}
+			for _, diff := range testCase.Diffs {
+				fmt.Fprintf(w, "        %s\n", diff)
+			}
+		}
+		fmt.Fprintf(w, "%d passed, %d failed\n", suite.Passed, suite.Failed)
+	}
+	return nil
+}
+
+func variablesRows(w io.Writer, variables []*k8s.EvalVariable) {
+	for _, variable := range variables {
+		if variable.IsError {
+			fmt.Fprintf(w, "variable\t%s\terror\t%s\n", variable.Name, *variable.Error)
+		} else {
+			fmt.Fprintf(w, "variable\t%s\t%s\t\n", variable.Name, value(variable.Value))
+		}
+	}
+}
+
+func resultsRows(w io.Writer, kind string, results []*k8s.EvalResult) {
+	for _, res := range results {
+		message := ""
+		switch {
+		case res.IsError:
+			message = *res.Error
+		case res.Message != nil:
+			message = value(res.Message)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", kind, name(res.Name), outcome(res), message)
+	}
+}
+
+func diagnosticsTable(w io.Writer, diagnostics []utils.Diagnostic) error {
+	if len(diagnostics) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEVERITY\tPATH\tRULE\tMESSAGE")
+	for _, diagnostic := range diagnostics {
+		path := diagnostic.Path
+		if diagnostic.Start != nil {
+			path = fmt.Sprintf("%s:%d:%d", path, diagnostic.Start.Line, diagnostic.Start.Column)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", diagnostic.Severity, path, diagnostic.Rule, diagnostic.Message)
+	}
+	return tw.Flush()
+}
+
+func name(name *string) string {
+	if name == nil {
+		return "-"
+	}
+	return *name
+}
+
+func outcome(res *k8s.EvalResult) string {
+	if res.IsError {
+		return "error"
+	}
+	return value(res.Result)
+}
+
+// value prints the value as compact JSON, and strings as they are.
+func value(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// batchTable prints a row per item of a batch evaluation, then the counts of the summary.
+func batchTable(w io.Writer, output string) error {
+	var response eval.BatchResponse
+	if err := json.Unmarshal([]byte(output), &response); err != nil {
+		return fmt.Errorf("failed to decode the output: %w", err)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "INDEX\tNAME\tRESULT\tCOST")
+	for _, item := range response.Items {
+		itemName := item.Name
+		if itemName == "" {
+			itemName = "-"
+		}
+		switch {
+		case item.Error != "":
+			fmt.Fprintf(tw, "%d\t%s\terror: %s\t-\n", item.Index, itemName, item.Error)
+		case item.Residual != "":
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", item.Index, itemName, item.Residual, cost(item.Cost))
+		default:
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", item.Index, itemName, value(item.Result), cost(item.Cost))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	summary := response.Summary
+	fmt.Fprintf(w, "\n%d items: %d true, %d false, %d errors, total cost %d\n",
+		summary.Total, summary.True, summary.False, summary.Errors, summary.Cost)
+	return diagnosticsTable(w, response.Diagnostics)
+}
+
+func auditTable(w io.Writer, output string) error {
+	var response k8s.AuditResponse
+	if err := json.Unmarshal([]byte(output), &response); err != nil {
+		return fmt.Errorf("failed to decode the output: %w", err)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tMESSAGE\tOBJECTS")
+	for _, violation := range response.Violations {
+		namespace := violation.Namespace
+		if namespace == "" {
+			namespace = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", namespace, violation.Message, strings.Join(violation.Objects, ", "))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	summary := response.Summary
+	_, err := fmt.Fprintf(w, "\n%d objects: %d matched, %d violating, %d errors, total cost %d\n",
+		summary.Objects, summary.Matched, summary.Violating, summary.Errors, response.Cost)
+	return err
+}
+
+func cost(c *uint64) string {
+	if c == nil {
+		return "-"
+	}
+	return fmt.Sprint(*c)
+}
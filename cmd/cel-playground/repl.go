@@ -0,0 +1,242 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/undistro/cel-playground/eval"
+)
+
+const replHelp = `Enter a CEL expression to evaluate it, or one of:
+  let <name> = <expr>  bind the result of the expression to a variable
+  :load <file>         load the top-level keys of a YAML or JSON file as variables
+  :type <expr>         show the type of the expression without evaluating it
+  :cost                show the cost of the last evaluation
+  :profile [version]   show or switch the Kubernetes version of the environment
+  :vars                list the variables
+  :history [n]         show the last n entries of the history
+  :help                show this help
+  :quit                exit
+End a line with '\' to continue the expression on the next line.
+`
+
+var letStatement = regexp.MustCompile(`^let\s+([^\s=]+)\s*=\s*(.+)$`)
+
+// repl reads statements from stdin until it is closed or :quit is entered, errors are printed and do not stop it.
+type repl struct {
+	session *eval.Session
+	out     io.Writer
+	history []string
+	file    string
+}
+
+func replCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("repl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	input := flags.String("input", "", "YAML or JSON file whose top-level keys are loaded as variables")
+	declarations := flags.String("declarations", "", "YAML file declaring the types of the variables")
+	profile := flags.String("profile", "", "Kubernetes version of the environment, "+strings.Join(eval.Profiles(), ", "))
+	historyFile := flags.String("history", defaultHistoryFile(), "file the history is kept in, empty to keep none")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+
+	opts := []eval.Option{eval.WithProfile(*profile)}
+	if *declarations != "" {
+		data, err := os.ReadFile(*declarations)
+		if err == nil {
+			var parsed eval.Declarations
+			if parsed, err = eval.ParseDeclarations(data); err == nil {
+				opts = append(opts, eval.WithDeclarations(parsed))
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "error: failed to read the declarations: %v\n", err)
+			return exitError
+		}
+	}
+	r := &repl{session: eval.NewSession(opts...), out: stdout, file: *historyFile}
+	if err := r.session.SetProfile(*profile); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return exitError
+	}
+	if *input != "" {
+		if err := r.load(*input); err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return exitError
+		}
+	}
+	r.loadHistory()
+
+	fmt.Fprintf(stdout, "CEL playground REPL, profile %s. Enter :help for the commands.\n", r.session.Profile())
+	scanner := bufio.NewScanner(stdin)
+	scanner.Buffer(nil, 1<<20)
+	var statement strings.Builder
+	prompt := "cel> "
+	for fmt.Fprint(stdout, prompt); scanner.Scan(); fmt.Fprint(stdout, prompt) {
+		line := scanner.Text()
+		if strings.HasSuffix(line, `\`) {
+			statement.WriteString(strings.TrimSuffix(line, `\`) + "\n")
+			prompt = "...> "
+			continue
+		}
+		statement.WriteString(line)
+		text := strings.TrimSpace(statement.String())
+		statement.Reset()
+		prompt = "cel> "
+		if text == "" {
+			continue
+		}
+		if text == ":quit" || text == ":q" || text == ":exit" {
+			break
+		}
+		r.addHistory(text)
+		if err := r.execute(text); err != nil {
+			fmt.Fprintf(stdout, "error: %v\n", err)
+		}
+	}
+	fmt.Fprintln(stdout)
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(stderr, "error: failed to read stdin: %v\n", err)
+		return exitError
+	}
+	return exitPassed
+}
+
+func (r *repl) execute(text string) error {
+	command, arg, _ := strings.Cut(text, " ")
+	arg = strings.TrimSpace(arg)
+	switch command {
+	case ":help", ":h":
+		fmt.Fprint(r.out, replHelp)
+	case ":load":
+		if err := r.load(arg); err != nil {
+			return err
+		}
+		fmt.Fprintf(r.out, "variables: %s\n", strings.Join(r.session.Variables(), ", "))
+	case ":type", ":t":
+		typ, err := r.session.Type(arg)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(r.out, typ)
+	case ":cost":
+		if cost := r.session.Cost(); cost != nil {
+			fmt.Fprintln(r.out, *cost)
+		} else {
+			fmt.Fprintln(r.out, "no evaluation yet")
+		}
+	case ":profile":
+		if arg != "" {
+			if err := r.session.SetProfile(arg); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(r.out, "%s (available: %s)\n", r.session.Profile(), strings.Join(eval.Profiles(), ", "))
+	case ":vars":
+		fmt.Fprintln(r.out, strings.Join(r.session.Variables(), ", "))
+	case ":history":
+		n := len(r.history)
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil {
+				return fmt.Errorf("invalid number of entries %q", arg)
+			}
+		}
+		for i := max(0, len(r.history)-n); i < len(r.history); i++ {
+			fmt.Fprintf(r.out, "%4d  %s\n", i+1, r.history[i])
+		}
+	default:
+		if strings.HasPrefix(command, ":") {
+			return fmt.Errorf("unknown command %s, enter :help for the commands", command)
+		}
+		return r.evaluate(text)
+	}
+	return nil
+}
+
+func (r *repl) evaluate(text string) error {
+	var response *eval.EvalResponse
+	var err error
+	if match := letStatement.FindStringSubmatch(text); match != nil {
+		response, err = r.session.Let(match[1], match[2])
+	} else {
+		response, err = r.session.Eval(text)
+	}
+	if err != nil {
+		return err
+	}
+	if response.Residual != "" {
+		fmt.Fprintf(r.out, "residual: %s\n", response.Residual)
+		return nil
+	}
+	fmt.Fprintf(r.out, "%s : %s\n", value(response.Result), response.Type)
+	return nil
+}
+
+func (r *repl) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read the input: %w", err)
+	}
+	return r.session.Load(data)
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".cel_playground_history")
+}
+
+func (r *repl) loadHistory() {
+	if r.file == "" {
+		return
+	}
+	data, err := os.ReadFile(r.file)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if text, err := strconv.Unquote(line); err == nil {
+			r.history = append(r.history, text)
+		}
+	}
+}
+
+// addHistory appends the statement to the history and its file, one quoted Go string per line so that multi-line
+// statements and backslashes are kept.
+func (r *repl) addHistory(text string) {
+	r.history = append(r.history, text)
+	if r.file == "" {
+		return
+	}
+	f, err := os.OpenFile(r.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, strconv.Quote(text))
+}
@@ -0,0 +1,35 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history")
+	statements := []string{"1 + 2", "let a = [\n  1,\n  2\n]", `'a\nb'.split('\\n')`, `"\"quoted\""`}
+	r := &repl{file: file}
+	for _, statement := range statements {
+		r.addHistory(statement)
+	}
+	loaded := &repl{file: file}
+	loaded.loadHistory()
+	if !reflect.DeepEqual(loaded.history, statements) {
+		t.Errorf("Expected the history %q, received %q", statements, loaded.history)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/undistro/cel-playground/modes"
+	"github.com/undistro/cel-playground/utils"
+)
+
+// limits bound the resources used by each evaluation request.
+type limits struct {
+	maxBodySize int64
+	timeout     time.Duration
+	costLimit   uint64
+}
+
+// args are the inputs of an evaluation, named as the arguments of the WASM functions, e.g.
+//
+//	{"cel": "object.replicas > 1", "dataInput": "object:\n  replicas: 2", "trace": true}
+//
+// Inputs are YAML or JSON documents given as strings, or as JSON values.
+type args map[string]json.RawMessage
+
+func (a args) Input(id string) []byte {
+	raw, ok := a[id]
+	if !ok || string(raw) == "null" {
+		return []byte{}
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []byte(s)
+	}
+	// JSON values are YAML documents as well
+	return raw
+}
+
+func (a args) Flag(name string) bool {
+	var b bool
+	return json.Unmarshal(a[name], &b) == nil && b
+}
+
+func (a args) Int(name string) (int, bool) {
+	var i int
+	return i, json.Unmarshal(a[name], &i) == nil
+}
+
+// errorResponse is the body of failed requests, diagnostics locate the errors of expressions.
+type errorResponse struct {
+	Error       string             `json:"error"`
+	Diagnostics []utils.Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// evalHandler serves POST /api/v1/eval/{mode}, responding with the JSON result of the evaluation.
+func evalHandler(l limits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mode := modes.Get(r.PathValue("mode"))
+		if mode == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown mode %s", r.PathValue("mode")))
+			return
+		}
+
+		var a args
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, l.maxBodySize)).Decode(&a); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeError(w, http.StatusRequestEntityTooLarge,
+					fmt.Errorf("the request body exceeds the limit of %d bytes", maxBytesErr.Limit))
+				return
+			}
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to decode the request body: %w", err))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), l.timeout)
+		defer cancel()
+		output, err := mode.Run(ctx, modes.Eval, a, modes.Options{CostLimit: l.costLimit})
+		var interrupted *utils.InterruptedError
+		if errors.As(err, &interrupted) {
+			if errors.Is(err, context.DeadlineExceeded) {
+				writeError(w, http.StatusServiceUnavailable,
+					fmt.Errorf("the evaluation exceeded the timeout of %s after a cost of %d", l.timeout, interrupted.Cost))
+			}
+			// otherwise the client went away
+			return
+		} else if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write([]byte(output)); err != nil {
+			log.Printf("failed to write the response: %v", err)
+		}
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body := errorResponse{Error: err.Error()}
+	var diagnosticsErr *utils.DiagnosticsError
+	if errors.As(err, &diagnosticsErr) {
+		body.Diagnostics = diagnosticsErr.Diagnostics
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("failed to write the response: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvalHandler(t *testing.T) {
+	items := make([]string, 2000)
+	for i := range items {
+		items[i] = strconv.Itoa(i)
+	}
+	slowBody := `{"cel": "object.items.all(i, object.items.all(j, i + j >= 0))", "dataInput": {"object": {"items": [` +
+		strings.Join(items, ",") + `]}}}`
+
+	tests := []struct {
+		name            string
+		mode            string
+		body            string
+		maxBodySize     int64
+		wantStatus      int
+		wantResult      any
+		wantError       string
+		wantDiagnostics bool
+	}{{
+		name:       "evaluation",
+		mode:       "cel",
+		body:       `{"cel": "object.replicas > 1", "dataInput": "object:\n  replicas: 2"}`,
+		wantStatus: http.StatusOK,
+		wantResult: true,
+	}, {
+		name:       "unknown mode",
+		mode:       "unknown",
+		body:       `{}`,
+		wantStatus: http.StatusNotFound,
+		wantError:  "unknown mode unknown",
+	}, {
+		name:       "invalid body",
+		mode:       "cel",
+		body:       `{"cel": `,
+		wantStatus: http.StatusBadRequest,
+		wantError:  "failed to decode the request body",
+	}, {
+		name:        "body too large",
+		mode:        "cel",
+		body:        `{"cel": "` + strings.Repeat("a", 2048) + `"}`,
+		maxBodySize: 1024,
+		wantStatus:  http.StatusRequestEntityTooLarge,
+		wantError:   "the request body exceeds the limit of 1024 bytes",
+	}, {
+		name:            "compilation error",
+		mode:            "cel",
+		body:            `{"cel": "object.replicas >", "dataInput": "object:\n  replicas: 2"}`,
+		wantStatus:      http.StatusUnprocessableEntity,
+		wantError:       "failed to compile the CEL expression",
+		wantDiagnostics: true,
+	}, {
+		name:       "missing input",
+		mode:       "cel",
+		body:       `{"dataInput": "object:\n  replicas: 2"}`,
+		wantStatus: http.StatusUnprocessableEntity,
+		wantError:  "the CEL Expression input is required",
+	}, {
+		name:       "timeout",
+		mode:       "cel",
+		body:       slowBody,
+		wantStatus: http.StatusServiceUnavailable,
+		wantError:  "the evaluation exceeded the timeout of 10ms",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := limits{maxBodySize: 1 << 20, timeout: 10 * time.Millisecond}
+			if tt.maxBodySize > 0 {
+				l.maxBodySize = tt.maxBodySize
+			}
+			handler := http.NewServeMux()
+			handler.Handle("POST /api/v1/eval/{mode}", evalHandler(l))
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/eval/"+tt.mode, strings.NewReader(tt.body)))
+
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, received %d: %s", tt.wantStatus, recorder.Code, recorder.Body)
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("Expected a JSON response, received %q", contentType)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var body struct {
+					Result any `json:"result"`
+				}
+				if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+					t.Fatalf("failed to decode the response: %v", err)
+				}
+				if body.Result != tt.wantResult {
+					t.Errorf("Expected the result %v, received %v", tt.wantResult, body.Result)
+				}
+				return
+			}
+			var body errorResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to decode the error response: %v", err)
+			}
+			if !strings.HasPrefix(body.Error, tt.wantError) {
+				t.Errorf("Expected an error starting with %q, received %q", tt.wantError, body.Error)
+			}
+			if (len(body.Diagnostics) > 0) != tt.wantDiagnostics {
+				t.Errorf("Expected diagnostics %v, received %v", tt.wantDiagnostics, body.Diagnostics)
+			}
+		})
+	}
+}
@@ -18,16 +18,27 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"time"
 )
 
 var (
-	listen = flag.String("listen", ":8080", "listen address")
-	dir    = flag.String("dir", ".", "directory to serve")
+	listen      = flag.String("listen", ":8080", "listen address")
+	dir         = flag.String("dir", ".", "directory to serve")
+	maxBodySize = flag.Int64("max-body-size", 1<<20, "maximum size in bytes of evaluation requests")
+	timeout     = flag.Duration("timeout", 5*time.Second, "maximum duration of evaluation requests")
+	costLimit   = flag.Uint64("cost-limit", 1000000, "maximum runtime cost of each evaluated expression")
 )
 
 func main() {
 	flag.Parse()
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir(*dir)))
+	mux.Handle("POST /api/v1/eval/{mode}", evalHandler(limits{
+		maxBodySize: *maxBodySize,
+		timeout:     *timeout,
+		costLimit:   *costLimit,
+	}))
 	log.Printf("listening on %s...", *listen)
-	err := http.ListenAndServe(*listen, http.FileServer(http.Dir(*dir)))
+	err := http.ListenAndServe(*listen, mux)
 	log.Fatalln(err)
 }
@@ -0,0 +1,171 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command update-data generates the data of the front end from the mode registry: web/assets/modes.json, describing
+// the modes, and the examples of each mode in web/assets/examples, converted from their YAML files.
+// Run it from the root of the repository.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+
+	"github.com/undistro/cel-playground/modes"
+	"gopkg.in/yaml.v3"
+)
+
+var dir = flag.String("dir", "web/assets", "directory of the front end assets")
+
+func main() {
+	flag.Parse()
+	if err := run(*dir); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(dir string) error {
+	celVersion, err := moduleVersion("github.com/google/cel-go")
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(modes.All(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal the modes: %w", err)
+	}
+	if err := writeFile(filepath.Join(dir, "modes.json"), data); err != nil {
+		return err
+	}
+	for _, mode := range modes.All() {
+		data, err := examplesJSON(mode, celVersion)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(dir, "examples", mode.ID()+".json"), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moduleVersion returns the version of a dependency the command is built with.
+func moduleVersion(path string) (string, error) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", errors.New("failed to read the build info")
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == path {
+			return dep.Version, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not a dependency", path)
+}
+
+// examplesJSON converts the examples file of the mode, keeping the order of its fields, and sets the version of cel-go.
+func examplesJSON(mode *modes.Mode, celVersion string) ([]byte, error) {
+	input, err := os.ReadFile(mode.Examples)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the examples of %s: %w", mode.ID(), err)
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(input, &root); err != nil {
+		return nil, fmt.Errorf("failed to decode the examples of %s: %w", mode.ID(), err)
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("the examples of %s are not a mapping", mode.ID())
+	}
+	examples := root.Content[0]
+	examples.Content = append(examples.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "versions"},
+		&yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: "cel-go"},
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: celVersion},
+		}},
+	)
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, examples); err != nil {
+		return nil, fmt.Errorf("failed to convert the examples of %s: %w", mode.ID(), err)
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, buf.Bytes(), "", "  "); err != nil {
+		return nil, fmt.Errorf("failed to indent the examples of %s: %w", mode.ID(), err)
+	}
+	return indented.Bytes(), nil
+}
+
+// writeJSON writes the node as JSON, mappings in the order of their keys.
+func writeJSON(buf *bytes.Buffer, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return writeJSON(buf, node.Alias)
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeValue(buf, node.Content[i].Value); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := writeJSON(buf, node.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, item := range node.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		var value any
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		return writeValue(buf, value)
+	}
+	return nil
+}
+
+func writeValue(buf *bytes.Buffer, value any) error {
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+	// the encoder terminates values with a newline
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+func writeFile(path string, data []byte) error {
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
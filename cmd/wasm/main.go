@@ -17,54 +17,54 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"syscall/js"
+	"time"
 
-	"github.com/undistro/cel-playground/eval"
-	"github.com/undistro/cel-playground/k8s"
+	"github.com/undistro/cel-playground/modes"
+	"github.com/undistro/cel-playground/utils"
 )
 
-type execFunction func(mode string, argMap js.Value) (string, error)
+// jsArgs are the arguments of the functions of a mode, an object of inputs given as strings and of options.
+type jsArgs struct {
+	js.Value
+}
 
-func getArg(value js.Value, name string) []byte {
-	arg := value.Get(name)
+func (a jsArgs) Input(id string) []byte {
+	arg := a.Get(id)
 	if arg.Type() == js.TypeString {
 		return []byte(arg.String())
 	}
 	return []byte{}
 }
 
-var modeExecFns = map[string]execFunction{
-	"cel": func(mode string, argMap js.Value) (string, error) {
-		return eval.CelEval(
-			getArg(argMap, "cel"),
-			getArg(argMap, "dataInput"),
-		)
-	},
-	"vap": func(mode string, argMap js.Value) (string, error) {
-		return k8s.EvalValidatingAdmissionPolicy(
-			getArg(argMap, "vap"),
-			getArg(argMap, "dataOldObject"),
-			getArg(argMap, "dataObject"),
-			getArg(argMap, "dataNamespace"),
-			getArg(argMap, "dataRequest"),
-			getArg(argMap, "dataAuthorizer"),
-		)
-	},
-	"webhooks": func(mode string, argMap js.Value) (string, error) {
-		return k8s.EvalWebhook(
-			getArg(argMap, "webhooks"),
-			getArg(argMap, "dataOldObject"),
-			getArg(argMap, "dataObject"),
-			getArg(argMap, "dataRequest"),
-			getArg(argMap, "dataAuthorizer"),
-		)
-	},
+func (a jsArgs) Flag(name string) bool {
+	arg := a.Get(name)
+	return arg.Type() == js.TypeBoolean && arg.Bool()
+}
+
+func (a jsArgs) Int(name string) (int, bool) {
+	arg := a.Get(name)
+	if arg.Type() != js.TypeNumber {
+		return 0, false
+	}
+	return arg.Int(), true
 }
 
 func main() {
-	defer addFunction("eval", dynamicEvalWrapper).Release()
+	defer addFunction("eval", dynamicWrapper(modes.Eval)).Release()
+	defer addFunction("check", dynamicWrapper(modes.Check)).Release()
+	defer addFunction("format", dynamicWrapper(modes.Format)).Release()
+	defer addFunction("abort", abortWrapper).Release()
+	defer addFunction("evalAsync", asyncWrapper(modes.Eval, jsonResult)).Release()
+	defer addFunction("checkAsync", asyncWrapper(modes.Check, jsonResult)).Release()
+	defer addFunction("formatAsync", asyncWrapper(modes.Format, textResult)).Release()
+	defer addFunction("modes", modesWrapper).Release()
 	<-make(chan bool)
 }
 
@@ -74,29 +74,244 @@ func addFunction(name string, fn func(js.Value, []js.Value) any) js.Func {
 	return function
 }
 
-func dynamicEvalWrapper(_ js.Value, args []js.Value) any {
+// modeArg returns the mode given as first argument, the second being the object of its arguments.
+func modeArg(args []js.Value) (*modes.Mode, error) {
 	if len(args) < 2 {
-		return response("", errors.New("invalid arguments"))
+		return nil, errors.New("invalid arguments")
 	}
 	if args[0].Type() != js.TypeString || args[1].Type() != js.TypeObject {
-		return response("", errors.New("invalid argument types, expecting string and object"))
+		return nil, errors.New("invalid argument types, expecting string and object")
+	}
+	mode := modes.Get(args[0].String())
+	if mode == nil {
+		return nil, fmt.Errorf("unknown mode %s", args[0].String())
+	}
+	return mode, nil
+}
+
+func dynamicWrapper(operation modes.Operation) func(js.Value, []js.Value) any {
+	return func(_ js.Value, args []js.Value) any {
+		defer utils.BlockingCall()()
+		mode, err := modeArg(args)
+		if err != nil {
+			return response("", err, utils.ErrorDiagnostics(err))
+		}
+
+		ctx, done := evaluationContext(args[1])
+		defer done()
+		output, err := mode.Run(ctx, operation, jsArgs{args[1]}, modes.Options{})
+		if err != nil {
+			return response("", err, editorDiagnostics(mode, jsArgs{args[1]}, utils.ErrorDiagnostics(err)))
+		}
+		return response(output, nil, nil)
+	}
+}
+
+// asyncWrapper returns a function which runs the function of a mode in a goroutine and returns a Promise of its
+// structured response, so that JavaScript keeps control during the evaluation, e.g. to call abort. The promise is
+// rejected when the arguments are invalid, the response reports the other errors.
+func asyncWrapper(operation modes.Operation, result func(output string) (any, error)) func(js.Value, []js.Value) any {
+	return func(_ js.Value, args []js.Value) any {
+		executor := js.FuncOf(func(_ js.Value, promiseArgs []js.Value) any {
+			resolve, reject := promiseArgs[0], promiseArgs[1]
+			mode, err := modeArg(args)
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return nil
+			}
+			argMap := args[1]
+			// the context is created before returning to JavaScript so that an abort following the call applies to it
+			ctx, done := evaluationContext(argMap)
+			go func() {
+				defer done()
+				start := time.Now()
+				output, err := mode.Run(ctx, operation, jsArgs{argMap}, modes.Options{})
+				var value any
+				if err == nil {
+					value, err = result(output)
+				}
+				var diagnostics []utils.Diagnostic
+				if err != nil {
+					diagnostics = utils.ErrorDiagnostics(err)
+				} else {
+					diagnostics = outputDiagnostics(output)
+				}
+				diagnostics = editorDiagnostics(mode, jsArgs{argMap}, diagnostics)
+				resolve.Invoke(asyncResponse(value, err, diagnostics, time.Since(start)))
+			}()
+			return nil
+		})
+		defer executor.Release()
+		return js.Global().Get("Promise").New(executor)
+	}
+}
+
+// jsonResult decodes the JSON output of evaluations and checks into values which can be passed to JavaScript. Numbers
+// are not decoded as float64: the ones a JavaScript number can not represent exactly, integers beyond 2^53, are passed
+// as their decimal strings, see jsNumbers.
+func jsonResult(output string) (any, error) {
+	decoder := json.NewDecoder(strings.NewReader(output))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("failed to decode the output: %w", err)
+	}
+	return jsNumbers(value), nil
+}
+
+// maxSafeInteger is the largest integer from which JavaScript numbers are exact, Number.MAX_SAFE_INTEGER.
+const maxSafeInteger = 1<<53 - 1
+
+// jsNumbers replaces the numbers of a value decoded with UseNumber with float64, or with their decimal strings for the
+// integers beyond maxSafeInteger which float64 would round.
+func jsNumbers(value any) any {
+	switch value := value.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil && -maxSafeInteger <= i && i <= maxSafeInteger {
+			return float64(i)
+		} else if strings.ContainsAny(value.String(), ".eE") {
+			f, _ := value.Float64()
+			return f
+		}
+		return value.String()
+	case []any:
+		for i, item := range value {
+			value[i] = jsNumbers(item)
+		}
+	case map[string]any:
+		for key, item := range value {
+			value[key] = jsNumbers(item)
+		}
+	}
+	return value
+}
+
+// textResult keeps the output of formatting, an expression or a document.
+func textResult(output string) (any, error) {
+	return output, nil
+}
+
+// outputDiagnostics returns the diagnostics of the JSON output of evaluations and checks, outputs which are not JSON
+// objects, e.g. formatted expressions, have none.
+func outputDiagnostics(output string) []utils.Diagnostic {
+	var object struct {
+		Diagnostics []utils.Diagnostic `json:"diagnostics"`
+	}
+	if err := json.Unmarshal([]byte(output), &object); err != nil {
+		return nil
 	}
-	mode := args[0].String()
-	fn, ok := modeExecFns[mode]
-	if !ok {
-		return response("", fmt.Errorf("unknown mode %s", mode))
+	return object.Diagnostics
+}
+
+// editorDiagnostics locates the diagnostics in the editor of the expression of the mode: the diagnostics of the
+// expressions of a YAML document are located in the document, see utils.LocateDiagnostics.
+func editorDiagnostics(mode *modes.Mode, args jsArgs, diagnostics []utils.Diagnostic) []utils.Diagnostic {
+	if mode.Inputs[0].Language != "yaml" {
+		return diagnostics
 	}
+	return utils.LocateDiagnostics(args.Input(mode.ID()), diagnostics)
+}
 
-	output, err := fn(mode, args[1])
+// asyncResponse is the structured response of asynchronous functions: the result, the diagnostics of the result or of
+// the error, and the duration of the call. The cost incurred until then is reported when the evaluation is interrupted.
+func asyncResponse(result any, err error, diagnostics []utils.Diagnostic, elapsed time.Duration) map[string]any {
+	value := map[string]any{
+		"isError":     err != nil,
+		"diagnostics": diagnosticsValue(diagnostics),
+		"timings":     map[string]any{"totalMs": float64(elapsed.Microseconds()) / 1000},
+	}
 	if err != nil {
-		return response("", err)
+		value["error"] = err.Error()
+		var interrupted *utils.InterruptedError
+		if errors.As(err, &interrupted) {
+			value["cost"] = interrupted.Cost
+		}
+		return value
 	}
-	return response(output, nil)
+	value["result"] = result
+	return value
 }
 
-func response(out string, err error) any {
+// evaluations are the cancel functions of the evaluations in progress, by id.
+var evaluations = struct {
+	sync.Mutex
+	nextID  int
+	cancels map[int]context.CancelFunc
+}{cancels: map[int]context.CancelFunc{}}
+
+// evaluationContext returns the context of an evaluation, done after the timeout argument in milliseconds if any or
+// when abort is called, and the function to call once the evaluation completes.
+func evaluationContext(argMap js.Value) (context.Context, func()) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout := argMap.Get("timeout"); timeout.Type() == js.TypeNumber && timeout.Float() > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(timeout.Float()*float64(time.Millisecond)))
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	evaluations.Lock()
+	defer evaluations.Unlock()
+	id := evaluations.nextID
+	evaluations.nextID++
+	evaluations.cancels[id] = cancel
+	return ctx, func() {
+		evaluations.Lock()
+		defer evaluations.Unlock()
+		delete(evaluations.cancels, id)
+		cancel()
+	}
+}
+
+// abortWrapper interrupts the evaluations in progress, which return an error with the cost incurred until then.
+// Only asynchronous evaluations let JavaScript call it, the timeout argument bounds synchronous ones instead.
+func abortWrapper(js.Value, []js.Value) any {
+	evaluations.Lock()
+	defer evaluations.Unlock()
+	for _, cancel := range evaluations.cancels {
+		cancel()
+	}
+	return nil
+}
+
+// modesWrapper returns the registered modes, as they are described in web/assets/modes.json.
+func modesWrapper(js.Value, []js.Value) any {
+	data, err := json.Marshal(modes.All())
+	if err != nil {
+		panic(err)
+	}
+	value, err := jsonResult(string(data))
 	if err != nil {
-		out = err.Error()
+		panic(err)
+	}
+	return value
+}
+
+func response(out string, err error, diagnostics []utils.Diagnostic) any {
+	if err != nil {
+		return map[string]any{"output": err.Error(), "isError": true, "diagnostics": diagnosticsValue(diagnostics)}
+	}
+	return map[string]any{"output": out, "isError": false}
+}
+
+// diagnosticsValue converts the diagnostics into values which can be passed to JavaScript.
+func diagnosticsValue(diagnostics []utils.Diagnostic) []any {
+	values := make([]any, 0, len(diagnostics))
+	for _, diagnostic := range diagnostics {
+		value := map[string]any{"severity": string(diagnostic.Severity), "message": diagnostic.Message}
+		if diagnostic.Path != "" {
+			value["path"] = diagnostic.Path
+		}
+		if diagnostic.Start != nil {
+			value["start"] = map[string]any{"line": diagnostic.Start.Line, "column": diagnostic.Start.Column}
+		}
+		if diagnostic.End != nil {
+			value["end"] = map[string]any{"line": diagnostic.End.Line, "column": diagnostic.End.Column}
+		}
+		if diagnostic.Rule != "" {
+			value["rule"] = diagnostic.Rule
+			value["fix"] = diagnostic.Fix
+		}
+		values = append(values, value)
 	}
-	return map[string]any{"output": out, "isError": err != nil}
+	return values
 }
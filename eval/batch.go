@@ -0,0 +1,164 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eval
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/undistro/cel-playground/utils"
+)
+
+// BatchInput is the input of an evaluation of a batch, named after the Kubernetes object it binds, if any.
+type BatchInput struct {
+	Name      string
+	Variables map[string]any
+}
+
+// BatchItem is the evaluation of the expression against an input of a batch, either its response or its error.
+type BatchItem struct {
+	Index int    `json:"index"`
+	Name  string `json:"name,omitempty"`
+	*EvalResponse
+	Error string `json:"error,omitempty"`
+}
+
+// BatchSummary counts the items of a batch by outcome, results which are not booleans are only counted in Total.
+type BatchSummary struct {
+	Total  int    `json:"total"`
+	True   int    `json:"true"`
+	False  int    `json:"false"`
+	Errors int    `json:"errors"`
+	Cost   uint64 `json:"cost"`
+}
+
+// BatchResponse is the evaluation of an expression against each input of a batch, the diagnostics are the ones of the
+// expression.
+type BatchResponse struct {
+	Items       []BatchItem        `json:"items"`
+	Summary     BatchSummary       `json:"summary"`
+	Diagnostics []utils.Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// BatchInputs splits a YAML stream, or a JSON document, into the inputs of a batch. Kubernetes objects, the items of
+// Lists, see utils.ListItems, and the documents with an apiVersion and a kind, are bound to the object variable, the other documents are the
+// variables of their evaluation.
+func BatchInputs(input []byte) ([]BatchInput, error) {
+	documents, err := utils.DecodeDocuments(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode input: %w", err)
+	}
+	var inputs []BatchInput
+	for _, document := range documents {
+		if items, ok, err := utils.ListItems(document); err != nil {
+			return nil, err
+		} else if ok {
+			for _, item := range items {
+				inputs = append(inputs, objectInput(item))
+			}
+		} else if isKubernetesObject(document) {
+			inputs = append(inputs, objectInput(document))
+		} else {
+			inputs = append(inputs, BatchInput{Variables: document})
+		}
+	}
+	return inputs, nil
+}
+
+func isKubernetesObject(document map[string]any) bool {
+	_, hasAPIVersion := document["apiVersion"].(string)
+	_, hasKind := document["kind"].(string)
+	return hasAPIVersion && hasKind
+}
+
+// objectInput binds the object, named namespace/name, or name for cluster-scoped objects.
+func objectInput(object map[string]any) BatchInput {
+	input := BatchInput{Variables: map[string]any{"object": object}}
+	if metadata, ok := object["metadata"].(map[string]any); ok {
+		input.Name, _ = metadata["name"].(string)
+		if namespace, ok := metadata["namespace"].(string); ok && namespace != "" {
+			input.Name = namespace + "/" + input.Name
+		}
+	}
+	return input
+}
+
+// CelEvalBatch evaluates the cel expression against each input of the YAML stream, see BatchInputs.
+func CelEvalBatch(exp []byte, input []byte, opts ...Option) (string, error) {
+	inputs, err := BatchInputs(input)
+	if err != nil {
+		return "", err
+	}
+	response, err := evaluateBatch(newOptions(opts).context(), string(exp), inputs, opts)
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(response)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal the output: %w", err)
+	}
+	return string(out), nil
+}
+
+// EvaluateBatch compiles the expression of the request once, for the variables of all the inputs, and evaluates it
+// against each of them, the input of the request is not used. The failures of the evaluations are reported by their
+// items, the batch stops with a utils.InterruptedError, carrying the cost of the whole batch, when the context is done.
+func EvaluateBatch(ctx context.Context, request *Request, inputs []BatchInput) (*BatchResponse, error) {
+	return evaluateBatch(ctx, request.Expression, inputs, request.options())
+}
+
+func evaluateBatch(ctx context.Context, exp string, inputs []BatchInput, opts []Option) (*BatchResponse, error) {
+	var variables []string
+	for _, input := range inputs {
+		for name := range input.Variables {
+			variables = append(variables, name)
+		}
+	}
+	compiled, err := Compile(exp, variables, opts...)
+	if err != nil {
+		return nil, err
+	}
+	response := &BatchResponse{Items: make([]BatchItem, 0, len(inputs)), Diagnostics: compiled.diagnostics}
+	for i, input := range inputs {
+		item := BatchItem{Index: i, Name: input.Name}
+		itemResponse, err := compiled.EvalContext(ctx, input.Variables)
+		var interrupted *utils.InterruptedError
+		switch {
+		case errors.As(err, &interrupted):
+			return nil, utils.NewInterruptedError(ctx.Err(), response.Summary.Cost+interrupted.Cost)
+		case err != nil:
+			item.Error = err.Error()
+			response.Summary.Errors++
+		default:
+			item.EvalResponse = itemResponse
+			// the diagnostics of the expression are the ones of the batch
+			itemResponse.Diagnostics = nil
+			if itemResponse.Cost != nil {
+				response.Summary.Cost += *itemResponse.Cost
+			}
+			switch itemResponse.Result {
+			case true:
+				response.Summary.True++
+			case false:
+				response.Summary.False++
+			}
+		}
+		response.Summary.Total++
+		response.Items = append(response.Items, item)
+	}
+	return response, nil
+}
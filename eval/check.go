@@ -0,0 +1,119 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eval
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
+	"github.com/undistro/cel-playground/utils"
+	"gopkg.in/yaml.v2"
+)
+
+// CheckResponse is the result of type-checking an expression, Issues are only set when the expression is not valid.
+// Diagnostics are the lint findings of valid expressions, see WithLint.
+type CheckResponse struct {
+	Valid       bool               `json:"valid"`
+	OutputType  string             `json:"outputType,omitempty"`
+	Issues      []utils.Diagnostic `json:"issues,omitempty"`
+	Variables   []string           `json:"variables,omitempty"`
+	Functions   []string           `json:"functions,omitempty"`
+	Cost        *CostEstimate      `json:"cost,omitempty"`
+	Diagnostics []utils.Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// CostEstimate is the static estimate of the evaluation cost of an expression, the maximum is only meaningful when
+// the sizes of the variables are bounded, e.g. by their declared types.
+type CostEstimate struct {
+	Min uint64 `json:"min"`
+	Max uint64 `json:"max"`
+}
+
+// defaultCostEstimator provides no estimates, leaving the sizes of variables unbounded.
+type defaultCostEstimator struct{}
+
+func (defaultCostEstimator) EstimateSize(checker.AstNode) *checker.SizeEstimate {
+	return nil
+}
+
+func (defaultCostEstimator) EstimateCallCost(string, string, *checker.AstNode, []checker.AstNode) *checker.CallEstimate {
+	return nil
+}
+
+// CelCheck type-checks the expression against the declared variables, given either as a YAML list of names or as a
+// YAML map whose keys are the names, such as a sample of the input data.
+func CelCheck(exp []byte, variablesInput []byte, opts ...Option) (string, error) {
+	var declarations any
+	if err := yaml.Unmarshal(variablesInput, &declarations); err != nil {
+		return "", fmt.Errorf("failed to decode variables: %w", err)
+	}
+	var variables []string
+	switch declarations := declarations.(type) {
+	case []any:
+		for _, name := range declarations {
+			variables = append(variables, fmt.Sprint(name))
+		}
+	case map[any]any:
+		for name := range declarations {
+			variables = append(variables, fmt.Sprint(name))
+		}
+	case nil:
+	default:
+		return "", fmt.Errorf("failed to decode variables: expected a list of names or a map, got %T", declarations)
+	}
+
+	response, err := Check(string(exp), variables, opts...)
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(response)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal the output: %w", err)
+	}
+	return string(out), nil
+}
+
+// Check type-checks the expression against the given variable names, declared as dyn unless their type is declared
+// with WithDeclarations, and estimates its cost.
+// The expression is neither planned nor evaluated, so checking is cheap enough to run while the expression is edited.
+func Check(exp string, variables []string, opts ...Option) (*CheckResponse, error) {
+	o := newOptions(opts)
+	names := variableNames(variables, o.declarations)
+	env, err := newEnv(names, options{declarations: o.declarations, descriptors: o.descriptors, lint: o.lint, profile: o.profile})
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(exp)
+	if issues != nil {
+		return &CheckResponse{Issues: utils.IssuesDiagnostics(exp, "", issues)}, nil
+	}
+	checked, err := cel.AstToCheckedExpr(ast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect the checked expression: %w", err)
+	}
+	response := &CheckResponse{Valid: true, OutputType: ast.OutputType().String()}
+	response.Variables, response.Functions = utils.References(checked, names)
+	cost, err := env.EstimateCost(ast, defaultCostEstimator{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate the cost: %w", err)
+	}
+	response.Cost = &CostEstimate{Min: cost.Min, Max: cost.Max}
+	if o.lint {
+		response.Diagnostics = utils.Lint(ast, "")
+	}
+	return response, nil
+}
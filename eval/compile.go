@@ -0,0 +1,263 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eval
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter"
+	"github.com/undistro/cel-playground/utils"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// celProfile identifies the environment options used by this package in the program cache keys.
+const celProfile = "cel"
+
+const (
+	programCacheSize = 128
+	envCacheSize     = 32
+)
+
+var (
+	programCache = utils.NewCache[*CompiledExpression](programCacheSize)
+	envCache     = utils.NewCache[*cel.Env](envCacheSize)
+)
+
+// CompiledExpression is a type-checked and planned CEL program.
+// It is safe for concurrent use and can be evaluated against many inputs.
+type CompiledExpression struct {
+	ast          *cel.Ast
+	prog         cel.Program
+	trace        bool
+	declarations Declarations
+	files        *protoregistry.Files
+	env          *cel.Env
+	unknowns     []*interpreter.AttributePattern
+	diagnostics  []utils.Diagnostic
+}
+
+// Compile returns the compiled form of the expression for the given variable names, declared as dyn unless their
+// type is declared with WithDeclarations. Declared variables are in scope even when they are not among the names.
+// Compiled expressions are cached by expression, environment profile, variable declarations and options.
+func Compile(exp string, variables []string, opts ...Option) (*CompiledExpression, error) {
+	o := newOptions(opts)
+	unknowns, unknownVariables, err := attributePatterns(o.unknowns)
+	if err != nil {
+		return nil, err
+	}
+	names := variableNames(append(unknownVariables, variables...), o.declarations)
+	key := utils.CacheKey(append([]string{celProfile, o.cacheKey(), exp}, names...)...)
+	if compiled, ok := programCache.Get(key); ok {
+		return compiled, nil
+	}
+	compiled, err := compile(exp, names, o)
+	if err != nil {
+		return nil, err
+	}
+	compiled.unknowns = unknowns
+	programCache.Add(key, compiled)
+	return compiled, nil
+}
+
+// attributePatterns parses the paths of unknown attributes, returning the variables they belong to as well.
+func attributePatterns(paths []string) ([]*interpreter.AttributePattern, []string, error) {
+	var patterns []*interpreter.AttributePattern
+	var variables []string
+	for _, path := range paths {
+		pattern, variable, err := utils.ParseAttributePattern(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse unknown attribute: %w", err)
+		}
+		patterns = append(patterns, pattern)
+		variables = append(variables, variable)
+	}
+	return patterns, variables, nil
+}
+
+// variableNames returns the sorted union of the variable names and the declared ones.
+func variableNames(variables []string, declarations Declarations) []string {
+	names := append([]string{}, variables...)
+	for name := range declarations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	unique := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// newEnv returns the environment declaring the sorted variable names with their declared type, or dyn, environments
+// are cached as they are expensive to create and safe for concurrent use.
+func newEnv(variables []string, o options) (*cel.Env, error) {
+	key := utils.CacheKey(append([]string{celProfile, o.cacheKey()}, variables...)...)
+	if env, ok := envCache.Get(key); ok {
+		return env, nil
+	}
+	profileOptions, err := profileEnvOptions(o.profile)
+	if err != nil {
+		return nil, err
+	}
+	envOptions := append([]cel.EnvOption{}, profileOptions...)
+	if o.descriptors != nil {
+		envOptions = append(envOptions, cel.TypeDescs(o.descriptors.files))
+	}
+	for _, name := range variables {
+		t, ok := o.declarations[name]
+		if !ok {
+			t = cel.DynType
+		}
+		envOptions = append(envOptions, cel.Variable(name, t))
+	}
+	if o.trace || len(o.unknowns) > 0 || o.lint {
+		// macro calls are needed to locate the traced subexpressions and lint findings, and to print residual
+		// expressions
+		envOptions = append(envOptions, cel.EnableMacroCallTracking())
+	}
+	env, err := cel.NewEnv(envOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL env: %w", err)
+	}
+	envCache.Add(key, env)
+	return env, nil
+}
+
+func compile(exp string, variables []string, o options) (*CompiledExpression, error) {
+	env, err := newEnv(variables, o)
+	if err != nil {
+		return nil, err
+	}
+	programOptions := celProgramOptions
+	if o.trace {
+		programOptions = append(append([]cel.ProgramOption{}, programOptions...), traceProgramOptions...)
+	}
+	if len(o.unknowns) > 0 {
+		programOptions = append(append([]cel.ProgramOption{}, programOptions...), partialProgramOptions...)
+	}
+	if o.costLimit > 0 {
+		programOptions = append(append([]cel.ProgramOption{}, programOptions...), cel.CostLimit(o.costLimit))
+	}
+	ast, issues := env.Compile(exp)
+	if issues != nil {
+		err := fmt.Errorf("failed to compile the CEL expression: %s", issues.String())
+		return nil, utils.NewDiagnosticsError(err, utils.IssuesDiagnostics(exp, "", issues))
+	}
+	prog, err := env.Program(ast, programOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate CEL program: %w", err)
+	}
+	compiled := &CompiledExpression{ast: ast, prog: prog, trace: o.trace, declarations: o.declarations, env: env}
+	if o.lint {
+		compiled.diagnostics = utils.Lint(ast, "")
+	}
+	if o.descriptors != nil {
+		compiled.files = o.descriptors.files
+	}
+	return compiled, nil
+}
+
+// Eval evaluates the compiled expression against the given input, the values of declared variables are converted to
+// their declared types first.
+func (c *CompiledExpression) Eval(input map[string]any) (*EvalResponse, error) {
+	return c.EvalContext(context.Background(), input)
+}
+
+// EvalContext evaluates the compiled expression like Eval, stopping with a utils.InterruptedError when the context is
+// done.
+func (c *CompiledExpression) EvalContext(ctx context.Context, input map[string]any) (*EvalResponse, error) {
+	val, costTracker, err := c.eval(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return c.response(val, costTracker)
+}
+
+func (c *CompiledExpression) eval(ctx context.Context, input map[string]any) (ref.Val, *cel.EvalDetails, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to evaluate: %w", utils.NewInterruptedError(err, 0))
+	}
+	input, err := c.coerceInput(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	var activation any = input
+	if len(c.unknowns) > 0 {
+		if activation, err = cel.PartialVars(input, c.unknowns...); err != nil {
+			return nil, nil, fmt.Errorf("failed to create CEL activations: %w", err)
+		}
+	}
+	val, costTracker, err := utils.ContextEval(ctx, c.prog, activation)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to evaluate: %w", err)
+	}
+	return val, costTracker, nil
+}
+
+func (c *CompiledExpression) response(val ref.Val, costTracker *cel.EvalDetails) (*EvalResponse, error) {
+	var err error
+	var response *EvalResponse
+	if types.IsUnknown(val) {
+		response, err = c.residualResponse(costTracker)
+	} else {
+		response, err = generateResponse(val, costTracker)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the response: %w", err)
+	}
+	if c.trace {
+		response.Trace = utils.Trace(c.ast, costTracker.State())
+	}
+	response.Diagnostics = c.diagnostics
+	return response, nil
+}
+
+// residualResponse returns the expression left after evaluating the parts of the expression which do not depend on
+// unknown attributes.
+func (c *CompiledExpression) residualResponse(details *cel.EvalDetails) (*EvalResponse, error) {
+	residual, err := c.env.ResidualAst(c.ast, details)
+	if err != nil {
+		return nil, err
+	}
+	source, err := cel.AstToString(residual)
+	if err != nil {
+		return nil, err
+	}
+	return &EvalResponse{Residual: source, Cost: details.ActualCost()}, nil
+}
+
+func (c *CompiledExpression) coerceInput(input map[string]any) (map[string]any, error) {
+	if len(c.declarations) == 0 {
+		return input, nil
+	}
+	coerced := make(map[string]any, len(input))
+	for name, value := range input {
+		if t, ok := c.declarations[name]; ok {
+			var err error
+			if value, err = utils.CoerceValue(value, t, c.files); err != nil {
+				return nil, fmt.Errorf("failed to convert variable %s to %s: %w", name, t, err)
+			}
+		}
+		coerced[name] = value
+	}
+	return coerced, nil
+}
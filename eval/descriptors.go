@@ -0,0 +1,111 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eval
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Descriptors are the protobuf files whose messages can be used as variable types and constructed in expressions.
+type Descriptors struct {
+	files  *protoregistry.Files
+	digest string
+}
+
+// ParseDescriptors decodes a serialized FileDescriptorSet, as written by 'protoc --include_imports
+// --descriptor_set_out', either in binary or base64 encoded.
+func ParseDescriptors(input []byte) (*Descriptors, error) {
+	encoded := bytes.TrimSpace(input)
+	if decoded, err := base64.StdEncoding.DecodeString(string(encoded)); err == nil {
+		input = decoded
+	}
+	fds := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(input, fds); err != nil {
+		return nil, fmt.Errorf("failed to decode the file descriptor set: %w", err)
+	}
+	return NewDescriptors(fds)
+}
+
+// NewDescriptors resolves the files of the set, imports missing from the set are resolved from the well-known types.
+func NewDescriptors(fds *descriptorpb.FileDescriptorSet) (*Descriptors, error) {
+	serialized, err := proto.MarshalOptions{Deterministic: true}.Marshal(fds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the file descriptor set: %w", err)
+	}
+	digest := sha256.Sum256(serialized)
+
+	protos := map[string]*descriptorpb.FileDescriptorProto{}
+	for _, file := range fds.GetFile() {
+		protos[file.GetName()] = file
+	}
+	files := &protoregistry.Files{}
+	var register func(path string, importing []string) error
+	register = func(path string, importing []string) error {
+		if _, err := files.FindFileByPath(path); err == nil {
+			return nil
+		}
+		for _, importer := range importing {
+			if importer == path {
+				return fmt.Errorf("failed to resolve %s: import cycle", path)
+			}
+		}
+		// well-known types must be the ones linked in the binary, CEL relies on their generated types; other
+		// files come from the set even if a file with the same path is linked in the binary
+		if strings.HasPrefix(path, "google/protobuf/") {
+			if file, err := protoregistry.GlobalFiles.FindFileByPath(path); err == nil {
+				return files.RegisterFile(file)
+			}
+		}
+		fileProto, ok := protos[path]
+		if !ok {
+			return fmt.Errorf("failed to resolve %s: file not found in the file descriptor set", path)
+		}
+		for _, dependency := range fileProto.GetDependency() {
+			if err := register(dependency, append(importing, path)); err != nil {
+				return err
+			}
+		}
+		file, err := protodesc.NewFile(fileProto, files)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", path, err)
+		}
+		return files.RegisterFile(file)
+	}
+	for _, file := range fds.GetFile() {
+		if err := register(file.GetName(), nil); err != nil {
+			return nil, err
+		}
+	}
+	return &Descriptors{files: files, digest: hex.EncodeToString(digest[:])}, nil
+}
+
+// WithDescriptors registers the message types of the descriptors, so that variables can be declared with them.
+// Inputs of message typed variables are given in protobuf JSON, as YAML or JSON maps, or in protobuf text format, as
+// strings.
+func WithDescriptors(descriptors *Descriptors) Option {
+	return func(o *options) {
+		o.descriptors = descriptors
+	}
+}
@@ -15,6 +15,7 @@
 package eval
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -24,99 +25,201 @@ import (
 	"github.com/google/cel-go/ext"
 	"github.com/google/cel-go/interpreter"
 	"github.com/undistro/cel-playground/utils"
-	"gopkg.in/yaml.v2"
 	k8s "k8s.io/apiserver/pkg/cel/library"
 )
 
+// EvalResponse is the result of an evaluation, or the residual expression when the result depends on unknown
+// attributes, see WithUnknowns. Diagnostics are the lint findings, see WithLint.
 type EvalResponse struct {
-	Result any     `json:"result"`
-	Cost   *uint64 `json:"cost, omitempty"`
+	Result      any                `json:"result"`
+	Type        string             `json:"type,omitempty"`
+	Residual    string             `json:"residual,omitempty"`
+	Cost        *uint64            `json:"cost,omitempty"`
+	Trace       []utils.TraceEntry `json:"trace,omitempty"`
+	Diagnostics []utils.Diagnostic `json:"diagnostics,omitempty"`
 }
 
-var celEnvOptions = []cel.EnvOption{
-	// 1.0 (1.23)
-	cel.HomogeneousAggregateLiterals(),
-	cel.EagerlyValidateDeclarations(true),
-	cel.DefaultUTCTimeZone(true),
-	k8s.URLs(),
-	k8s.Regex(),
-	k8s.Lists(),
-
-	// 1.27
-	// k8s.Authz(),
+// DefaultProfile is the Kubernetes version whose CEL environment is used unless another one is selected with
+// WithProfile.
+const DefaultProfile = "1.29"
 
+// profiles are the CEL environment options introduced by each Kubernetes version, in order, the environment of a
+// version includes the options of all the previous ones.
+var profiles = []struct {
+	version string
+	options []cel.EnvOption
+}{{
+	// 1.0 (1.23)
+	version: "1.23",
+	options: []cel.EnvOption{
+		cel.HomogeneousAggregateLiterals(),
+		cel.EagerlyValidateDeclarations(true),
+		cel.DefaultUTCTimeZone(true),
+		k8s.URLs(),
+		k8s.Regex(),
+		k8s.Lists(),
+
+		// 1.27
+		// k8s.Authz(),
+	},
+}, {
 	// 1.28
-	cel.CrossTypeNumericComparisons(true),
-	cel.OptionalTypes(),
-	k8s.Quantity(),
-
+	version: "1.28",
+	options: []cel.EnvOption{
+		cel.CrossTypeNumericComparisons(true),
+		cel.OptionalTypes(),
+		k8s.Quantity(),
+	},
+}, {
 	// 1.29 (see also validator.ExtendedValidations())
-	cel.ASTValidators(
-		cel.ValidateDurationLiterals(),
-		cel.ValidateTimestampLiterals(),
-		cel.ValidateRegexLiterals(),
-		cel.ValidateHomogeneousAggregateLiterals(),
-	),
-
-	// Strings (from 1.29 onwards)
-	ext.Strings(ext.StringsVersion(2)),
-	// Set library (1.29 onwards)
-	ext.Sets(),
-
+	version: "1.29",
+	options: []cel.EnvOption{
+		cel.ASTValidators(
+			cel.ValidateDurationLiterals(),
+			cel.ValidateTimestampLiterals(),
+			cel.ValidateRegexLiterals(),
+			cel.ValidateHomogeneousAggregateLiterals(),
+		),
+
+		// Strings (from 1.29 onwards)
+		ext.Strings(ext.StringsVersion(2)),
+		// Set library (1.29 onwards)
+		ext.Sets(),
+	},
+}, {
+	// 1.30
+	version: "1.30",
+	options: []cel.EnvOption{
+		k8s.IP(),
+		k8s.CIDR(),
+	},
+}}
+
+// costEnvOptions are shared by all the profiles.
+var costEnvOptions = []cel.EnvOption{
 	// cel-go v0.17.7 introduced CostEstimatorOptions.
 	// Previous the presence has a cost of 0 but cel fixed it to 1. We still set to 0 here to avoid breaking changes.
 	cel.CostEstimatorOptions(checker.PresenceTestHasCost(false)),
 }
 
-var celProgramOptions = []cel.ProgramOption{
+var celEnvOptions, _ = profileEnvOptions(DefaultProfile)
+
+// Profiles returns the Kubernetes versions whose CEL environment can be selected with WithProfile, in order.
+func Profiles() []string {
+	versions := make([]string, len(profiles))
+	for i, profile := range profiles {
+		versions[i] = profile.version
+	}
+	return versions
+}
+
+// profileEnvOptions returns the CEL environment options of the Kubernetes version, the default one when empty.
+func profileEnvOptions(version string) ([]cel.EnvOption, error) {
+	if version == "" {
+		version = DefaultProfile
+	}
+	var envOptions []cel.EnvOption
+	for _, profile := range profiles {
+		envOptions = append(envOptions, profile.options...)
+		if profile.version == version {
+			return append(envOptions, costEnvOptions...), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown profile %s, expecting one of %v", version, Profiles())
+}
+
+var celProgramOptions = append([]cel.ProgramOption{
 	cel.EvalOptions(cel.OptOptimize, cel.OptTrackCost),
 
 	// cel-go v0.17.7 introduced CostTrackerOptions.
 	// Previous the presence has a cost of 0 but cel fixed it to 1. We still set to 0 here to avoid breaking changes.
 	cel.CostTrackerOptions(interpreter.PresenceTestHasCost(false)),
+}, utils.InterruptProgramOptions...)
+
+// traceProgramOptions record the value of every subexpression, evaluating all branches.
+var traceProgramOptions = []cel.ProgramOption{
+	cel.EvalOptions(cel.OptTrackState, cel.OptExhaustiveEval),
+}
+
+// partialProgramOptions evaluate expressions with unknown attributes, tracking the state to compute residuals.
+var partialProgramOptions = []cel.ProgramOption{
+	cel.EvalOptions(cel.OptTrackState, cel.OptPartialEval),
 }
 
-func CelEval(exp []byte, input []byte) (string, error) {
-	var inputMap map[string]any
-	if err := yaml.Unmarshal(input, &inputMap); err != nil {
+// CelEval evaluates the cel expression against the YAML or JSON input, see utils.Decode for the typed values it may hold.
+func CelEval(exp []byte, input []byte, opts ...Option) (string, error) {
+	inputMap, err := utils.Decode(input)
+	if err != nil {
 		return "", fmt.Errorf("failed to decode input: %w", err)
 	}
-	return Eval(string(exp), inputMap)
+	return Eval(string(exp), inputMap, opts...)
 }
 
 // Eval evaluates the cel expression against the given input
-func Eval(exp string, input map[string]any) (string, error) {
-	inputVars := make([]cel.EnvOption, 0, len(input))
-	for k := range input {
-		inputVars = append(inputVars, cel.Variable(k, cel.DynType))
+func Eval(exp string, input map[string]any, opts ...Option) (string, error) {
+	response, err := evaluate(newOptions(opts).context(), exp, input, opts)
+	if err != nil {
+		return "", err
 	}
-	env, err := cel.NewEnv(append(celEnvOptions, inputVars...)...)
+	out, err := json.Marshal(response)
 	if err != nil {
-		return "", fmt.Errorf("failed to create CEL env: %w", err)
+		return "", fmt.Errorf("failed to marshal the output: %w", err)
 	}
-	ast, issues := env.Compile(exp)
-	if issues != nil {
-		return "", fmt.Errorf("failed to compile the CEL expression: %s", issues.String())
+	return string(out), nil
+}
+
+// Request is the input of Evaluate, the typed counterpart of the arguments and options of Eval.
+type Request struct {
+	Expression string
+	// Input holds the values of the variables, see utils.Decode for the typed values it may hold.
+	Input map[string]any
+	// Declarations, Descriptors, Unknowns, Profile and CostLimit are the arguments of the options of the same names,
+	// Trace and Lint enable WithTrace and WithLint.
+	Declarations Declarations
+	Descriptors  *Descriptors
+	Unknowns     []string
+	Profile      string
+	CostLimit    uint64
+	Trace        bool
+	Lint         bool
+}
+
+// Evaluate evaluates the expression of the request against its input, returning the response Eval marshals.
+// The evaluation stops with a utils.InterruptedError when the context is done.
+func Evaluate(ctx context.Context, request *Request) (*EvalResponse, error) {
+	return evaluate(ctx, request.Expression, request.Input, request.options())
+}
+
+func (r *Request) options() []Option {
+	opts := []Option{WithProfile(r.Profile), WithCostLimit(r.CostLimit)}
+	if r.Trace {
+		opts = append(opts, WithTrace())
 	}
-	prog, err := env.Program(ast, celProgramOptions...)
-	if err != nil {
-		return "", fmt.Errorf("failed to instantiate CEL program: %w", err)
+	if r.Lint {
+		opts = append(opts, WithLint())
 	}
-	val, costTracker, err := prog.Eval(input)
-	if err != nil {
-		return "", fmt.Errorf("failed to evaluate: %w", err)
+	if r.Declarations != nil {
+		opts = append(opts, WithDeclarations(r.Declarations))
 	}
-
-	response, err := generateResponse(val, costTracker)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate the response: %w", err)
+	if r.Descriptors != nil {
+		opts = append(opts, WithDescriptors(r.Descriptors))
+	}
+	if len(r.Unknowns) > 0 {
+		opts = append(opts, WithUnknowns(r.Unknowns...))
 	}
+	return opts
+}
 
-	out, err := json.Marshal(response)
+func evaluate(ctx context.Context, exp string, input map[string]any, opts []Option) (*EvalResponse, error) {
+	names := make([]string, 0, len(input))
+	for k := range input {
+		names = append(names, k)
+	}
+	compiled, err := Compile(exp, names, opts...)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal the output: %w", err)
+		return nil, err
 	}
-	return string(out), nil
+	return compiled.EvalContext(ctx, input)
 }
 
 func getResults(val ref.Val) (any, error) {
@@ -135,6 +238,7 @@ func generateResponse(val ref.Val, costTracker *cel.EvalDetails) (*EvalResponse,
 	cost := costTracker.ActualCost()
 	return &EvalResponse{
 		Result: result,
+		Type:   utils.TypeName(val),
 		Cost:   cost,
 	}, nil
 }
@@ -15,12 +15,21 @@
 package eval
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/common/types"
+	"github.com/undistro/cel-playground/utils"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 var input = map[string]any{
@@ -346,3 +355,936 @@ func TestValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestCompiledExpression(t *testing.T) {
+	compiled, err := Compile("account.balance >= transaction.withdrawal", []string{"account", "transaction"})
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	if cached, err := Compile("account.balance >= transaction.withdrawal", []string{"transaction", "account"}); err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	} else if cached != compiled {
+		t.Errorf("Compile() expected the cached program for the same expression and declarations")
+	}
+	for _, withdrawal := range []int{100, 700} {
+		response, err := compiled.Eval(map[string]any{
+			"account":     map[string]any{"balance": 500},
+			"transaction": map[string]any{"withdrawal": withdrawal},
+		})
+		if err != nil {
+			t.Fatalf("Eval() error = %v", err)
+		}
+		out, err := json.Marshal(response)
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+		evalResponse := EvalResponse{}
+		if err := json.Unmarshal(out, &evalResponse); err != nil {
+			t.Fatalf("Unmarshal() error = %v", err)
+		}
+		if want := withdrawal <= 500; evalResponse.Result != want {
+			t.Errorf("Expected %v, received %v", want, evalResponse.Result)
+		}
+	}
+}
+
+func TestEvalDiagnostics(t *testing.T) {
+	_, err := Eval("object.replicas > 1 &&\n  object.foo(", input)
+	if err == nil {
+		t.Fatalf("Eval() expected an error")
+	}
+	diagnostics := utils.ErrorDiagnostics(err)
+	if len(diagnostics) == 0 {
+		t.Fatalf("Expected diagnostics for %v", err)
+	}
+	if start := diagnostics[0].Start; start == nil || start.Line != 2 {
+		t.Errorf("Expected a diagnostic on the second line, received %v", start)
+	}
+	if diagnostics[0].Severity != utils.SeverityError || diagnostics[0].Path != "" {
+		t.Errorf("Expected an error diagnostic without path, received %+v", diagnostics[0])
+	}
+}
+
+func TestEvalCostLimit(t *testing.T) {
+	exp := "object.items.all(i, object.items.all(j, i + j >= 0))"
+	items := make([]any, 100)
+	for i := range items {
+		items[i] = i
+	}
+	data := map[string]any{"object": map[string]any{"items": items}}
+	if _, err := Eval(exp, data, WithCostLimit(1000)); err == nil || !strings.Contains(err.Error(), "cost limit exceeded") {
+		t.Errorf("Expected the cost limit to be exceeded, received %v", err)
+	}
+	if _, err := Eval(exp, data); err != nil {
+		t.Errorf("Eval() error = %v", err)
+	}
+}
+
+func TestEvalTimeout(t *testing.T) {
+	exp := "object.items.all(i, object.items.all(j, i + j >= 0))"
+	items := make([]any, 2000)
+	for i := range items {
+		items[i] = i
+	}
+	data := map[string]any{"object": map[string]any{"items": items}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := Eval(exp, data, WithContext(ctx))
+	var interrupted *utils.InterruptedError
+	if !errors.As(err, &interrupted) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the evaluation to be interrupted by the deadline, received %v", err)
+	}
+	if interrupted.Cost == 0 {
+		t.Errorf("Expected the cost incurred before the deadline, received %v", err)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	request := &Request{
+		Expression:   "object.created < now",
+		Input:        map[string]any{"object": map[string]any{"created": "2024-01-01T00:00:00Z"}, "now": "2025-01-01T00:00:00Z"},
+		Declarations: Declarations{"now": cel.TimestampType},
+		CostLimit:    100,
+	}
+	if _, err := Evaluate(context.Background(), request); err == nil {
+		t.Errorf("Expected comparing a string to a timestamp to fail")
+	}
+	request.Expression = "timestamp(object.created) < now"
+	response, err := Evaluate(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if response.Result != true || response.Type != "bool" {
+		t.Errorf("Expected true, received %v", response)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Evaluate(ctx, request); err == nil || !strings.Contains(err.Error(), "context canceled") {
+		t.Errorf("Expected the evaluation to be canceled, received %v", err)
+	}
+}
+
+func TestEvalBatch(t *testing.T) {
+	input := []byte(`apiVersion: v1
+kind: List
+items:
+  - apiVersion: v1
+    kind: Pod
+    metadata: {name: latest, namespace: default}
+    spec: {containers: [{image: "nginx:latest"}]}
+  - apiVersion: v1
+    kind: Pod
+    metadata: {name: pinned, namespace: default}
+    spec: {containers: [{image: "nginx:1.25"}]}
+  - apiVersion: v1
+    kind: Pod
+    metadata: {name: empty}
+    spec: {}
+---
+object:
+  spec: {containers: []}
+`)
+	out, err := CelEvalBatch([]byte(`object.spec.containers.all(c, !c.image.endsWith(":latest"))`), input)
+	if err != nil {
+		t.Fatalf("CelEvalBatch() error = %v", err)
+	}
+	var response BatchResponse
+	if err := json.Unmarshal([]byte(out), &response); err != nil {
+		t.Fatalf("failed to decode the output: %v", err)
+	}
+	expected := BatchSummary{Total: 4, True: 2, False: 1, Errors: 1, Cost: response.Summary.Cost}
+	if response.Summary != expected || response.Summary.Cost == 0 {
+		t.Errorf("expected the summary %v, received %v", expected, response.Summary)
+	}
+	names := []string{"default/latest", "default/pinned", "empty", ""}
+	for i, item := range response.Items {
+		if item.Index != i || item.Name != names[i] {
+			t.Errorf("expected item %d to be named %q, received %v", i, names[i], item)
+		}
+	}
+	if response.Items[2].Error == "" {
+		t.Errorf("expected the pod without containers to fail, received %v", response.Items[2])
+	}
+}
+
+func TestBatchInputs(t *testing.T) {
+	inputs, err := BatchInputs([]byte(`apiVersion: v1
+kind: PodList
+items:
+  - {apiVersion: v1, kind: Pod, metadata: {name: a}}
+  - {apiVersion: v1, kind: Pod, metadata: {name: b}}
+---
+apiVersion: example.com/v1
+kind: Inventory
+metadata: {name: inventory}
+items: [1, 2]
+`))
+	if err != nil {
+		t.Fatalf("BatchInputs() error = %v", err)
+	}
+	var names []string
+	for _, input := range inputs {
+		names = append(names, input.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b", "inventory"}) {
+		t.Errorf("Expected the items of the PodList and the Inventory, received %v", names)
+	}
+	if _, err := BatchInputs([]byte("apiVersion: v1\nkind: List\nitems: [1]")); err == nil || err.Error() != "item 0 of the List is not an object" {
+		t.Errorf("Expected an invalid item error, received %v", err)
+	}
+}
+
+func TestEvalTrace(t *testing.T) {
+	exp := "account.balance >= transaction.withdrawal\n    || (account.overdraftProtection\n    && account.overdraftLimit >= transaction.withdrawal - account.balance)"
+	got, err := Eval(exp, map[string]any{
+		"account":     map[string]any{"balance": 500, "overdraftProtection": false, "overdraftLimit": 1000},
+		"transaction": map[string]any{"withdrawal": 700},
+	}, WithTrace())
+	if err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	evalResponse := EvalResponse{}
+	if err := json.Unmarshal([]byte(got), &evalResponse); err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	traced := map[string]any{}
+	for _, entry := range evalResponse.Trace {
+		traced[entry.Expression] = entry.Value
+	}
+	for expression, want := range map[string]any{
+		"account.balance >= transaction.withdrawal":                          false,
+		"account.overdraftProtection":                                        false,
+		"transaction.withdrawal - account.balance":                           "200",
+		"account.overdraftLimit >= transaction.withdrawal - account.balance": true,
+	} {
+		if value, ok := traced[expression]; !ok || value != want {
+			t.Errorf("Expected %s to be traced as %v, received %v", expression, want, value)
+		}
+	}
+	if first := evalResponse.Trace[0]; first.Value != false || first.Start != (utils.Position{Line: 1, Column: 1}) || first.End != (utils.Position{Line: 3, Column: 74}) {
+		t.Errorf("Expected the whole expression first, received %+v", first)
+	}
+}
+
+func TestEvalDeclarations(t *testing.T) {
+	declarations, err := ParseDeclarations([]byte("created: timestamp\nttl: duration\nratio: double\nlabels: map(string, string)"))
+	if err != nil {
+		t.Fatalf("ParseDeclarations() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		exp     string
+		input   string
+		want    any
+		wantErr bool
+	}{{
+		name:  "converted inputs",
+		exp:   "created + ttl > timestamp('2024-01-01T00:00:00Z') && ratio / 2.0 == 0.5",
+		input: "created: 2023-12-31T23:30:00Z\nttl: 1h\nratio: 1",
+		want:  true,
+	}, {
+		name:  "typed map",
+		exp:   "has(labels.app) ? labels.app : 'none'",
+		input: "labels:\n  app: nginx",
+		want:  "nginx",
+	}, {
+		name:    "invalid timestamp",
+		exp:     "created < timestamp('2024-01-01T00:00:00Z')",
+		input:   "created: yesterday",
+		wantErr: true,
+	}, {
+		name:    "type error",
+		exp:     "ratio + 'a'",
+		input:   "ratio: 1",
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CelEval([]byte(tt.exp), []byte(tt.input), WithDeclarations(declarations))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CelEval() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			evalResponse := EvalResponse{}
+			if err := json.Unmarshal([]byte(got), &evalResponse); err != nil {
+				t.Fatalf("CelEval() error = %v", err)
+			}
+			if !reflect.DeepEqual(tt.want, evalResponse.Result) {
+				t.Errorf("Expected %v, received %v", tt.want, evalResponse.Result)
+			}
+		})
+	}
+}
+
+func TestEvalTypedInput(t *testing.T) {
+	tests := []struct {
+		name    string
+		exp     string
+		input   string
+		want    any
+		wantErr string
+	}{{
+		name:  "yaml tags",
+		exp:   "created + ttl == timestamp('2023-10-13T21:32:04Z') && payload == b'hello' && type(count) == uint",
+		input: "created: !!timestamp 2023-10-13T20:32:04Z\nttl: !duration 1h\npayload: !!binary aGVsbG8=\ncount: !uint 3",
+		want:  true,
+	}, {
+		name:  "annotated json",
+		exp:   "created + ttl == timestamp('2023-10-13T21:32:04Z') && payload == b'hello' && count == 3u",
+		input: `{"created": {"@type": "timestamp", "value": "2023-10-13T20:32:04Z"}, "ttl": {"@type": "duration", "value": "1h"}, "payload": {"@type": "bytes", "value": "aGVsbG8="}, "count": {"@type": "uint", "value": 3}}`,
+		want:  true,
+	}, {
+		name:  "large integers",
+		exp:   "max == 18446744073709551615u",
+		input: "max: 18446744073709551615",
+		want:  true,
+	}, {
+		name:  "quoted timestamps are strings",
+		exp:   "type(created) == google.protobuf.Timestamp && type(quoted) == string",
+		input: "created: 2023-10-13T20:32:04Z\nquoted: '2023-10-13T20:32:04Z'",
+		want:  true,
+	}, {
+		name:  "merge keys",
+		exp:   "b.x + b.y",
+		input: "a: &a\n  x: 1\n  y: 2\nb:\n  <<: *a\n  y: 3",
+		want:  "4",
+	}, {
+		name:  "annotated max uint",
+		exp:   "count == 18446744073709551615u",
+		input: `{"count": {"@type": "uint", "value": 18446744073709551615}}`,
+		want:  true,
+	}, {
+		name:  "tagged max uint",
+		exp:   "count == 18446744073709551615u",
+		input: "count: !uint 18446744073709551615",
+		want:  true,
+	}, {
+		name:    "annotated negative uint",
+		exp:     "count",
+		input:   `{"count": {"@type": "uint", "value": -1}}`,
+		wantErr: "negative value -1",
+	}, {
+		name:    "invalid duration",
+		exp:     "ttl",
+		input:   "ttl: !duration forever",
+		wantErr: "invalid !duration value",
+	}, {
+		name:    "not a map",
+		exp:     "true",
+		input:   "[1, 2]",
+		wantErr: "map",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CelEval([]byte(tt.exp), []byte(tt.input))
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("CelEval() error = %v, wantErr %q", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error containing %q, received %v", tt.wantErr, err)
+				}
+				return
+			}
+			evalResponse := EvalResponse{}
+			if err := json.Unmarshal([]byte(got), &evalResponse); err != nil {
+				t.Fatalf("CelEval() error = %v", err)
+			}
+			if !reflect.DeepEqual(tt.want, evalResponse.Result) {
+				t.Errorf("Expected %v, received %v", tt.want, evalResponse.Result)
+			}
+		})
+	}
+}
+
+func TestEvalTypedResults(t *testing.T) {
+	tests := []struct {
+		exp      string
+		want     string
+		wantType string
+	}{
+		{exp: "dyn(1) == 1.0", want: "true", wantType: "bool"},
+		{exp: "1.0", want: "1", wantType: "double"},
+		{exp: "9007199254740993", want: `"9007199254740993"`, wantType: "int"},
+		{exp: "9223372036854775807", want: `"9223372036854775807"`, wantType: "int"},
+		{exp: "18446744073709551615u", want: `"18446744073709551615"`, wantType: "uint"},
+		{exp: "[9007199254740993, 1]", want: `["9007199254740993","1"]`, wantType: "list"},
+		{exp: "1.0 / 0.0", want: `"Infinity"`, wantType: "double"},
+		{exp: "b'hello'", want: `"aGVsbG8="`, wantType: "bytes"},
+		{exp: "timestamp('2023-10-13T20:32:04Z')", want: `"2023-10-13T20:32:04Z"`, wantType: "google.protobuf.Timestamp"},
+		{exp: "duration('1h30m')", want: `"5400s"`, wantType: "google.protobuf.Duration"},
+		{exp: "quantity('1Gi')", want: `"1Gi"`, wantType: "kubernetes.Quantity"},
+		{exp: "url('https://example.com/path')", want: `"https://example.com/path"`, wantType: "kubernetes.URL"},
+		{exp: "type(1)", want: `"int"`, wantType: "type"},
+		{exp: "optional.of(1)", want: `"1"`, wantType: "optional_type(int)"},
+		{exp: "optional.none()", want: "null", wantType: "optional_type"},
+		{exp: "{1: 'a'}", want: `{"1":"a"}`, wantType: "map"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.exp, func(t *testing.T) {
+			got, err := Eval(tt.exp, map[string]any{})
+			if err != nil {
+				t.Fatalf("Eval() error = %v", err)
+			}
+			var evalResponse struct {
+				Result json.RawMessage `json:"result"`
+				Type   string          `json:"type"`
+			}
+			if err := json.Unmarshal([]byte(got), &evalResponse); err != nil {
+				t.Fatalf("Eval() error = %v", err)
+			}
+			if string(evalResponse.Result) != tt.want || evalResponse.Type != tt.wantType {
+				t.Errorf("Expected %s of type %s, received %s", tt.want, tt.wantType, got)
+			}
+		})
+	}
+}
+
+func TestEvalUnknowns(t *testing.T) {
+	input := map[string]any{
+		"object":  map[string]any{"replicas": 3, "labels": map[string]any{"app": "nginx"}, "containers": []any{map[string]any{"image": "nginx"}}},
+		"request": map[string]any{"userInfo": map[string]any{"username": "admin"}},
+	}
+	tests := []struct {
+		name         string
+		exp          string
+		unknowns     []string
+		want         any
+		wantResidual string
+		wantErr      bool
+	}{{
+		name:     "known result",
+		exp:      "object.replicas > 5 && request.userInfo.username == 'admin'",
+		unknowns: []string{"request.userInfo"},
+		want:     false,
+	}, {
+		name:         "residual",
+		exp:          "object.replicas > 2 && request.userInfo.username == 'admin'",
+		unknowns:     []string{"request.userInfo"},
+		wantResidual: `request.userInfo.username == "admin"`,
+	}, {
+		name:         "unknown variable",
+		exp:          "object.labels.app == 'nginx' ? params.enabled : false",
+		unknowns:     []string{"params"},
+		wantResidual: "params.enabled",
+	}, {
+		name:         "map keys and wildcards",
+		exp:          "object.labels['app'] == 'nginx' && object.containers.all(c, c.image.startsWith('nginx'))",
+		unknowns:     []string{"object.labels['app']", "object.containers[*].image"},
+		wantResidual: `object.labels["app"] == "nginx" && object.containers.all(c, c.image.startsWith("nginx"))`,
+	}, {
+		name:     "invalid path",
+		exp:      "true",
+		unknowns: []string{"object..replicas"},
+		wantErr:  true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Eval(tt.exp, input, WithUnknowns(tt.unknowns...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Eval() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			evalResponse := EvalResponse{}
+			if err := json.Unmarshal([]byte(got), &evalResponse); err != nil {
+				t.Fatalf("Eval() error = %v", err)
+			}
+			if !reflect.DeepEqual(tt.want, evalResponse.Result) || tt.wantResidual != evalResponse.Residual {
+				t.Errorf("Expected %v with residual %q, received %s", tt.want, tt.wantResidual, got)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		exp     string
+		width   int
+		want    string
+		wantErr bool
+	}{{
+		name: "fits",
+		exp:  "a  &&  b ||\n c",
+		want: "a && b || c",
+	}, {
+		name:  "logical chain",
+		exp:   "object.replicas <= 5 && object.name.startsWith('prod') && has(object.template)",
+		width: 36,
+		want:  "object.replicas <= 5\n&& object.name.startsWith(\"prod\")\n&& has(object.template)",
+	}, {
+		name:  "nested chain",
+		exp:   "(object.replicas > 1 || object.paused) && object.name.startsWith('prod')",
+		width: 36,
+		want:  "(object.replicas > 1\n || object.paused)\n&& object.name.startsWith(\"prod\")",
+	}, {
+		name:  "conditional and macro",
+		exp:   "object.replicas > 1 ? object.replicas < 10 : object.labels.exists(k, k == 'name' || k == 'instance')",
+		width: 40,
+		want:  "object.replicas > 1\n  ? object.replicas < 10\n  : object.labels.exists(k,\n      k == \"name\" || k == \"instance\"\n    )",
+	}, {
+		name:  "list",
+		exp:   "['registry.example.com', 'docker.io', ?optional.none()]",
+		width: 30,
+		want:  "[\n  \"registry.example.com\",\n  \"docker.io\",\n  ?optional.none()\n]",
+	}, {
+		name: "comments",
+		exp:  "// replicas\nobject.replicas > 1 &&\n  // names, e.g. 'prod // x'\n  object.name == 'prod // x' // end",
+		want: "// replicas\nobject.replicas > 1\n// names, e.g. 'prod // x'\n&& object.name == \"prod // x\"\n// end",
+	}, {
+		name:    "invalid",
+		exp:     "a &&",
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Format(tt.exp, WithWidth(tt.width))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Format() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Expected\n%s\nreceived\n%s", tt.want, got)
+			}
+			if tt.wantErr {
+				return
+			}
+			if again, err := Format(got, WithWidth(tt.width)); err != nil || again != got {
+				t.Errorf("Expected formatting to be stable, received %q, %v", again, err)
+			}
+		})
+	}
+}
+
+func TestFormatNestedConditionals(t *testing.T) {
+	env, err := cel.NewEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unparse := func(exp string) string {
+		ast, issues := env.Parse(exp)
+		if issues.Err() != nil {
+			t.Fatalf("failed to parse %q: %v", exp, issues.Err())
+		}
+		s, err := cel.AstToString(ast)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	exps := []string{
+		"(object.replicas > 1 ? object.paused : object.ready) ? object.name : object.namespace",
+		"object.replicas > 1 ? (object.paused ? object.name : object.namespace) : object.ready",
+		"object.replicas > 1 ? object.paused : object.ready ? object.name : object.namespace",
+		"((object.a ? object.b : object.c) ? object.d : object.e) ? object.f : object.g",
+		"(object.a || object.b ? object.c : object.d) && object.e ? object.f : object.g",
+	}
+	for _, exp := range exps {
+		for _, width := range []int{10, 40, 80} {
+			got, err := Format(exp, WithWidth(width))
+			if err != nil {
+				t.Fatalf("Format(%q) error = %v", exp, err)
+			}
+			if want, formatted := unparse(exp), unparse(got); formatted != want {
+				t.Errorf("Format(%q) at width %d changed the expression to\n%s\nreceived\n%s", exp, width, want, formatted)
+			}
+		}
+	}
+}
+
+func TestFormatDocument(t *testing.T) {
+	input := `apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingAdmissionPolicy
+spec:
+  # the policy validations
+  validations:
+    - expression: "object.spec.replicas <= 5 && has(object.spec.template) && object.metadata.name != 'default'"
+      message: too many replicas
+      messageExpression: "'replicas: ' + string(object.spec.replicas)"
+---
+kind: Other
+expression: "a  &&  b"
+`
+	want := `apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingAdmissionPolicy
+spec:
+  # the policy validations
+  validations:
+    - expression: |-
+        object.spec.replicas <= 5
+        && has(object.spec.template)
+        && object.metadata.name != "default"
+      message: too many replicas
+      messageExpression: "\"replicas: \" + string(object.spec.replicas)"
+---
+kind: Other
+expression: "a  &&  b"
+`
+	got, err := FormatDocument([]byte(input), WithWidth(60))
+	if err != nil {
+		t.Fatalf("FormatDocument() error = %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("Expected\n%s\nreceived\n%s", want, got)
+	}
+	if _, err := FormatDocument([]byte("validations:\n  - expression: 'a &&'\n")); err == nil {
+		t.Error("Expected an invalid expression to fail")
+	}
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name         string
+		exp          string
+		declarations Declarations
+		want         []string
+	}{{
+		name: "clean",
+		exp:  "has(object.spec.replicas) && object.spec.replicas < 5 && object.metadata.name.startsWith('prod')",
+	}, {
+		name: "missing has",
+		exp:  "object.spec.replicas < 5 && object.spec.?paused.orValue(false) == false",
+		want: []string{utils.RuleHasCheck},
+	}, {
+		name: "exists asserted",
+		exp:  "object.items.exists(i, i.ready) && object.items.map(i, i.name).exists(n, n == 'a') == false",
+		want: []string{utils.RuleExistsAssertion},
+	}, {
+		name: "dynamic regex",
+		exp:  "name.matches(pattern) && name.matches('^[a-z]+$') && name.find(pattern) != ''",
+		want: []string{utils.RuleDynamicRegex, utils.RuleDynamicRegex},
+	}, {
+		name:         "string size",
+		exp:          "size(name) <= 63 && name.size() > 0 && size(items) > 0",
+		declarations: Declarations{"name": cel.StringType, "items": cel.ListType(cel.StringType)},
+		want:         []string{utils.RuleStringSize, utils.RuleStringSize},
+	}, {
+		name: "nested comprehension",
+		exp:  "a.all(x, b.exists(y, y == x)) && a.all(x, x.items.all(y, y > 0)) && [1, 2].all(x, b.exists(y, y == x))",
+		want: []string{utils.RuleNestedComprehension},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := Check(tt.exp, []string{"object", "name", "pattern", "a", "b"}, WithDeclarations(tt.declarations), WithLint())
+			if err != nil || !response.Valid {
+				t.Fatalf("Check() error = %v, issues %v", err, response)
+			}
+			var rules []string
+			for _, diagnostic := range response.Diagnostics {
+				rules = append(rules, diagnostic.Rule)
+				if diagnostic.Fix == "" || diagnostic.Start == nil {
+					t.Errorf("Expected a located finding with a fix, received %v", diagnostic)
+				}
+			}
+			if !reflect.DeepEqual(tt.want, rules) {
+				t.Errorf("Expected the rules %v, received %v", tt.want, rules)
+			}
+		})
+	}
+
+	got, err := Eval("object.items.exists(i, i == 1)", map[string]any{"object": map[string]any{"items": []any{1}}}, WithLint())
+	if err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	evalResponse := EvalResponse{}
+	if err := json.Unmarshal([]byte(got), &evalResponse); err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	if len(evalResponse.Diagnostics) != 1 || evalResponse.Diagnostics[0].Fix != "if every element must match, use object.items.all(i, i == 1), and test size() > 0 if the list must not be empty" {
+		t.Errorf("Expected the exists-assertion finding, received %s", got)
+	}
+}
+
+func TestParseDeclarations(t *testing.T) {
+	declarations, err := ParseDeclarations([]byte("a: list(map(string, dyn))\nb: optional_type(int)\nc: google.protobuf.Struct"))
+	if err != nil {
+		t.Fatalf("ParseDeclarations() error = %v", err)
+	}
+	if got := utils.FormatDeclarations(declarations); got != "a: list(map(string, dyn))\nb: optional(int)\nc: map(string, dyn)" {
+		t.Errorf("Unexpected declarations %q", got)
+	}
+	for _, invalid := range []string{"a: list", "a: map(string)", "a: int(string)", "a: list(int", "a: list(int) x"} {
+		if _, err := ParseDeclarations([]byte(invalid)); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestEvalDescriptors(t *testing.T) {
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:       proto.String("acme/account.proto"),
+		Package:    proto.String("acme"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Account"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("owner"), JsonName: proto.String("owner"), Number: proto.Int32(1), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+				{Name: proto.String("balance"), JsonName: proto.String("balance"), Number: proto.Int32(2), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()},
+				{Name: proto.String("tags"), JsonName: proto.String("tags"), Number: proto.Int32(3), Label: descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+				{Name: proto.String("created"), JsonName: proto.String("created"), Number: proto.Int32(4), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(), TypeName: proto.String(".google.protobuf.Timestamp")},
+				{Name: proto.String("parent"), JsonName: proto.String("parent"), Number: proto.Int32(5), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(), TypeName: proto.String(".acme.Account")},
+			},
+		}},
+	}}}
+	serialized, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatalf("proto.Marshal() error = %v", err)
+	}
+	descriptors, err := ParseDescriptors([]byte(base64.StdEncoding.EncodeToString(serialized)))
+	if err != nil {
+		t.Fatalf("ParseDescriptors() error = %v", err)
+	}
+	declarations, err := ParseDeclarations([]byte("account: acme.Account"))
+	if err != nil {
+		t.Fatalf("ParseDeclarations() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		exp     string
+		input   string
+		want    any
+		wantErr bool
+	}{{
+		name:  "protobuf JSON input",
+		exp:   "account.owner == 'alice' && account.balance > 100 && !has(account.parent) && account.created < timestamp('2025-01-01T00:00:00Z')",
+		input: "account:\n  owner: alice\n  balance: 500\n  tags: [a, b]\n  created: '2024-06-01T00:00:00Z'",
+		want:  true,
+	}, {
+		name:  "protobuf text input",
+		exp:   "account.parent.balance + size(account.tags)",
+		input: "account: 'parent { balance: 5 } tags: \"a\"'",
+		want:  "6",
+	}, {
+		name:  "message construction",
+		exp:   "acme.Account{owner: 'bob', tags: ['x']}",
+		input: "account: {}",
+		want:  map[string]any{"owner": "bob", "tags": []any{"x"}},
+	}, {
+		name:    "undefined field",
+		exp:     "account.name == 'alice'",
+		input:   "account: {}",
+		wantErr: true,
+	}, {
+		name:    "invalid input",
+		exp:     "account.owner == 'alice'",
+		input:   "account:\n  owner: 1",
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CelEval([]byte(tt.exp), []byte(tt.input), WithDescriptors(descriptors), WithDeclarations(declarations))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CelEval() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			evalResponse := EvalResponse{}
+			if err := json.Unmarshal([]byte(got), &evalResponse); err != nil {
+				t.Fatalf("CelEval() error = %v", err)
+			}
+			if !reflect.DeepEqual(tt.want, evalResponse.Result) {
+				t.Errorf("Expected %v, received %v", tt.want, evalResponse.Result)
+			}
+		})
+	}
+}
+
+func TestNewDescriptorsLinkedPath(t *testing.T) {
+	// the binary links in an extensions/extension.proto too, only the well-known types are taken from the binary
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:        proto.String("extensions/extension.proto"),
+		Package:     proto.String("acme.extensions"),
+		Syntax:      proto.String("proto3"),
+		Dependency:  []string{"google/protobuf/timestamp.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String("Extension")}},
+	}}}
+	descriptors, err := NewDescriptors(fds)
+	if err != nil {
+		t.Fatalf("NewDescriptors() error = %v", err)
+	}
+	if _, err := descriptors.files.FindDescriptorByName("acme.extensions.Extension"); err != nil {
+		t.Errorf("Expected the message of the set, received %v", err)
+	}
+	if _, err := descriptors.files.FindDescriptorByName("google.protobuf.Timestamp"); err != nil {
+		t.Errorf("Expected the linked in well-known type, received %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		exp          string
+		variables    string
+		declarations string
+		want         CheckResponse
+	}{{
+		name:      "bool",
+		exp:       "object.items.all(i, i > 0) && size(object.image) > 0",
+		variables: "[object, nested]",
+		want: CheckResponse{
+			Valid:      true,
+			OutputType: "bool",
+			Variables:  []string{"object"},
+			Functions:  []string{"size"},
+			Cost:       &CostEstimate{Min: 2, Max: math.MaxUint64},
+		},
+	}, {
+		name:      "variables from a sample input",
+		exp:       "url(object.href).getQuery()",
+		variables: "object:\n  href: https://example.com",
+		want: CheckResponse{
+			Valid:      true,
+			OutputType: "map(string, list(string))",
+			Variables:  []string{"object"},
+			Functions:  []string{"getQuery", "url"},
+			Cost:       &CostEstimate{Min: 3, Max: 3},
+		},
+	}, {
+		name:         "declared types",
+		exp:          "names.exists(n, n.startsWith('a')) && expires > timestamp('2024-01-01T00:00:00Z')",
+		declarations: "names: list(string)\nexpires: timestamp",
+		want: CheckResponse{
+			Valid:      true,
+			OutputType: "bool",
+			Variables:  []string{"expires", "names"},
+			Functions:  []string{"startsWith", "timestamp"},
+			Cost:       &CostEstimate{Min: 2, Max: math.MaxUint64},
+		},
+	}, {
+		name:         "declared type mismatch",
+		exp:          "replicas + 'a'",
+		variables:    "[replicas]",
+		declarations: "replicas: int",
+		want: CheckResponse{
+			Issues: []utils.Diagnostic{{
+				Severity: utils.SeverityError,
+				Message:  "found no matching overload for '_+_' applied to '(int, string)'",
+				Start:    &utils.Position{Line: 1, Column: 10},
+				End:      &utils.Position{Line: 1, Column: 11},
+			}},
+		},
+	}, {
+		name:      "undeclared variable",
+		exp:       "object.replicas > 1 && foo",
+		variables: "[object]",
+		want: CheckResponse{
+			Issues: []utils.Diagnostic{{
+				Severity: utils.SeverityError,
+				Message:  "undeclared reference to 'foo' (in container '')",
+				Start:    &utils.Position{Line: 1, Column: 24},
+				End:      &utils.Position{Line: 1, Column: 27},
+			}},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			declarations, err := ParseDeclarations([]byte(tt.declarations))
+			if err != nil {
+				t.Fatalf("ParseDeclarations() error = %v", err)
+			}
+			got, err := CelCheck([]byte(tt.exp), []byte(tt.variables), WithDeclarations(declarations))
+			if err != nil {
+				t.Fatalf("CelCheck() error = %v", err)
+			}
+			checkResponse := CheckResponse{}
+			if err := json.Unmarshal([]byte(got), &checkResponse); err != nil {
+				t.Fatalf("CelCheck() error = %v", err)
+			}
+			if !reflect.DeepEqual(tt.want, checkResponse) {
+				t.Errorf("Expected %+v\n, received %+v (%s)", tt.want, checkResponse, got)
+			}
+		})
+	}
+}
+
+func TestEvalProfile(t *testing.T) {
+	exp := "ip('10.0.0.1').family() == 4"
+	if _, err := Eval(exp, nil); err == nil {
+		t.Errorf("Expected the IP library to be undeclared in the default profile")
+	}
+	got, err := Eval(exp, nil, WithProfile("1.30"))
+	if err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	if want := `{"result":true,"type":"bool","cost":3}`; got != want {
+		t.Errorf("Expected %s\n, received %s", want, got)
+	}
+	if _, err := Eval("[1, 2].all(i, i > 0)", nil, WithProfile("1.30"), WithProfile("1.28")); err != nil {
+		t.Errorf("Eval() error = %v", err)
+	}
+	if _, err := Eval("'a'.upperAscii() == 'A'", nil, WithProfile("0.1")); err == nil || !strings.Contains(err.Error(), "unknown profile") {
+		t.Errorf("Expected an unknown profile error, received %v", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	session := NewSession()
+	if err := session.Load([]byte("object:\n  items: [1, 2, 3]\n  name: test")); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if _, err := session.Let("doubled", "object.items.map(i, i * 2)"); err != nil {
+		t.Fatalf("Let() error = %v", err)
+	}
+	if _, err := session.Let("total", "doubled.sum()"); err != nil {
+		t.Fatalf("Let() error = %v", err)
+	}
+	if _, err := session.Let("object.name", "1"); err == nil {
+		t.Errorf("Expected an invalid variable name error")
+	}
+	if typ, err := session.Type("doubled"); err != nil || typ != "list(int)" {
+		t.Errorf("Expected doubled to be a list(int), received %s (%v)", typ, err)
+	}
+	response, err := session.Eval("doubled.exists(i, i == 6) && total == 12 && object.name == 'test'")
+	if err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	if response.Result != true {
+		t.Errorf("Expected true, received %v", response.Result)
+	}
+	if cost := session.Cost(); cost == nil || *cost != *response.Cost {
+		t.Errorf("Expected the cost of the last evaluation, received %v", cost)
+	}
+	if want := []string{"doubled", "object", "total"}; !reflect.DeepEqual(want, session.Variables()) {
+		t.Errorf("Expected the variables %v, received %v", want, session.Variables())
+	}
+	if _, err := session.Type("doubled.foo()"); len(utils.ErrorDiagnostics(err)) != 1 {
+		t.Errorf("Expected a diagnostic, received %v", err)
+	}
+	if err := session.SetProfile("1.30"); err != nil {
+		t.Fatalf("SetProfile() error = %v", err)
+	}
+	if response, err := session.Eval("doubled.size() == 3 && cidr('10.0.0.0/8').containsIP('10.0.0.1')"); err != nil || response.Result != true {
+		t.Errorf("Expected true, received %v (%v)", response, err)
+	}
+	if err := session.SetProfile("2.0"); err == nil {
+		t.Errorf("Expected an unknown profile error")
+	}
+}
+
+func BenchmarkEval(b *testing.B) {
+	exp := "object.items.all(i, i > 0) && object.image.find('v[0-9]+.[0-9]+.[0-9]*$') == 'v0.0.0'"
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			compiled, err := compile(exp, []string{"nested", "object"}, options{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := compiled.Eval(input); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := Eval(exp, input); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eval
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/undistro/cel-playground/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultWidth is the maximum line width of formatted expressions unless set with WithWidth.
+const defaultWidth = 80
+
+// expressionFields are the fields holding expressions in the lists of validating admission policies, webhooks and
+// CRD validation rules.
+var expressionFields = map[string]map[string]bool{
+	"validations":              {"expression": true, "messageExpression": true},
+	"auditAnnotations":         {"valueExpression": true},
+	"matchConditions":          {"expression": true},
+	"variables":                {"expression": true},
+	"x-kubernetes-validations": {"rule": true, "messageExpression": true},
+}
+
+// Format parses the expression and prints it back with consistent line breaks, see utils.FormatExpr.
+// Lines are at most 80 characters wide unless set otherwise with WithWidth, expressions which can not be broken may
+// still exceed it.
+func Format(exp string, opts ...Option) (string, error) {
+	o := newOptions(opts)
+	width := o.width
+	if width <= 0 {
+		width = defaultWidth
+	}
+	env, err := formatEnv()
+	if err != nil {
+		return "", err
+	}
+	ast, issues := env.Parse(exp)
+	if issues != nil {
+		err := fmt.Errorf("failed to parse the CEL expression: %s", issues.String())
+		return "", utils.NewDiagnosticsError(err, utils.IssuesDiagnostics(exp, "", issues))
+	}
+	parsed, err := cel.AstToParsedExpr(ast)
+	if err != nil {
+		return "", fmt.Errorf("failed to format the CEL expression: %w", err)
+	}
+	formatted, err := utils.FormatExpr(parsed, exp, width)
+	if err != nil {
+		return "", fmt.Errorf("failed to format the CEL expression: %w", err)
+	}
+	return formatted, nil
+}
+
+// formatEnv returns the environment parsing expressions to format, which tracks macro calls to print them back.
+func formatEnv() (*cel.Env, error) {
+	key := utils.CacheKey(celProfile, "format")
+	if env, ok := envCache.Get(key); ok {
+		return env, nil
+	}
+	env, err := cel.NewEnv(append(append([]cel.EnvOption{}, celEnvOptions...), cel.EnableMacroCallTracking())...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL env: %w", err)
+	}
+	envCache.Add(key, env)
+	return env, nil
+}
+
+// FormatDocument formats the expressions of a YAML document, or stream of documents, such as validating admission
+// policies, webhook configurations and CRDs: validations, audit annotations, match conditions, variables and
+// x-kubernetes-validations rules. Multi-line expressions are written as literal block scalars.
+func FormatDocument(input []byte, opts ...Option) ([]byte, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(input))
+	var output bytes.Buffer
+	encoder := yaml.NewEncoder(&output)
+	encoder.SetIndent(2)
+	for {
+		var document yaml.Node
+		if err := decoder.Decode(&document); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to decode the document: %w", err)
+		}
+		if err := formatNode(&document, "", opts); err != nil {
+			return nil, err
+		}
+		if err := encoder.Encode(&document); err != nil {
+			return nil, fmt.Errorf("failed to encode the document: %w", err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode the document: %w", err)
+	}
+	return output.Bytes(), nil
+}
+
+// formatNode formats the expressions found under the node, the list is the key of the closest list holding it.
+func formatNode(node *yaml.Node, list string, opts []Option) error {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if err := formatNode(child, list, opts); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := formatNode(child, list, opts); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if value.Kind == yaml.ScalarNode && value.ShortTag() == "!!str" && expressionFields[list][key.Value] {
+				if err := formatScalar(value, opts); err != nil {
+					return fmt.Errorf("line %d: %w", value.Line, err)
+				}
+				continue
+			}
+			childList := list
+			if value.Kind == yaml.SequenceNode {
+				childList = key.Value
+			}
+			if err := formatNode(value, childList, opts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatScalar(node *yaml.Node, opts []Option) error {
+	formatted, err := Format(node.Value, opts...)
+	if err != nil {
+		return err
+	}
+	node.Value = formatted
+	if strings.Contains(formatted, "\n") {
+		node.Style = yaml.LiteralStyle
+	} else if node.Style == yaml.LiteralStyle || node.Style == yaml.FoldedStyle {
+		node.Style = 0
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eval
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/undistro/cel-playground/utils"
+	"gopkg.in/yaml.v2"
+)
+
+// Option configures how expressions are compiled and evaluated.
+type Option func(*options)
+
+type options struct {
+	trace        bool
+	declarations Declarations
+	descriptors  *Descriptors
+	unknowns     []string
+	width        int
+	lint         bool
+	costLimit    uint64
+	profile      string
+	ctx          context.Context
+}
+
+func newOptions(opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithTrace records the value of every subexpression in the response trace.
+// Tracing evaluates all the branches of logical operators and conditionals, so the reported cost may be higher than
+// the one of a regular evaluation.
+func WithTrace() Option {
+	return func(o *options) {
+		o.trace = true
+	}
+}
+
+// WithLint reports the findings of the lint rules in the diagnostics of the response, see utils.Lint.
+func WithLint() Option {
+	return func(o *options) {
+		o.lint = true
+	}
+}
+
+// WithCostLimit aborts evaluations whose runtime cost exceeds the limit, with an error.
+func WithCostLimit(limit uint64) Option {
+	return func(o *options) {
+		o.costLimit = limit
+	}
+}
+
+// WithProfile selects the CEL environment of the Kubernetes version, see Profiles. Expressions may then use the
+// libraries available in that version only.
+func WithProfile(version string) Option {
+	return func(o *options) {
+		o.profile = version
+	}
+}
+
+// WithContext evaluates expressions with the context, evaluations then stop with a utils.InterruptedError when it is
+// done. It does not affect how expressions are compiled.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+func (o options) context() context.Context {
+	if o.ctx == nil {
+		return context.Background()
+	}
+	return o.ctx
+}
+
+// WithWidth sets the maximum line width of formatted expressions, see Format.
+func WithWidth(width int) Option {
+	return func(o *options) {
+		o.width = width
+	}
+}
+
+// Declarations are the types of variables, by name. Undeclared variables of the input are declared as dyn.
+type Declarations map[string]*cel.Type
+
+// ParseDeclarations decodes a YAML map from variable names to CEL types, e.g. 'list(string)' or 'timestamp'.
+func ParseDeclarations(input []byte) (Declarations, error) {
+	var types map[string]string
+	if err := yaml.Unmarshal(input, &types); err != nil {
+		return nil, fmt.Errorf("failed to decode declarations: %w", err)
+	}
+	declarations := Declarations{}
+	for name, text := range types {
+		t, err := utils.ParseType(text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to declare variable %s: %w", name, err)
+		}
+		declarations[name] = t
+	}
+	return declarations, nil
+}
+
+// WithDeclarations declares the variables with the given types, so that expressions are type-checked against them
+// and inputs are converted to them, e.g. RFC 3339 strings into timestamps.
+func WithDeclarations(declarations Declarations) Option {
+	return func(o *options) {
+		o.declarations = declarations
+	}
+}
+
+// cacheKey identifies the options affecting environments and programs in cache keys.
+func (o options) cacheKey() string {
+	digest := ""
+	if o.descriptors != nil {
+		digest = o.descriptors.digest
+	}
+	return utils.CacheKey(strconv.FormatBool(o.trace), utils.FormatDeclarations(o.declarations), digest,
+		strings.Join(o.unknowns, "\n"), strconv.FormatBool(o.lint), strconv.FormatUint(o.costLimit, 10), o.profile)
+}
+
+// WithUnknowns marks the attributes at the given paths as unknown, see utils.ParseAttributePattern for their syntax.
+// The evaluation then returns either a result which does not depend on them, or the residual expression left after
+// evaluating everything known.
+func WithUnknowns(paths ...string) Option {
+	return func(o *options) {
+		o.unknowns = append([]string{}, paths...)
+		sort.Strings(o.unknowns)
+	}
+}
+
+// ParseUnknowns decodes a YAML list of the paths of unknown attributes.
+func ParseUnknowns(input []byte) ([]string, error) {
+	var paths []string
+	if err := yaml.Unmarshal(input, &paths); err != nil {
+		return nil, fmt.Errorf("failed to decode unknowns: %w", err)
+	}
+	return paths, nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eval
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/undistro/cel-playground/utils"
+)
+
+var identifier = regexp.MustCompile(`^[_a-zA-Z][_a-zA-Z0-9]*$`)
+
+// Session evaluates expressions against variables which persist between evaluations: the input data loaded into the
+// session and the results bound with Let, which keep the type they were checked with.
+// Environments and programs are cached by the variables in scope, see Compile, so that evaluations do not rebuild
+// them. A session is not safe for concurrent use.
+type Session struct {
+	opts     []Option
+	profile  string
+	input    map[string]any
+	bindings map[string]ref.Val
+	types    Declarations
+	cost     *uint64
+}
+
+// NewSession returns a session without variables, evaluating expressions with the given options.
+func NewSession(opts ...Option) *Session {
+	return &Session{
+		opts:     opts,
+		profile:  newOptions(opts).profile,
+		input:    map[string]any{},
+		bindings: map[string]ref.Val{},
+		types:    Declarations{},
+	}
+}
+
+// Load decodes the YAML or JSON input, see utils.Decode, and adds its top-level keys to the variables of the session,
+// replacing the variables with the same names.
+func (s *Session) Load(input []byte) error {
+	inputMap, err := utils.Decode(input)
+	if err != nil {
+		return fmt.Errorf("failed to decode input: %w", err)
+	}
+	for name, value := range inputMap {
+		delete(s.bindings, name)
+		delete(s.types, name)
+		s.input[name] = value
+	}
+	return nil
+}
+
+// Eval evaluates the expression against the variables of the session.
+func (s *Session) Eval(exp string) (*EvalResponse, error) {
+	compiled, err := s.compile(exp)
+	if err != nil {
+		return nil, err
+	}
+	response, err := compiled.EvalContext(newOptions(s.opts).context(), s.activation())
+	if err != nil {
+		return nil, err
+	}
+	s.cost = response.Cost
+	return response, nil
+}
+
+// Let evaluates the expression and binds its result to the variable, declared with the type the expression is checked
+// to have.
+func (s *Session) Let(name, exp string) (*EvalResponse, error) {
+	if !identifier.MatchString(name) {
+		return nil, fmt.Errorf("invalid variable name %q", name)
+	}
+	compiled, err := s.compile(exp)
+	if err != nil {
+		return nil, err
+	}
+	val, costTracker, err := compiled.eval(newOptions(s.opts).context(), s.activation())
+	if err != nil {
+		return nil, err
+	}
+	if types.IsUnknown(val) {
+		return nil, fmt.Errorf("failed to bind %s: the result depends on unknown attributes", name)
+	}
+	response, err := compiled.response(val, costTracker)
+	if err != nil {
+		return nil, err
+	}
+	delete(s.input, name)
+	s.bindings[name] = val
+	s.types[name] = compiled.ast.OutputType()
+	s.cost = response.Cost
+	return response, nil
+}
+
+// Type returns the type the expression is checked to have, without evaluating it.
+func (s *Session) Type(exp string) (string, error) {
+	response, err := Check(exp, s.Variables(), s.options()...)
+	if err != nil {
+		return "", err
+	}
+	if !response.Valid {
+		err := fmt.Errorf("failed to compile the CEL expression: %s", response.Issues[0].Message)
+		return "", utils.NewDiagnosticsError(err, response.Issues)
+	}
+	return response.OutputType, nil
+}
+
+// Cost returns the runtime cost of the last evaluation, nil before the first one.
+func (s *Session) Cost() *uint64 {
+	return s.cost
+}
+
+// Profile returns the Kubernetes version whose CEL environment the session uses.
+func (s *Session) Profile() string {
+	if s.profile == "" {
+		return DefaultProfile
+	}
+	return s.profile
+}
+
+// SetProfile switches the session to the CEL environment of the Kubernetes version, see WithProfile.
+// Bound variables keep their values, expressions using them are checked again in the new environment.
+func (s *Session) SetProfile(version string) error {
+	if _, err := profileEnvOptions(version); err != nil {
+		return err
+	}
+	s.profile = version
+	return nil
+}
+
+// Variables returns the sorted names of the variables of the session.
+func (s *Session) Variables() []string {
+	names := make([]string, 0, len(s.input)+len(s.bindings))
+	for name := range s.input {
+		names = append(names, name)
+	}
+	for name := range s.bindings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Session) compile(exp string) (*CompiledExpression, error) {
+	return Compile(exp, s.Variables(), s.options()...)
+}
+
+// options are the options of the session followed by its profile and the declarations of the bound variables.
+func (s *Session) options() []Option {
+	declarations := Declarations{}
+	for name, t := range newOptions(s.opts).declarations {
+		declarations[name] = t
+	}
+	for name, t := range s.types {
+		declarations[name] = t
+	}
+	return append(append([]Option{}, s.opts...), WithProfile(s.profile), WithDeclarations(declarations))
+}
+
+func (s *Session) activation() map[string]any {
+	activation := make(map[string]any, len(s.input)+len(s.bindings))
+	for name, value := range s.input {
+		activation[name] = value
+	}
+	for name, value := range s.bindings {
+		activation[name] = value
+	}
+	return activation
+}
@@ -14,7 +14,11 @@
 
 package k8s
 
-import "github.com/google/cel-go/interpreter"
+import (
+	"strings"
+
+	"github.com/google/cel-go/interpreter"
+)
 
 type k8sActivation struct {
 	inputData                 map[string]any
@@ -45,3 +49,24 @@ func (a *k8sActivation) ResolveName(name string) (interface{}, bool) {
 func (a *k8sActivation) Parent() interpreter.Activation {
 	return nil
 }
+
+// variablesActivation resolves 'variables.<name>' through the memoized lazy evaluations of the composited variables,
+// all other names are resolved by the parent activation.
+type variablesActivation struct {
+	parent     interpreter.Activation
+	lazyEvals  lazyEvalMap
+	evaluation *evaluation
+}
+
+func (a *variablesActivation) ResolveName(name string) (interface{}, bool) {
+	if variableName, ok := strings.CutPrefix(name, "variables."); ok {
+		if lazyEval, ok := a.lazyEvals[variableName]; ok {
+			return lazyEval.eval(a.evaluation, a), true
+		}
+	}
+	return a.parent.ResolveName(name)
+}
+
+func (a *variablesActivation) Parent() interpreter.Activation {
+	return a.parent
+}
@@ -0,0 +1,308 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
+	"github.com/undistro/cel-playground/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Analysis is the static analysis of the expressions of a document, a validating admission policy, a webhook
+// configuration or a CRD, as editors need it. Unlike the compilation of policies, every expression is checked even
+// when others fail, and composited variables which fail to compile are declared as dyn for the expressions using them.
+// Diagnostics are the compilation errors and the findings of the lint rules of every expression.
+type Analysis struct {
+	Expressions []*AnalyzedExpression
+	Variables   []*AnalyzedVariable
+	Diagnostics []utils.Diagnostic
+	// Globals are the names of the variables declared for the expressions, besides 'variables'.
+	Globals []string
+}
+
+// AnalyzedExpression is an expression of a document, Type is the type it is checked to have, empty when it fails to
+// compile.
+type AnalyzedExpression struct {
+	Path       string
+	Expression string
+	Type       string
+	env        *cel.Env
+	ast        *cel.Ast
+}
+
+// AnalyzedVariable is a composited variable of a validating admission policy, NamePath is the YAML path of its name.
+type AnalyzedVariable struct {
+	Name     string
+	NamePath string
+	*AnalyzedExpression
+}
+
+// crdValidationVars declare the values validated by the rules of CRDs, whose types depend on the schema.
+var crdValidationVars = []cel.EnvOption{
+	cel.Variable("self", cel.DynType),
+	cel.Variable("oldSelf", cel.DynType),
+}
+
+// Analyze checks the expressions of the YAML or JSON document, returning an error when it is neither a validating
+// admission policy, a webhook configuration nor a CRD.
+func Analyze(input []byte) (*Analysis, error) {
+	var document struct {
+		Kind string `yaml:"kind"`
+	}
+	if err := yaml.Unmarshal(input, &document); err != nil {
+		return nil, fmt.Errorf("failed to decode input: %w", err)
+	}
+	if document.Kind == "CustomResourceDefinition" {
+		return analyzeCRD(input)
+	}
+
+	celInfo, err := extractCelInformation(input)
+	if err != nil {
+		return nil, err
+	}
+	// lint enables the macro call tracking needed to locate subexpressions
+	o := options{lint: true}
+	if strings.HasPrefix(document.Kind, "ValidatingAdmissionPolicy") {
+		return analyzeValidatingAdmissionPolicy(celInfo, o)
+	}
+	return analyzeWebhook(celInfo, o)
+}
+
+func analyzeValidatingAdmissionPolicy(celInfo *CelInformation, o options) (*Analysis, error) {
+	env, err := newEnv(validatingAdmissionPolicyVars, o)
+	if err != nil {
+		return nil, err
+	}
+	a := &Analysis{Globals: []string{"authorizer", "namespaceObject", "object", "oldObject", "params", "request"}}
+
+	positions := map[string]int{}
+	for i, variable := range celInfo.variables {
+		if _, ok := positions[variable.name]; !ok {
+			positions[variable.name] = i
+		}
+	}
+	for i, variable := range celInfo.variables {
+		path := fmt.Sprintf("spec.variables[%d].expression", i)
+		expression := &AnalyzedExpression{Path: path, Expression: variable.expression, env: env}
+		outputType := cel.DynType
+		ast, issues := env.Parse(variable.expression)
+		if issues.Err() == nil {
+			issues = checkVariableReferences(ast, i, celInfo.variables, positions)
+		}
+		if issues.Err() == nil {
+			ast, issues = env.Check(ast)
+		}
+		if issues.Err() != nil {
+			a.Diagnostics = append(a.Diagnostics, utils.IssuesDiagnostics(variable.expression, path, issues)...)
+		} else {
+			a.setAST(expression, ast)
+			outputType = ast.OutputType()
+		}
+		a.Expressions = append(a.Expressions, expression)
+
+		namePath := fmt.Sprintf("spec.variables[%d].name", i)
+		if positions[variable.name] != i {
+			a.Diagnostics = append(a.Diagnostics, utils.Diagnostic{
+				Severity: utils.SeverityError,
+				Message:  fmt.Sprintf("variable %s is declared more than once", variable.name),
+				Path:     namePath,
+			})
+			continue
+		}
+		a.Variables = append(a.Variables, &AnalyzedVariable{Name: variable.name, NamePath: namePath, AnalyzedExpression: expression})
+		if env, err = env.Extend(cel.Variable("variables."+variable.name, outputType)); err != nil {
+			return nil, fmt.Errorf("failed to initialize variables: could not append variable %s to CEL env: %w", variable.name, err)
+		}
+	}
+
+	for i, matchCondition := range celInfo.matchConditions {
+		a.check(env, fmt.Sprintf("spec.matchConditions[%d].expression", i), matchCondition.expression, cel.BoolType)
+	}
+	for i, validation := range celInfo.validations {
+		a.check(env, fmt.Sprintf("spec.validations[%d].expression", i), validation.expression, cel.BoolType)
+		if validation.messageExpression != "" {
+			a.check(env, fmt.Sprintf("spec.validations[%d].messageExpression", i), validation.messageExpression, cel.StringType)
+		} else if diagnostic := utils.LintMessage(validation.message, fmt.Sprintf("spec.validations[%d].message", i)); diagnostic != nil {
+			a.Diagnostics = append(a.Diagnostics, *diagnostic)
+		}
+	}
+	for i, auditAnnotation := range celInfo.auditAnnotations {
+		a.check(env, fmt.Sprintf("spec.auditAnnotations[%d].valueExpression", i), auditAnnotation.expression, cel.StringType)
+	}
+	return a, nil
+}
+
+func analyzeWebhook(celInfo *CelInformation, o options) (*Analysis, error) {
+	env, err := newEnv(webhookVars, o)
+	if err != nil {
+		return nil, err
+	}
+	a := &Analysis{Globals: []string{"authorizer", "object", "oldObject", "request"}}
+	for i, matchConditions := range celInfo.webhookMatchConditions {
+		for j, matchCondition := range matchConditions {
+			a.check(env, fmt.Sprintf("webhooks[%d].matchConditions[%d].expression", i, j), matchCondition.expression, cel.BoolType)
+		}
+	}
+	return a, nil
+}
+
+// analyzeCRD checks the rules and message expressions of the x-kubernetes-validations of the schemas of a CRD.
+func analyzeCRD(input []byte) (*Analysis, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(input, &document); err != nil {
+		return nil, fmt.Errorf("failed to decode input: %w", err)
+	}
+	env, err := newEnv(crdValidationVars, options{lint: true})
+	if err != nil {
+		return nil, err
+	}
+	a := &Analysis{Globals: []string{"oldSelf", "self"}}
+	var walk func(node *yaml.Node, path string)
+	walk = func(node *yaml.Node, path string) {
+		switch node.Kind {
+		case yaml.DocumentNode:
+			for _, child := range node.Content {
+				walk(child, path)
+			}
+		case yaml.SequenceNode:
+			for i, child := range node.Content {
+				walk(child, fmt.Sprintf("%s[%d]", path, i))
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i].Value, node.Content[i+1]
+				childPath := strings.TrimPrefix(path+"."+key, ".")
+				if key == "x-kubernetes-validations" && value.Kind == yaml.SequenceNode {
+					a.checkCRDRules(env, childPath, value)
+					continue
+				}
+				walk(value, childPath)
+			}
+		}
+	}
+	walk(&document, "")
+	return a, nil
+}
+
+func (a *Analysis) checkCRDRules(env *cel.Env, path string, rules *yaml.Node) {
+	for i, rule := range rules.Content {
+		var fields struct {
+			Rule              string `yaml:"rule"`
+			Message           string `yaml:"message"`
+			MessageExpression string `yaml:"messageExpression"`
+		}
+		if rule.Decode(&fields) != nil {
+			continue
+		}
+		rulePath := fmt.Sprintf("%s[%d]", path, i)
+		if fields.Rule != "" {
+			a.check(env, rulePath+".rule", fields.Rule, cel.BoolType)
+		}
+		if fields.MessageExpression != "" {
+			a.check(env, rulePath+".messageExpression", fields.MessageExpression, cel.StringType)
+		} else if diagnostic := utils.LintMessage(fields.Message, rulePath+".message"); diagnostic != nil {
+			a.Diagnostics = append(a.Diagnostics, *diagnostic)
+		}
+	}
+}
+
+// check compiles the expression found at path, which must evaluate to the expected type, and records its diagnostics.
+func (a *Analysis) check(env *cel.Env, path, source string, expectedType *cel.Type) {
+	expression := &AnalyzedExpression{Path: path, Expression: source, env: env}
+	ast, issues := env.Compile(source)
+	if issues.Err() == nil {
+		a.setAST(expression, ast)
+		issues = checkOutputType(ast, expectedType)
+	}
+	if issues.Err() != nil {
+		a.Diagnostics = append(a.Diagnostics, utils.IssuesDiagnostics(source, path, issues)...)
+	}
+	a.Expressions = append(a.Expressions, expression)
+}
+
+func (a *Analysis) setAST(expression *AnalyzedExpression, ast *cel.Ast) {
+	expression.ast = ast
+	expression.Type = ast.OutputType().String()
+	a.Diagnostics = append(a.Diagnostics, utils.Lint(ast, expression.Path)...)
+}
+
+// Expression returns the expression at the YAML path, or nil.
+func (a *Analysis) Expression(path string) *AnalyzedExpression {
+	for _, expression := range a.Expressions {
+		if expression.Path == path {
+			return expression
+		}
+	}
+	return nil
+}
+
+// Variable returns the composited variable with the name, or nil.
+func (a *Analysis) Variable(name string) *AnalyzedVariable {
+	for _, variable := range a.Variables {
+		if variable.Name == name {
+			return variable
+		}
+	}
+	return nil
+}
+
+// TypeAt returns the innermost subexpression containing the character offset and the type it is checked to have, or
+// false when the expression does not compile or no subexpression contains the offset.
+func (e *AnalyzedExpression) TypeAt(offset int) (utils.Span, string, bool) {
+	if e.ast == nil {
+		return utils.Span{}, "", false
+	}
+	checked, err := cel.AstToCheckedExpr(e.ast)
+	if err != nil {
+		return utils.Span{}, "", false
+	}
+	var found utils.Span
+	var foundType string
+	for id, span := range utils.ExprSpans(checked.GetExpr(), checked.GetSourceInfo(), e.Expression) {
+		t, ok := checked.GetTypeMap()[id]
+		if !ok || offset < span.Start || offset >= span.End {
+			continue
+		}
+		if foundType == "" || span.End-span.Start < found.End-found.Start {
+			found, foundType = span, checker.FormatCheckedType(t)
+		}
+	}
+	return found, foundType, foundType != ""
+}
+
+// Check returns the type of another expression checked in the environment of this one, such as the operand of a
+// field selection being typed, or false when it does not compile.
+func (e *AnalyzedExpression) Check(source string) (string, bool) {
+	ast, issues := e.env.Compile(source)
+	if issues.Err() != nil {
+		return "", false
+	}
+	return ast.OutputType().String(), true
+}
+
+// VariableNames returns the sorted names of the composited variables.
+func (a *Analysis) VariableNames() []string {
+	names := make([]string, 0, len(a.Variables))
+	for _, variable := range a.Variables {
+		names = append(names, variable.Name)
+	}
+	sort.Strings(names)
+	return names
+}
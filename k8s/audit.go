@@ -0,0 +1,460 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/undistro/cel-playground/utils"
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/api/admissionregistration/v1alpha1"
+	"k8s.io/api/admissionregistration/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	operationCreate = "CREATE"
+	operationUpdate = "UPDATE"
+)
+
+// AuditRequest is the audit of a validating admission policy against existing objects, e.g. the dump of a cluster.
+// Each object is admitted by a request of the operation: UPDATE, the default, where the old object is the object, or
+// CREATE. The Namespace objects among the objects are the namespaces of the others.
+type AuditRequest struct {
+	Policy    []byte
+	Objects   []map[string]any
+	Operation string
+	Params    map[string]any
+	CostLimit uint64
+}
+
+// AuditSummary counts the audited objects: the ones the policy applies to, per its match constraints and match
+// conditions, the ones it rejects and the ones some expression of which failed.
+type AuditSummary struct {
+	Objects   int `json:"objects"`
+	Matched   int `json:"matched"`
+	Violating int `json:"violating"`
+	Errors    int `json:"errors"`
+}
+
+// AuditViolation lists the objects of a namespace, as kind/name, rejected with the same message. The namespace of
+// cluster-scoped objects is empty.
+type AuditViolation struct {
+	Namespace string   `json:"namespace,omitempty"`
+	Message   string   `json:"message"`
+	Objects   []string `json:"objects"`
+}
+
+// AuditResponse reports the objects violating the policy, grouped by namespace and message, the cost is the one of
+// all the evaluations.
+type AuditResponse struct {
+	Summary    AuditSummary      `json:"summary"`
+	Violations []*AuditViolation `json:"violations"`
+	Cost       uint64            `json:"cost"`
+}
+
+// AuditValidatingAdmissionPolicy evaluates the validating admission policy against each object of the YAML stream, see
+// DecodeObjects and Audit. The objects are created rather than updated when create is set.
+//
+// Parameters are given with WithParams.
+func AuditValidatingAdmissionPolicy(policyInput, objectsInput []byte, create bool, opts ...Option) (string, error) {
+	o := newOptions(opts)
+	request := &AuditRequest{Policy: policyInput, Operation: operationUpdate, CostLimit: o.costLimit}
+	if create {
+		request.Operation = operationCreate
+	}
+	var err error
+	if request.Objects, err = DecodeObjects(objectsInput); err != nil {
+		return "", err
+	}
+	if request.Params, err = utils.Decode(o.params); err != nil {
+		return "", fmt.Errorf("failed to decode input for the params: %w", err)
+	}
+	response, err := Audit(o.context(), request)
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(response)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal the output: %w", err)
+	}
+	return string(out), nil
+}
+
+// DecodeObjects decodes the objects of a YAML stream, e.g. the output of 'kubectl get -A -o yaml': its documents, the
+// items of the Lists among them being expanded, see utils.ListItems.
+func DecodeObjects(input []byte) ([]map[string]any, error) {
+	documents, err := utils.DecodeDocuments(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode input for the objects: %w", err)
+	}
+	var objects []map[string]any
+	for _, document := range documents {
+		if items, ok, err := utils.ListItems(document); err != nil {
+			return nil, err
+		} else if ok {
+			objects = append(objects, items...)
+		} else {
+			objects = append(objects, document)
+		}
+	}
+	return objects, nil
+}
+
+// Audit evaluates the validating admission policy of the request against each of its objects matched by the match
+// constraints of the policy. The audit stops with a utils.InterruptedError, carrying the cost of the whole audit, when
+// the context is done.
+func Audit(ctx context.Context, r *AuditRequest) (*AuditResponse, error) {
+	operation := r.Operation
+	switch operation {
+	case "":
+		operation = operationUpdate
+	case operationCreate, operationUpdate:
+	default:
+		return nil, fmt.Errorf("unsupported operation %s, expected %s or %s", operation, operationCreate, operationUpdate)
+	}
+	policy, err := compileValidatingAdmissionPolicy(r.Policy, options{costLimit: r.CostLimit})
+	if err != nil {
+		return nil, err
+	}
+	matcher, err := newObjectMatcher(r.Policy)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]*auditObject, len(r.Objects))
+	namespaces := map[string]*NamespaceType{}
+	for i, object := range r.Objects {
+		if objects[i], err = newAuditObject(object); err != nil {
+			return nil, fmt.Errorf("object %d: %w", i, err)
+		}
+		if objects[i].isNamespace() {
+			if namespaces[objects[i].name], err = namespaceOf(object); err != nil {
+				return nil, fmt.Errorf("object %d: %w", i, err)
+			}
+		}
+	}
+
+	failClosed := FailsClosed(r.Policy)
+	response := &AuditResponse{Violations: []*AuditViolation{}}
+	violations := map[[2]string]*AuditViolation{}
+	for _, object := range objects {
+		response.Summary.Objects++
+		namespace := namespaces[object.namespace]
+		if !matcher.matches(object, operation, namespace) {
+			continue
+		}
+		request := &PolicyRequest{
+			Policy:    r.Policy,
+			Object:    object.value,
+			Namespace: namespace,
+			Request:   object.request(operation),
+			Params:    r.Params,
+			CostLimit: r.CostLimit,
+		}
+		if operation == operationUpdate {
+			request.OldObject = object.value
+		}
+		evalResponse, err := EvaluateValidatingAdmissionPolicy(ctx, request)
+		var interrupted *utils.InterruptedError
+		if errors.As(err, &interrupted) {
+			return nil, utils.NewInterruptedError(ctx.Err(), response.Cost+interrupted.Cost)
+		} else if err != nil {
+			return nil, err
+		}
+		if evalResponse.Cost != nil {
+			response.Cost += *evalResponse.Cost
+		}
+		if evalResponse.Matched() {
+			response.Summary.Matched++
+		}
+		messages, failed := auditMessages(policy, evalResponse, failClosed)
+		if failed {
+			response.Summary.Errors++
+		}
+		if evalResponse.Allowed(failClosed) {
+			continue
+		}
+		response.Summary.Violating++
+		for _, message := range messages {
+			key := [2]string{object.namespace, message}
+			violation, ok := violations[key]
+			if !ok {
+				violation = &AuditViolation{Namespace: object.namespace, Message: message}
+				violations[key] = violation
+				response.Violations = append(response.Violations, violation)
+			}
+			violation.Objects = append(violation.Objects, object.kind.Kind+"/"+object.name)
+		}
+	}
+	// the messages of a namespace are kept in the order they were first reported in
+	sort.SliceStable(response.Violations, func(i, j int) bool {
+		return response.Violations[i].Namespace < response.Violations[j].Namespace
+	})
+	return response, nil
+}
+
+// auditMessages returns the messages rejecting the request, the ones of the false validations or their expressions as
+// the apiserver reports them, and the errors of the failed expressions, which only reject requests when failing
+// closed. It also returns whether some expression failed.
+func auditMessages(policy *compiledPolicy, response *EvalResponse, failClosed bool) ([]string, bool) {
+	var messages []string
+	failed := false
+	for _, matchCondition := range response.MatchConditions {
+		if matchCondition.IsError {
+			failed = true
+			if failClosed {
+				messages = append(messages, *matchCondition.Error)
+			}
+		}
+	}
+	if failed {
+		// the validations do not decide the admission when a match condition fails
+		return messages, true
+	}
+	for i, validation := range response.Validations {
+		expression := policy.validations[i].expression
+		switch {
+		case validation.IsError:
+			failed = true
+			if failClosed {
+				messages = append(messages, *validation.Error)
+			}
+		case validation.Result == true:
+		case validation.Message != nil && validation.Message != "":
+			messages = append(messages, fmt.Sprint(validation.Message))
+		default:
+			messages = append(messages, fmt.Sprintf("failed expression: %s", expression))
+		}
+	}
+	return messages, failed
+}
+
+// auditObject is an object of an audit along with the attributes of its admission requests.
+type auditObject struct {
+	value     map[string]any
+	kind      GVKType
+	resource  GVRType
+	name      string
+	namespace string
+	labels    map[string]string
+}
+
+func newAuditObject(object map[string]any) (*auditObject, error) {
+	apiVersion, _ := object["apiVersion"].(string)
+	kind, _ := object["kind"].(string)
+	if apiVersion == "" || kind == "" {
+		return nil, errors.New("expected a Kubernetes object, with an apiVersion and a kind")
+	}
+	o := &auditObject{value: object, labels: map[string]string{}}
+	group, version, found := strings.Cut(apiVersion, "/")
+	if !found {
+		// the core group
+		group, version = "", apiVersion
+	}
+	o.kind = GVKType{Group: group, Version: version, Kind: kind}
+	o.resource = GVRType{Group: group, Version: version, Resource: resourceOf(kind)}
+	if objectMeta, ok := object[metadata].(map[string]any); ok {
+		o.name, _ = objectMeta[metadataName].(string)
+		o.namespace, _ = objectMeta["namespace"].(string)
+		if objectLabels, ok := objectMeta["labels"].(map[string]any); ok {
+			for key, value := range objectLabels {
+				o.labels[key] = fmt.Sprint(value)
+			}
+		}
+	}
+	return o, nil
+}
+
+func (o *auditObject) isNamespace() bool {
+	return o.kind.Group == "" && o.kind.Kind == "Namespace"
+}
+
+// request returns the admission request of the operation on the object, by a user without attributes.
+func (o *auditObject) request(operation string) *AdmissionRequest {
+	kind, resource := o.kind, o.resource
+	return &AdmissionRequest{
+		Kind:            kind,
+		Resource:        resource,
+		RequestKind:     &kind,
+		RequestResource: &resource,
+		Name:            o.name,
+		Namespace:       o.namespace,
+		Operation:       operation,
+	}
+}
+
+// irregularResources are the resources of the built-in kinds whose plural is not derived from their kind.
+var irregularResources = map[string]string{
+	"endpoints": "endpoints",
+}
+
+// resourceOf returns the resource of the kind, its lowercase plural, as the REST mapping of a cluster would, as long
+// as the plural is regular.
+func resourceOf(kind string) string {
+	singular := strings.ToLower(kind)
+	if resource, ok := irregularResources[singular]; ok {
+		return resource
+	}
+	switch {
+	case strings.HasSuffix(singular, "s"), strings.HasSuffix(singular, "x"), strings.HasSuffix(singular, "z"),
+		strings.HasSuffix(singular, "ch"), strings.HasSuffix(singular, "sh"):
+		return singular + "es"
+	case strings.HasSuffix(singular, "y") && len(singular) > 1 && !strings.ContainsRune("aeiou", rune(singular[len(singular)-2])):
+		return singular[:len(singular)-1] + "ies"
+	}
+	return singular + "s"
+}
+
+// namespaceOf converts a Namespace object to the type of the namespaceObject variable.
+func namespaceOf(object map[string]any) (*NamespaceType, error) {
+	data, err := yaml.Marshal(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert the namespace: %w", err)
+	}
+	namespace, err := deserializeNamespace(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert the namespace: %w", err)
+	}
+	return namespace, nil
+}
+
+// objectMatcher selects the objects of the requests a policy applies to, per its match constraints. Policies without
+// match constraints, or without resource rules, apply to every object.
+type objectMatcher struct {
+	constraints       *v1.MatchResources
+	namespaceSelector labels.Selector
+	objectSelector    labels.Selector
+}
+
+func newObjectMatcher(policyInput []byte) (*objectMatcher, error) {
+	object, err := deserializeCelInformation(policyInput)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode input: %w", err)
+	}
+	var constraints any
+	switch policy := object.(type) {
+	case *v1alpha1.ValidatingAdmissionPolicy:
+		constraints = policy.Spec.MatchConstraints
+	case *v1beta1.ValidatingAdmissionPolicy:
+		constraints = policy.Spec.MatchConstraints
+	case *v1.ValidatingAdmissionPolicy:
+		constraints = policy.Spec.MatchConstraints
+	default:
+		return nil, fmt.Errorf("expected a validating admission policy, got %s", object.GetObjectKind().GroupVersionKind().Kind)
+	}
+	// the match constraints have the same fields in every version
+	data, err := json.Marshal(constraints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert the match constraints: %w", err)
+	}
+	m := &objectMatcher{namespaceSelector: labels.Everything(), objectSelector: labels.Everything()}
+	if err := json.Unmarshal(data, &m.constraints); err != nil {
+		return nil, fmt.Errorf("failed to convert the match constraints: %w", err)
+	}
+	if m.constraints == nil {
+		return m, nil
+	}
+	if m.namespaceSelector, err = selector(m.constraints.NamespaceSelector); err != nil {
+		return nil, fmt.Errorf("invalid namespace selector: %w", err)
+	}
+	if m.objectSelector, err = selector(m.constraints.ObjectSelector); err != nil {
+		return nil, fmt.Errorf("invalid object selector: %w", err)
+	}
+	return m, nil
+}
+
+// selector converts a label selector, an absent one selecting everything.
+func selector(labelSelector *metav1.LabelSelector) (labels.Selector, error) {
+	if labelSelector == nil {
+		return labels.Everything(), nil
+	}
+	return metav1.LabelSelectorAsSelector(labelSelector)
+}
+
+// matches returns whether the policy applies to the operation on the object, in the namespace, if any.
+func (m *objectMatcher) matches(o *auditObject, operation string, namespace *NamespaceType) bool {
+	if m.constraints == nil {
+		return true
+	}
+	if !m.objectSelector.Matches(labels.Set(o.labels)) {
+		return false
+	}
+	// the namespace selector applies to namespaced objects and to namespaces themselves
+	switch {
+	case o.isNamespace():
+		if !m.namespaceSelector.Matches(labels.Set(o.labels)) {
+			return false
+		}
+	case o.namespace != "":
+		namespaceLabels := labels.Set{}
+		if namespace != nil {
+			namespaceLabels = namespace.Metadata.Labels
+		}
+		if !m.namespaceSelector.Matches(namespaceLabels) {
+			return false
+		}
+	}
+	for _, rule := range m.constraints.ExcludeResourceRules {
+		if ruleMatches(rule, o, operation) {
+			return false
+		}
+	}
+	if len(m.constraints.ResourceRules) == 0 {
+		return true
+	}
+	for _, rule := range m.constraints.ResourceRules {
+		if ruleMatches(rule, o, operation) {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleMatches(rule v1.NamedRuleWithOperations, o *auditObject, operation string) bool {
+	if len(rule.ResourceNames) > 0 && !slices.Contains(rule.ResourceNames, o.name) {
+		return false
+	}
+	if !slices.Contains(rule.Operations, v1.OperationType(operation)) && !slices.Contains(rule.Operations, v1.OperationAll) {
+		return false
+	}
+	if !matchesAll(rule.APIGroups, o.kind.Group) || !matchesAll(rule.APIVersions, o.kind.Version) {
+		return false
+	}
+	// '*' matches the resources and '*/*' their subresources too, the requests of an audit have no subresource
+	if !matchesAll(rule.Resources, o.resource.Resource) && !slices.Contains(rule.Resources, "*/*") {
+		return false
+	}
+	switch scope := rule.Scope; {
+	case scope == nil || *scope == v1.AllScopes:
+		return true
+	case *scope == v1.ClusterScope:
+		return o.namespace == ""
+	default:
+		return o.namespace != ""
+	}
+}
+
+// matchesAll returns whether the values contain the value or '*'.
+func matchesAll(values []string, value string) bool {
+	return slices.Contains(values, value) || slices.Contains(values, "*")
+}
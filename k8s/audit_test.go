@@ -0,0 +1,121 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/undistro/cel-playground/k8s"
+)
+
+const auditPolicy = `apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingAdmissionPolicy
+metadata:
+  name: deployments
+spec:
+  matchConstraints:
+    namespaceSelector:
+      matchExpressions:
+        - key: environment
+          operator: NotIn
+          values: ["dev"]
+    resourceRules:
+      - apiGroups: ["apps"]
+        apiVersions: ["v1"]
+        operations: ["CREATE", "UPDATE"]
+        resources: ["deployments"]
+  validations:
+    - expression: object.spec.replicas >= 2
+      message: too few replicas
+    - expression: "'team' in object.metadata.?labels.orValue({})"
+    - expression: oldObject == null || object.spec.replicas == oldObject.spec.replicas
+`
+
+const auditObjects = `apiVersion: v1
+kind: List
+items:
+  - apiVersion: v1
+    kind: Namespace
+    metadata: {name: prod, labels: {environment: prod}}
+  - apiVersion: v1
+    kind: Namespace
+    metadata: {name: dev, labels: {environment: dev}}
+  - apiVersion: apps/v1
+    kind: Deployment
+    metadata: {name: web, namespace: prod, labels: {team: a}}
+    spec: {replicas: 3}
+  - apiVersion: apps/v1
+    kind: Deployment
+    metadata: {name: api, namespace: prod}
+    spec: {replicas: 1}
+  - apiVersion: apps/v1
+    kind: Deployment
+    metadata: {name: worker, namespace: prod, labels: {team: b}}
+    spec: {replicas: 1}
+  - apiVersion: apps/v1
+    kind: Deployment
+    metadata: {name: test, namespace: dev}
+    spec: {replicas: 1}
+  - apiVersion: v1
+    kind: ConfigMap
+    metadata: {name: config, namespace: prod}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata: {name: lonely, namespace: default, labels: {team: c}}
+spec: {replicas: 1}
+`
+
+func TestAudit(t *testing.T) {
+	objects, err := k8s.DecodeObjects([]byte(auditObjects))
+	if err != nil {
+		t.Fatalf("DecodeObjects() error = %v", err)
+	}
+	for _, operation := range []string{"", "CREATE"} {
+		t.Run(operation, func(t *testing.T) {
+			response, err := k8s.Audit(context.Background(), &k8s.AuditRequest{
+				Policy:    []byte(auditPolicy),
+				Objects:   objects,
+				Operation: operation,
+			})
+			if err != nil {
+				t.Fatalf("Audit() error = %v", err)
+			}
+			expectedSummary := k8s.AuditSummary{Objects: 8, Matched: 4, Violating: 3}
+			if response.Summary != expectedSummary {
+				t.Errorf("expected %+v, got %+v", expectedSummary, response.Summary)
+			}
+			expected := []*k8s.AuditViolation{
+				{Namespace: "default", Message: "too few replicas", Objects: []string{"Deployment/lonely"}},
+				{Namespace: "prod", Message: "too few replicas", Objects: []string{"Deployment/api", "Deployment/worker"}},
+				{Namespace: "prod", Message: "failed expression: 'team' in object.metadata.?labels.orValue({})", Objects: []string{"Deployment/api"}},
+			}
+			if !reflect.DeepEqual(response.Violations, expected) {
+				for _, violation := range response.Violations {
+					t.Logf("%+v", violation)
+				}
+				t.Errorf("unexpected violations")
+			}
+			if response.Cost == 0 {
+				t.Errorf("expected the cost of the evaluations")
+			}
+		})
+	}
+	if _, err := k8s.Audit(context.Background(), &k8s.AuditRequest{Policy: []byte(auditPolicy), Operation: "DELETE"}); err == nil {
+		t.Errorf("expected DELETE requests not to be audited")
+	}
+}
@@ -15,12 +15,16 @@
 package k8s
 
 import (
+	"fmt"
+	"reflect"
 	"strings"
 
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
 	"github.com/google/cel-go/common/types/traits"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -31,6 +35,36 @@ var (
 	DecisionType      = cel.OpaqueType("playground.k8s.Decision")
 )
 
+// authorizerEnvOptions declares the functions of the authorizer types so expressions using them can be type-checked,
+// the calls are dispatched to the Receive method of the values.
+var authorizerEnvOptions = []cel.EnvOption{
+	receiverFunction("path", AuthorizerType, PathCheckType, cel.StringType),
+	receiverFunction("group", AuthorizerType, GroupCheckType, cel.StringType),
+	receiverFunction("serviceAccount", AuthorizerType, AuthorizerType, cel.StringType, cel.StringType),
+	receiverFunction("check", PathCheckType, DecisionType, cel.StringType),
+	receiverFunction("resource", GroupCheckType, ResourceCheckType, cel.StringType),
+	receiverFunction("subresource", ResourceCheckType, ResourceCheckType, cel.StringType),
+	receiverFunction("namespace", ResourceCheckType, ResourceCheckType, cel.StringType),
+	receiverFunction("name", ResourceCheckType, ResourceCheckType, cel.StringType),
+	receiverFunction("check", ResourceCheckType, DecisionType, cel.StringType),
+	receiverFunction("errored", DecisionType, cel.BoolType),
+	receiverFunction("error", DecisionType, cel.StringType),
+	receiverFunction("allowed", DecisionType, cel.BoolType),
+	receiverFunction("reason", DecisionType, cel.StringType),
+}
+
+func receiverFunction(function string, receiverType, resultType *cel.Type, argTypes ...*cel.Type) cel.EnvOption {
+	overload := strings.ToLower(strings.TrimPrefix(receiverType.String(), "playground.k8s.")) + "_" + function
+	return cel.Function(function, cel.MemberOverload(overload, append([]*cel.Type{receiverType}, argTypes...), resultType,
+		cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+			if receiver, ok := args[0].(traits.Receiver); ok {
+				return receiver.Receive(function, overload, args[1:])
+			}
+			return types.MaybeNoSuchOverloadErr(args[0])
+		}),
+	))
+}
+
 var _ traits.Receiver = &Authorizer{}
 
 type Authorizer struct {
@@ -242,6 +276,21 @@ type Decision struct {
 
 var _ traits.Receiver = &Decision{}
 
+// ConvertToNative converts the decision to JSON, so that decisions can be returned by expressions.
+func (d *Decision) ConvertToNative(typeDesc reflect.Type) (any, error) {
+	if typeDesc != reflect.TypeOf(&structpb.Value{}) {
+		return d.receiverOnlyObjectVal.ConvertToNative(typeDesc)
+	}
+	decision := map[string]any{"allowed": d.Decision == "allow"}
+	if d.Reason != "" {
+		decision["reason"] = d.Reason
+	}
+	if d.Error != "" {
+		decision["error"] = d.Error
+	}
+	return structpb.NewValue(decision)
+}
+
 func (d *Decision) Receive(function string, overload string, args []ref.Val) ref.Val {
 	if len(args) == 0 {
 		switch function {
@@ -293,6 +342,15 @@ func getValOrEmpty(val any) string {
 	}
 }
 
+// deserializeAuthorizer decodes the authorization decisions, an empty input denies everything.
+func deserializeAuthorizer(authorizerData []byte) (*Authorizer, error) {
+	authorizer := &Authorizer{}
+	if err := yaml.Unmarshal(authorizerData, authorizer); err != nil {
+		return nil, fmt.Errorf("failed to decode input for the authorizer: %w", err)
+	}
+	return authorizer, nil
+}
+
 func getAuthorizerRequestResource(authorizer *Authorizer, request map[string]any) (*ResourceCheck, error) {
 	if authorizer == nil || request == nil {
 		return nil, nil
@@ -17,6 +17,7 @@ package k8s
 import (
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/ext"
+	"github.com/undistro/cel-playground/utils"
 	k8s "k8s.io/apiserver/pkg/cel/library"
 )
 
@@ -32,6 +33,11 @@ var celEnvOptions = []cel.EnvOption{
 	k8s.Quantity(),
 }
 
-var celProgramOptions = []cel.ProgramOption{
+var celProgramOptions = append([]cel.ProgramOption{
 	cel.EvalOptions(cel.OptOptimize, cel.OptTrackCost),
+}, utils.InterruptProgramOptions...)
+
+// traceProgramOptions record the value of every subexpression, evaluating all branches.
+var traceProgramOptions = []cel.ProgramOption{
+	cel.EvalOptions(cel.OptTrackState, cel.OptExhaustiveEval),
 }
@@ -0,0 +1,314 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/undistro/cel-playground/utils"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+const (
+	// profiles identify the environment options used by this package in the program cache keys
+	validatingAdmissionPolicyProfile = "k8s-vap"
+	webhookProfile                   = "k8s-webhook"
+
+	policyCacheSize = 64
+)
+
+var policyCache = utils.NewCache[*compiledPolicy](policyCacheSize)
+
+var (
+	// validatingAdmissionPolicyVars are always declared so expressions are checked the same way regardless of which
+	// inputs are provided, match conditions and validations only differ in the values bound at evaluation time.
+	validatingAdmissionPolicyVars = []cel.EnvOption{
+		cel.Variable("object", cel.DynType),
+		cel.Variable("oldObject", cel.DynType),
+		cel.Variable("request", cel.DynType),
+		cel.Variable("namespaceObject", cel.DynType),
+		cel.Variable("params", cel.DynType),
+		cel.Variable("authorizer", AuthorizerType),
+		cel.Variable("authorizer.requestResource", ResourceCheckType),
+	}
+	webhookVars = []cel.EnvOption{
+		cel.Variable("object", cel.DynType),
+		cel.Variable("oldObject", cel.DynType),
+		cel.Variable("request", cel.DynType),
+		cel.Variable("authorizer", AuthorizerType),
+		cel.Variable("authorizer.requestResource", ResourceCheckType),
+	}
+)
+
+// compiledExpression is a type-checked and planned CEL expression of a policy, path is the YAML path of its field.
+// Failures to plan the program are kept and reported when the expression is evaluated.
+type compiledExpression struct {
+	expression string
+	path       string
+	ast        *cel.Ast
+	prog       cel.Program
+	err        error
+	traced     bool
+}
+
+func (c *compiledExpression) program() (cel.Program, error) {
+	return c.prog, c.err
+}
+
+// trace returns the values of the subexpressions recorded during an evaluation, when the policy is traced.
+func (c *compiledExpression) trace(details *cel.EvalDetails) []utils.TraceEntry {
+	if !c.traced || details == nil {
+		return nil
+	}
+	return utils.Trace(c.ast, details.State())
+}
+
+type compiledVariable struct {
+	name string
+	*compiledExpression
+}
+
+type compiledMatchCondition struct {
+	name string
+	*compiledExpression
+}
+
+type compiledValidation struct {
+	*compiledExpression
+	message           string
+	messageExpression *compiledExpression
+}
+
+type compiledAuditAnnotation struct {
+	key string
+	*compiledExpression
+}
+
+// compiledPolicy holds the CEL programs of a policy or webhook configuration, planned once.
+// It is safe for concurrent use, all per request state is kept by the evaluation.
+type compiledPolicy struct {
+	variables              []*compiledVariable
+	matchConditions        []*compiledMatchCondition
+	validations            []*compiledValidation
+	auditAnnotations       []*compiledAuditAnnotation
+	webhookMatchConditions [][]*compiledMatchCondition
+	// diagnostics are the lint findings, when linting
+	diagnostics []utils.Diagnostic
+}
+
+// compileValidatingAdmissionPolicy returns the compiled policy, compiled policies are cached by their source and options.
+func compileValidatingAdmissionPolicy(policyInput []byte, o options) (*compiledPolicy, error) {
+	key := utils.CacheKey(validatingAdmissionPolicyProfile, o.cacheKey(), string(policyInput))
+	if policy, ok := policyCache.Get(key); ok {
+		return policy, nil
+	}
+
+	celInfo, err := extractCelInformation(policyInput)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := newEnv(validatingAdmissionPolicyVars, o)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &compiledPolicy{}
+	if policy.variables, env, err = compileVariables(env, celInfo.variables, o); err != nil {
+		return nil, err
+	}
+	if policy.matchConditions, err = compileMatchConditions(env, "spec.matchConditions", celInfo.matchConditions, o); err != nil {
+		return nil, err
+	}
+	for i, validation := range celInfo.validations {
+		compiled := &compiledValidation{message: validation.message}
+		path := fmt.Sprintf("spec.validations[%d].expression", i)
+		if compiled.compiledExpression, err = compileExpression(env, path, validation.expression, cel.BoolType, o); err != nil {
+			return nil, err
+		}
+		if validation.messageExpression != "" {
+			path := fmt.Sprintf("spec.validations[%d].messageExpression", i)
+			if compiled.messageExpression, err = compileExpression(env, path, validation.messageExpression, cel.StringType, o); err != nil {
+				return nil, err
+			}
+		}
+		policy.validations = append(policy.validations, compiled)
+	}
+	for i, auditAnnotation := range celInfo.auditAnnotations {
+		compiled := &compiledAuditAnnotation{key: auditAnnotation.key}
+		path := fmt.Sprintf("spec.auditAnnotations[%d].valueExpression", i)
+		if compiled.compiledExpression, err = compileExpression(env, path, auditAnnotation.expression, cel.StringType, o); err != nil {
+			return nil, err
+		}
+		policy.auditAnnotations = append(policy.auditAnnotations, compiled)
+	}
+	if o.lint {
+		policy.diagnostics = lintPolicy(policy)
+	}
+
+	policyCache.Add(key, policy)
+	return policy, nil
+}
+
+// compileWebhook returns the compiled webhook configuration, compiled configurations are cached by their source and
+// options.
+func compileWebhook(webhookInput []byte, o options) (*compiledPolicy, error) {
+	key := utils.CacheKey(webhookProfile, o.cacheKey(), string(webhookInput))
+	if policy, ok := policyCache.Get(key); ok {
+		return policy, nil
+	}
+
+	celInfo, err := extractCelInformation(webhookInput)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := newEnv(webhookVars, o)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &compiledPolicy{}
+	for i, webhookMatchConditions := range celInfo.webhookMatchConditions {
+		matchConditions, err := compileMatchConditions(env, fmt.Sprintf("webhooks[%d].matchConditions", i), webhookMatchConditions, o)
+		if err != nil {
+			return nil, err
+		}
+		policy.webhookMatchConditions = append(policy.webhookMatchConditions, matchConditions)
+	}
+	if o.lint {
+		policy.diagnostics = lintPolicy(policy)
+	}
+
+	policyCache.Add(key, policy)
+	return policy, nil
+}
+
+func newEnv(vars []cel.EnvOption, o options) (*cel.Env, error) {
+	envOptions := append(append(append([]cel.EnvOption{}, celEnvOptions...), authorizerEnvOptions...), vars...)
+	if o.trace || o.lint {
+		envOptions = append(envOptions, cel.EnableMacroCallTracking())
+	}
+	env, err := cel.NewEnv(envOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL env: %w", err)
+	}
+	return env, nil
+}
+
+// compileExpression type checks the expression found at path, which must evaluate to the expected type.
+// As in the apiserver, expressions of type dyn are accepted and their results are checked at evaluation time.
+func compileExpression(env *cel.Env, path, expression string, expectedType *cel.Type, o options) (*compiledExpression, error) {
+	ast, issues := env.Compile(expression)
+	if issues.Err() == nil {
+		issues = checkOutputType(ast, expectedType)
+	}
+	if issues.Err() != nil {
+		err := fmt.Errorf("failed to compile expression %s: %w", expression, issues.Err())
+		return nil, utils.NewDiagnosticsError(err, utils.IssuesDiagnostics(expression, path, issues))
+	}
+	prog, err := env.Program(ast, o.programOptions()...)
+	return &compiledExpression{expression: expression, path: path, ast: ast, prog: prog, err: err, traced: o.trace}, nil
+}
+
+func compileMatchConditions(env *cel.Env, path string, matchConditionInfos []CelMatchConditionsInfo, o options) ([]*compiledMatchCondition, error) {
+	matchConditions := []*compiledMatchCondition{}
+	for i, matchCondition := range matchConditionInfos {
+		compiled, err := compileExpression(env, fmt.Sprintf("%s[%d].expression", path, i), matchCondition.expression, cel.BoolType, o)
+		if err != nil {
+			return nil, err
+		}
+		matchConditions = append(matchConditions, &compiledMatchCondition{name: matchCondition.name, compiledExpression: compiled})
+	}
+	return matchConditions, nil
+}
+
+// checkOutputType reports the expression when its type is neither the expected type nor dyn.
+func checkOutputType(ast *cel.Ast, expectedType *cel.Type) *cel.Issues {
+	issues := cel.NewIssuesWithSourceInfo(common.NewErrors(ast.Source()), ast.SourceInfo())
+	if outputType := ast.OutputType(); !outputType.IsExactType(expectedType) && !outputType.IsExactType(cel.DynType) {
+		issues.ReportErrorAtID(ast.Expr().GetId(), "expression must evaluate to %s but evaluates to %s", expectedType, outputType)
+	}
+	return issues
+}
+
+// compileVariables type checks the composited variables in declaration order, each variable extends the environment
+// of the next ones with 'variables.<name>' of its output type. The returned environment declares all variables.
+// As in the apiserver composition environment, variables may only reference the variables declared before them.
+func compileVariables(env *cel.Env, variableInfos []CelVariableInfo, o options) ([]*compiledVariable, *cel.Env, error) {
+	positions := map[string]int{}
+	for i, variable := range variableInfos {
+		if _, ok := positions[variable.name]; ok {
+			err := fmt.Errorf("failed to initialize variables: variable %s is declared more than once", variable.name)
+			return nil, nil, utils.NewDiagnosticsError(err, []utils.Diagnostic{{
+				Severity: utils.SeverityError,
+				Message:  fmt.Sprintf("variable %s is declared more than once", variable.name),
+				Path:     fmt.Sprintf("spec.variables[%d].name", i),
+			}})
+		}
+		positions[variable.name] = i
+	}
+
+	variables := []*compiledVariable{}
+	for i, variable := range variableInfos {
+		path := fmt.Sprintf("spec.variables[%d].expression", i)
+		ast, issues := env.Parse(variable.expression)
+		if issues.Err() == nil {
+			issues = checkVariableReferences(ast, i, variableInfos, positions)
+		}
+		if issues.Err() == nil {
+			ast, issues = env.Check(ast)
+		}
+		if issues.Err() != nil {
+			err := fmt.Errorf("failed to initialize variables: failed to compile expression for variable %s: %w", variable.name, issues.Err())
+			return nil, nil, utils.NewDiagnosticsError(err, utils.IssuesDiagnostics(variable.expression, path, issues))
+		}
+		prog, err := env.Program(ast, o.programOptions()...)
+		variables = append(variables, &compiledVariable{
+			name:               variable.name,
+			compiledExpression: &compiledExpression{expression: variable.expression, path: path, ast: ast, prog: prog, err: err, traced: o.trace},
+		})
+		if env, err = env.Extend(cel.Variable("variables."+variable.name, ast.OutputType())); err != nil {
+			return nil, nil, fmt.Errorf("failed to initialize variables: could not append variable %s to CEL env: %w", variable.name, err)
+		}
+	}
+	return variables, env, nil
+}
+
+// checkVariableReferences reports the references of the variable at index to itself or to variables declared after it.
+func checkVariableReferences(ast *cel.Ast, index int, variableInfos []CelVariableInfo, positions map[string]int) *cel.Issues {
+	issues := cel.NewIssuesWithSourceInfo(common.NewErrors(ast.Source()), ast.SourceInfo())
+	utils.VisitExpr(ast.Expr(), func(expr *exprpb.Expr) bool {
+		path, ok := utils.SelectPath(expr)
+		if !ok {
+			return true
+		}
+		name, ok := strings.CutPrefix(path, "variables.")
+		if !ok {
+			return false
+		}
+		name, _, _ = strings.Cut(name, ".")
+		if position, ok := positions[name]; ok && position == index {
+			issues.ReportErrorAtID(expr.GetId(), "cyclic reference: variable %s references itself", name)
+		} else if ok && position > index {
+			issues.ReportErrorAtID(expr.GetId(), "forward reference: variable %s references variable %s which is declared after it", variableInfos[index].name, name)
+		}
+		return false
+	})
+	return issues
+}
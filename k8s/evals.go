@@ -15,6 +15,8 @@
 package k8s
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/google/cel-go/cel"
@@ -29,23 +31,27 @@ type evalResponseError struct {
 	cause error
 }
 
-func newEvalResponseErr(operation, expression string, err error) *evalResponse {
+// newEvalResponseErr returns the response of an expression which failed, path is the YAML path of its field.
+func newEvalResponseErr(operation, expression, path string, err error) *evalResponse {
 	switch celErr := err.(type) {
 	case *types.Err:
 		underlying := celErr.Unwrap()
 		switch evalErr := underlying.(type) {
 		case *evalResponseError:
 			return &evalResponse{
-				val: types.WrapErr(&evalResponseError{fmt.Errorf("unexpected error %s expression '%s', caused by nested exception: '%s'", operation, expression, evalErr.cause), evalErr.cause}),
+				val:  types.WrapErr(&evalResponseError{fmt.Errorf("unexpected error %s expression '%s', caused by nested exception: '%s'", operation, expression, evalErr.cause), evalErr.cause}),
+				path: path,
 			}
 		default:
 			return &evalResponse{
-				val: types.WrapErr(&evalResponseError{fmt.Errorf("unexpected error %s expression %s: %s", operation, expression, underlying), underlying}),
+				val:  types.WrapErr(&evalResponseError{fmt.Errorf("unexpected error %s expression %s: %s", operation, expression, underlying), underlying}),
+				path: path,
 			}
 		}
 	default:
 		return &evalResponse{
-			val: types.WrapErr(&evalResponseError{fmt.Errorf("unexpected error %s expression %s: %s", operation, expression, err), err}),
+			val:  types.WrapErr(&evalResponseError{fmt.Errorf("unexpected error %s expression %s: %s", operation, expression, err), err}),
+			path: path,
 		}
 	}
 }
@@ -56,71 +62,208 @@ type evalResponse struct {
 	details    *cel.EvalDetails
 	messageVal ref.Val
 	message    string
+	path       string
+	trace      []utils.TraceEntry
 }
 
 type evalResponses []*evalResponse
 
-func newEvalResponse(name string, exprEval ref.Val, details *cel.EvalDetails, message string, messageVal ref.Val) *evalResponse {
+func newEvalResponse(name string, exprEval ref.Val, details *cel.EvalDetails, message string, messageVal ref.Val, trace []utils.TraceEntry) *evalResponse {
 	return &evalResponse{
 		name:       name,
 		val:        exprEval,
 		details:    details,
 		messageVal: messageVal,
 		message:    message,
+		trace:      trace,
 	}
 }
 
+// lazyVariableEval evaluates a composited variable the first time it is referenced during an evaluation and
+// memoizes the result, as the apiserver does, so a variable is evaluated at most once per admission request.
 type lazyVariableEval struct {
-	name string
-	ast  *cel.Ast
-	val  *evalResponse
+	name       string
+	variable   *compiledVariable
+	val        *evalResponse
+	references int
 }
 
-func (lve *lazyVariableEval) eval(env *cel.Env, activation interpreter.Activation) ref.Val {
-	val := lve.evalExpression(env, activation)
-	lve.val = val
-	return val.val
+func (lve *lazyVariableEval) eval(e *evaluation, activation interpreter.Activation) ref.Val {
+	lve.references++
+	if lve.val == nil {
+		lve.val = lve.evalExpression(e, activation)
+	}
+	return lve.val.val
 }
 
-func (lve *lazyVariableEval) evalExpression(env *cel.Env, activation interpreter.Activation) *evalResponse {
-	prog, err := env.Program(lve.ast, celProgramOptions...)
+func (lve *lazyVariableEval) evalExpression(e *evaluation, activation interpreter.Activation) *evalResponse {
+	prog, err := lve.variable.program()
 	if err != nil {
-		return newEvalResponseErr("parsing", lve.name, err)
+		return newEvalResponseErr("parsing", lve.name, lve.variable.path, err)
 	}
-	val, details, err := prog.Eval(activation)
+	val, details, err := e.eval(prog, activation)
 	if err != nil {
-		return newEvalResponseErr("evaluating", lve.name, err)
+		return newEvalResponseErr("evaluating", lve.name, lve.variable.path, err)
 	}
-	return newEvalResponse(lve.name, val, details, "", nil)
+	return newEvalResponse(lve.name, val, details, "", nil, lve.variable.trace(details))
 }
 
 type lazyEvalMap map[string]*lazyVariableEval
 
+// evaluation is the evaluation of the expressions of a policy for an admission request, it stops when its context is
+// done. err is the error of the context when an expression was interrupted, and interruptedCost the cost incurred by the
+// interrupted expressions.
+type evaluation struct {
+	ctx             context.Context
+	err             error
+	interruptedCost uint64
+}
+
+func (e *evaluation) eval(prog cel.Program, activation interpreter.Activation) (ref.Val, *cel.EvalDetails, error) {
+	val, details, err := utils.ContextEval(e.ctx, prog, activation)
+	var interrupted *utils.InterruptedError
+	if errors.As(err, &interrupted) {
+		e.err = e.ctx.Err()
+		e.interruptedCost += interrupted.Cost
+	}
+	return val, details, err
+}
+
+// interrupted returns an InterruptedError with the cost of the response when an expression was interrupted.
+func (e *evaluation) interrupted(response *EvalResponse) error {
+	if e.err == nil {
+		return nil
+	}
+	return utils.NewInterruptedError(e.err, *response.Cost+e.interruptedCost)
+}
+
 type EvalVariable struct {
-	Name    string  `json:"name"`
-	Value   any     `json:"value,omitempty"`
-	Cost    *uint64 `json:"cost,omitempty"`
-	IsError bool    `json:"isError,omitempty"`
-	Error   *string `json:"error,omitempty"`
+	Name       string             `json:"name"`
+	Value      any                `json:"value,omitempty"`
+	Type       string             `json:"type,omitempty"`
+	Cost       *uint64            `json:"cost,omitempty"`
+	IsError    bool               `json:"isError,omitempty"`
+	Error      *string            `json:"error,omitempty"`
+	References int                `json:"references,omitempty"`
+	Trace      []utils.TraceEntry `json:"trace,omitempty"`
 }
 
 type EvalResult struct {
-	Name    *string `json:"name,omitempty"`
-	Result  any     `json:"result,omitempty"`
-	Cost    *uint64 `json:"cost,omitempty"`
-	Error   *string `json:"error,omitempty"`
-	IsError bool    `json:"isError,omitempty"`
-	Message any     `json:"message,omitempty"`
+	Name    *string            `json:"name,omitempty"`
+	Result  any                `json:"result,omitempty"`
+	Type    string             `json:"type,omitempty"`
+	Cost    *uint64            `json:"cost,omitempty"`
+	Error   *string            `json:"error,omitempty"`
+	IsError bool               `json:"isError,omitempty"`
+	Message any                `json:"message,omitempty"`
+	Trace   []utils.TraceEntry `json:"trace,omitempty"`
 }
 
 type EvalResponse struct {
-	MatchConditionsVariables []*EvalVariable `json:"matchConditionVariables,omitempty"`
-	MatchConditions          []*EvalResult   `json:"matchConditions,omitempty"`
-	ValidationVariables      []*EvalVariable `json:"validationVariables,omitempty"`
-	Validations              []*EvalResult   `json:"validations,omitempty"`
-	AuditAnnotations         []*EvalResult   `json:"auditAnnotations,omitempty"`
-	WebhookMatchConditions   [][]*EvalResult `json:"webhookMatchConditions,omitempty"`
-	Cost                     *uint64         `json:"cost,omitempty"`
+	MatchConditionsVariables []*EvalVariable    `json:"matchConditionVariables,omitempty"`
+	MatchConditions          []*EvalResult      `json:"matchConditions,omitempty"`
+	ValidationVariables      []*EvalVariable    `json:"validationVariables,omitempty"`
+	Validations              []*EvalResult      `json:"validations,omitempty"`
+	AuditAnnotations         []*EvalResult      `json:"auditAnnotations,omitempty"`
+	WebhookMatchConditions   [][]*EvalResult    `json:"webhookMatchConditions,omitempty"`
+	Cost                     *uint64            `json:"cost,omitempty"`
+	Diagnostics              []utils.Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// Matched returns whether the match conditions of the validating admission policy hold, i.e. the policy applies.
+func (r *EvalResponse) Matched() bool {
+	matched, _ := conditionsHold(r.MatchConditions)
+	return matched
+}
+
+// Allowed returns whether the validating admission policy admits the request: its match conditions do not hold, or
+// all its validations hold. Failures of expressions reject the request when failing closed, i.e. unless the failure
+// policy of the policy is Ignore.
+func (r *EvalResponse) Allowed(failClosed bool) bool {
+	matched, failed := conditionsHold(r.MatchConditions)
+	switch {
+	case failed:
+		return !failClosed
+	case !matched:
+		return true
+	}
+	for _, validation := range r.Validations {
+		if validation.IsError && failClosed || !validation.IsError && validation.Result != true {
+			return false
+		}
+	}
+	return true
+}
+
+// WebhooksMatched returns whether the match conditions of each webhook hold, i.e. whether the webhook is called.
+func (r *EvalResponse) WebhooksMatched() []bool {
+	webhooks := []bool{}
+	for _, matchConditions := range r.WebhookMatchConditions {
+		matched, _ := conditionsHold(matchConditions)
+		webhooks = append(webhooks, matched)
+	}
+	return webhooks
+}
+
+// PolicyRequest is the input of EvaluateValidatingAdmissionPolicy and EvaluateWebhook: the source of the policy or
+// webhook configuration, compiled policies being cached by source, and the inputs of the admission request, nil when
+// absent. Objects and params are unstructured, see utils.Decode for the typed values they may hold.
+// Trace, Lint and CostLimit are the options of the same names, see Option.
+type PolicyRequest struct {
+	Policy     []byte
+	Object     map[string]any
+	OldObject  map[string]any
+	Namespace  *NamespaceType
+	Request    *AdmissionRequest
+	Authorizer *Authorizer
+	Params     map[string]any
+	Trace      bool
+	Lint       bool
+	CostLimit  uint64
+}
+
+func (r *PolicyRequest) options() options {
+	return options{trace: r.Trace, lint: r.Lint, costLimit: r.CostLimit}
+}
+
+// typedInputs converts the namespace and the admission request to the values bound to the variables.
+func (r *PolicyRequest) typedInputs() (map[string]any, map[string]any, error) {
+	var namespace, request map[string]any
+	var err error
+	if r.Namespace != nil {
+		if namespace, err = convertToMap(r.Namespace); err != nil {
+			return nil, nil, fmt.Errorf("failed to convert the namespace: %w", err)
+		}
+	}
+	if r.Request != nil {
+		if request, err = convertToMap(r.Request); err != nil {
+			return nil, nil, fmt.Errorf("failed to convert the request: %w", err)
+		}
+	}
+	return namespace, request, nil
+}
+
+// authorizer returns a copy of the authorizer of the request, which denies everything when absent.
+func (r *PolicyRequest) authorizer() *Authorizer {
+	authorizer := &Authorizer{}
+	if r.Authorizer != nil {
+		*authorizer = *r.Authorizer
+	}
+	initReceiver(&authorizer.receiverOnlyObjectVal, AuthorizerType)
+	return authorizer
+}
+
+// conditionsHold returns whether all the match conditions hold, and whether some failed while none was false.
+func conditionsHold(matchConditions []*EvalResult) (bool, bool) {
+	failed := false
+	for _, matchCondition := range matchConditions {
+		if matchCondition.IsError {
+			failed = true
+		} else if matchCondition.Result != true {
+			return false, false
+		}
+	}
+	return !failed, failed
 }
 
 func getResults(val ref.Val) (any, *string) {
@@ -141,6 +284,14 @@ func getResults(val ref.Val) (any, *string) {
 	}
 }
 
+// getTypeName returns the CEL type name of a value which was converted without error.
+func getTypeName(val ref.Val, err *string) string {
+	if val == nil || err != nil {
+		return ""
+	}
+	return utils.TypeName(val)
+}
+
 func getCost(details *cel.EvalDetails) *uint64 {
 	if details == nil {
 		return nil
@@ -154,11 +305,14 @@ func generateEvalVariables(names []string, lazyEvals lazyEvalMap) []*EvalVariabl
 		if varLazyEval, ok := lazyEvals[name]; ok && varLazyEval.val != nil {
 			value, err := getResults(varLazyEval.val.val)
 			variables = append(variables, &EvalVariable{
-				Name:    varLazyEval.name,
-				Value:   value,
-				Cost:    getCost(varLazyEval.val.details),
-				Error:   err,
-				IsError: err != nil,
+				Name:       varLazyEval.name,
+				Value:      value,
+				Type:       getTypeName(varLazyEval.val.val, err),
+				Cost:       getCost(varLazyEval.val.details),
+				Error:      err,
+				IsError:    err != nil,
+				References: varLazyEval.references,
+				Trace:      varLazyEval.val.trace,
 			})
 		}
 	}
@@ -182,10 +336,12 @@ func generateEvalResults(responses evalResponses) []*EvalResult {
 		evals = append(evals, &EvalResult{
 			Name:    name,
 			Result:  value,
+			Type:    getTypeName(eval.val, err),
 			Cost:    getCost(eval.details),
 			Error:   err,
 			IsError: err != nil,
 			Message: message,
+			Trace:   eval.trace,
 		})
 	}
 	return evals
@@ -200,6 +356,34 @@ func generateEvalArrayResults(responses []evalResponses) [][]*EvalResult {
 	return evalsArray
 }
 
+// generateDiagnostics reports the failed expressions, each failure once even if the same variable failed both when
+// evaluating match conditions and validations.
+func generateDiagnostics(lazyEvals []lazyEvalMap, names [][]string, evals []evalResponses) []utils.Diagnostic {
+	responses := evalResponses{}
+	for i, lazyEval := range lazyEvals {
+		for _, name := range names[i] {
+			if varLazyEval, ok := lazyEval[name]; ok && varLazyEval.val != nil {
+				responses = append(responses, varLazyEval.val)
+			}
+		}
+	}
+	for _, eval := range evals {
+		responses = append(responses, eval...)
+	}
+
+	var diagnostics []utils.Diagnostic
+	reported := map[string]bool{}
+	for _, response := range responses {
+		if _, err := getResults(response.val); err != nil && response.path != "" {
+			if key := response.path + "\x00" + *err; !reported[key] {
+				reported[key] = true
+				diagnostics = append(diagnostics, utils.Diagnostic{Severity: utils.SeverityError, Message: *err, Path: response.path})
+			}
+		}
+	}
+	return diagnostics
+}
+
 func calculateLazyEvalCost(lazyEvals lazyEvalMap) uint64 {
 	var cost uint64
 	for _, lazyEval := range lazyEvals {
@@ -239,6 +423,9 @@ func generateEvalResponse(matchConditionsVariableNames []string, matchConditions
 	cost += calculateEvalResponsesCost(auditAnnotationEvals)
 	cost += calculateEvalResponsesArrayCost(webhookMatchConditionsEvals)
 
+	evals := []evalResponses{matchConditionsEvals, validationEvals, auditAnnotationEvals}
+	evals = append(evals, webhookMatchConditionsEvals...)
+
 	return &EvalResponse{
 		MatchConditionsVariables: generateEvalVariables(matchConditionsVariableNames, matchConditionsVariableLazyEvals),
 		MatchConditions:          generateEvalResults(matchConditionsEvals),
@@ -247,5 +434,7 @@ func generateEvalResponse(matchConditionsVariableNames []string, matchConditions
 		AuditAnnotations:         generateEvalResults(auditAnnotationEvals),
 		WebhookMatchConditions:   generateEvalArrayResults(webhookMatchConditionsEvals),
 		Cost:                     &cost,
+		Diagnostics: generateDiagnostics([]lazyEvalMap{matchConditionsVariableLazyEvals, validationVariableLazyEvals},
+			[][]string{matchConditionsVariableNames, validationVariableNames}, evals),
 	}
 }
@@ -0,0 +1,62 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"strings"
+
+	"github.com/undistro/cel-playground/utils"
+)
+
+// lintPolicy returns the lint findings of every expression of the compiled policy, in declaration order, and of the
+// static messages of its validations.
+func lintPolicy(policy *compiledPolicy) []utils.Diagnostic {
+	var expressions []*compiledExpression
+	for _, variable := range policy.variables {
+		expressions = append(expressions, variable.compiledExpression)
+	}
+	for _, matchCondition := range policy.matchConditions {
+		expressions = append(expressions, matchCondition.compiledExpression)
+	}
+	for _, validation := range policy.validations {
+		expressions = append(expressions, validation.compiledExpression)
+		if validation.messageExpression != nil {
+			expressions = append(expressions, validation.messageExpression)
+		}
+	}
+	for _, auditAnnotation := range policy.auditAnnotations {
+		expressions = append(expressions, auditAnnotation.compiledExpression)
+	}
+	for _, matchConditions := range policy.webhookMatchConditions {
+		for _, matchCondition := range matchConditions {
+			expressions = append(expressions, matchCondition.compiledExpression)
+		}
+	}
+
+	var diagnostics []utils.Diagnostic
+	for _, expression := range expressions {
+		diagnostics = append(diagnostics, utils.Lint(expression.ast, expression.path)...)
+	}
+	for _, validation := range policy.validations {
+		if validation.message == "" || validation.messageExpression != nil {
+			continue
+		}
+		path := strings.TrimSuffix(validation.path, ".expression") + ".message"
+		if diagnostic := utils.LintMessage(validation.message, path); diagnostic != nil {
+			diagnostics = append(diagnostics, *diagnostic)
+		}
+	}
+	return diagnostics
+}
@@ -101,14 +101,13 @@ type NamespaceType struct {
 	Status   NamespaceStatusType   `yaml:"status"`
 }
 
-func deserializeNamespace(namespaceData []byte) (map[string]any, error) {
+func deserializeNamespace(namespaceData []byte) (*NamespaceType, error) {
 	if namespaceData == nil {
 		return nil, nil
 	}
-	namespace := NamespaceType{}
-	if err := yaml.Unmarshal(namespaceData, &namespace); err != nil {
+	namespace := &NamespaceType{}
+	if err := yaml.Unmarshal(namespaceData, namespace); err != nil {
 		return nil, err
-	} else {
-		return convertToMap(&namespace)
 	}
+	return namespace, nil
 }
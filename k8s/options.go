@@ -0,0 +1,106 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/google/cel-go/cel"
+	"github.com/undistro/cel-playground/utils"
+)
+
+// Option configures how policies are compiled and evaluated.
+type Option func(*options)
+
+type options struct {
+	trace     bool
+	lint      bool
+	params    []byte
+	costLimit uint64
+	ctx       context.Context
+}
+
+func newOptions(opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithTrace records the value of every subexpression in the trace of each result.
+// Tracing evaluates all the branches of logical operators and conditionals, so the reported cost may be higher than
+// the one of a regular evaluation.
+func WithTrace() Option {
+	return func(o *options) {
+		o.trace = true
+	}
+}
+
+// WithLint reports the findings of the lint rules for every expression of the policy in the diagnostics of the
+// response, see utils.Lint.
+func WithLint() Option {
+	return func(o *options) {
+		o.lint = true
+	}
+}
+
+// WithParams binds 'params' to the parameter resource, given as YAML or JSON, as the policy binding would.
+// Parameters only affect the evaluation, policies are compiled the same way with or without them.
+func WithParams(paramsInput []byte) Option {
+	return func(o *options) {
+		o.params = paramsInput
+	}
+}
+
+// WithCostLimit aborts the evaluation of each expression whose runtime cost exceeds the limit, the expression then
+// fails as it would when the apiserver exceeds the per-expression cost limit.
+func WithCostLimit(limit uint64) Option {
+	return func(o *options) {
+		o.costLimit = limit
+	}
+}
+
+// WithContext evaluates the policy with the context, the evaluation then stops with a utils.InterruptedError when it is
+// done. It does not affect how policies are compiled.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+func (o options) context() context.Context {
+	if o.ctx == nil {
+		return context.Background()
+	}
+	return o.ctx
+}
+
+func (o options) programOptions() []cel.ProgramOption {
+	programOptions := celProgramOptions
+	if o.trace {
+		programOptions = append(append([]cel.ProgramOption{}, programOptions...), traceProgramOptions...)
+	}
+	if o.costLimit > 0 {
+		programOptions = append(append([]cel.ProgramOption{}, programOptions...), cel.CostLimit(o.costLimit))
+	}
+	return programOptions
+}
+
+// cacheKey identifies the options affecting compiled policies in cache keys.
+func (o options) cacheKey() string {
+	return utils.CacheKey(strconv.FormatBool(o.trace), strconv.FormatBool(o.lint), strconv.FormatUint(o.costLimit, 10))
+}
@@ -89,14 +89,13 @@ type AdmissionRequest struct {
 	// Options            any      `yaml:"options,omitempty"`
 }
 
-func deserializeRequest(requestData []byte) (map[string]any, error) {
+func deserializeRequest(requestData []byte) (*AdmissionRequest, error) {
 	if requestData == nil {
 		return nil, nil
 	}
-	admissionRequest := AdmissionRequest{}
-	if err := yaml.Unmarshal(requestData, &admissionRequest); err != nil {
+	admissionRequest := &AdmissionRequest{}
+	if err := yaml.Unmarshal(requestData, admissionRequest); err != nil {
 		return nil, err
-	} else {
-		return convertToMap(&admissionRequest)
 	}
+	return admissionRequest, nil
 }
@@ -0,0 +1,313 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TestSuite is a policy, a validating admission policy or a webhook configuration, with the cases it is tested
+// against, e.g.
+//
+//	policy:
+//	  apiVersion: admissionregistration.k8s.io/v1
+//	  kind: ValidatingAdmissionPolicy
+//	  ...
+//	cases:
+//	  - name: too many replicas
+//	    object: {spec: {replicas: 10}}
+//	    expect:
+//	      allowed: false
+//	      messages: ["replicas must be at most 5"]
+//
+// The policy is either embedded or given as a string holding the document.
+type TestSuite struct {
+	Policy yaml.Node  `yaml:"policy"`
+	Cases  []TestCase `yaml:"cases"`
+}
+
+// TestCase holds the inputs of an evaluation of the policy and the outcome it is expected to have, inputs left out
+// are not bound. Namespace and params only apply to validating admission policies.
+type TestCase struct {
+	Name       string      `yaml:"name"`
+	Object     yaml.Node   `yaml:"object"`
+	OldObject  yaml.Node   `yaml:"oldObject"`
+	Request    yaml.Node   `yaml:"request"`
+	Namespace  yaml.Node   `yaml:"namespace"`
+	Params     yaml.Node   `yaml:"params"`
+	Authorizer yaml.Node   `yaml:"authorizer"`
+	Expect     Expectation `yaml:"expect"`
+}
+
+// Expectation is the expected outcome of a test case, only the outcomes which are set are compared.
+//   - Allowed is whether a validating admission policy admits the request: its match conditions do not hold, or all its
+//     validations hold. Failures reject the request unless the failure policy is Ignore.
+//   - Matched is whether the match conditions of a validating admission policy hold.
+//   - Webhooks is whether the match conditions of each webhook hold, i.e. whether the webhook would be called.
+//   - Messages are the messages of the failed validations, in order.
+//   - AuditAnnotations are the values of the audit annotations, by key.
+//   - Variables are the values of the composited variables which were evaluated, by name.
+type Expectation struct {
+	Allowed          *bool             `yaml:"allowed"`
+	Matched          *bool             `yaml:"matched"`
+	Webhooks         []bool            `yaml:"webhooks"`
+	Messages         []string          `yaml:"messages"`
+	AuditAnnotations map[string]string `yaml:"auditAnnotations"`
+	Variables        map[string]any    `yaml:"variables"`
+}
+
+// TestSuiteResult is the outcome of every case of a test suite.
+type TestSuiteResult struct {
+	Passed int               `json:"passed"`
+	Failed int               `json:"failed"`
+	Cases  []*TestCaseResult `json:"cases"`
+}
+
+// TestCaseResult is the outcome of a test case, Diffs describe each expectation which was not met, and Error the
+// failure to evaluate the case.
+type TestCaseResult struct {
+	Name   string   `json:"name"`
+	Passed bool     `json:"passed"`
+	Diffs  []string `json:"diffs,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// EvalTestSuite runs the test suite, given as YAML or JSON, and returns the JSON encoded TestSuiteResult.
+func EvalTestSuite(suiteInput []byte, opts ...Option) (string, error) {
+	result, err := RunTestSuite(suiteInput, opts...)
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal the output: %w", err)
+	}
+	return string(out), nil
+}
+
+// RunTestSuite evaluates the policy of the test suite for each case with EvaluateValidatingAdmissionPolicy or EvaluateWebhook,
+// depending on its kind, and compares the outcomes with the expected ones.
+// Errors are only returned when the suite or its policy are invalid, failures of the cases are reported in the result.
+func RunTestSuite(suiteInput []byte, opts ...Option) (*TestSuiteResult, error) {
+	var suite TestSuite
+	if err := yaml.Unmarshal(suiteInput, &suite); err != nil {
+		return nil, fmt.Errorf("failed to decode the test suite: %w", err)
+	}
+	policyInput, err := nodeInput(&suite.Policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the policy: %w", err)
+	}
+	if len(policyInput) == 0 {
+		return nil, fmt.Errorf("failed to decode the policy: the test suite has no policy")
+	}
+	var policy struct {
+		Kind string `yaml:"kind"`
+	}
+	if err := yaml.Unmarshal(policyInput, &policy); err != nil {
+		return nil, fmt.Errorf("failed to decode the policy: %w", err)
+	}
+	failClosed := FailsClosed(policyInput)
+
+	result := &TestSuiteResult{Cases: []*TestCaseResult{}}
+	for i, testCase := range suite.Cases {
+		caseResult := &TestCaseResult{Name: testCase.Name}
+		if caseResult.Name == "" {
+			caseResult.Name = fmt.Sprintf("case %d", i+1)
+		}
+		response, err := evalTestCase(policy.Kind, policyInput, &testCase, opts)
+		if err != nil {
+			caseResult.Error = err.Error()
+		} else {
+			caseResult.Diffs = testCase.Expect.diff(response, failClosed)
+		}
+		caseResult.Passed = caseResult.Error == "" && len(caseResult.Diffs) == 0
+		if caseResult.Passed {
+			result.Passed++
+		} else {
+			result.Failed++
+		}
+		result.Cases = append(result.Cases, caseResult)
+	}
+	return result, nil
+}
+
+// FailsClosed returns whether failures of the expressions of the validating admission policy reject requests, i.e.
+// its failure policy is not Ignore.
+func FailsClosed(policyInput []byte) bool {
+	var policy struct {
+		Spec struct {
+			FailurePolicy string `yaml:"failurePolicy"`
+		} `yaml:"spec"`
+	}
+	return yaml.Unmarshal(policyInput, &policy) != nil || policy.Spec.FailurePolicy != "Ignore"
+}
+
+func evalTestCase(kind string, policyInput []byte, testCase *TestCase, opts []Option) (*EvalResponse, error) {
+	var inputs [6][]byte
+	for i, node := range []*yaml.Node{&testCase.Object, &testCase.OldObject, &testCase.Request, &testCase.Namespace,
+		&testCase.Params, &testCase.Authorizer} {
+		input, err := nodeInput(node)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the inputs: %w", err)
+		}
+		inputs[i] = input
+	}
+	object, oldObject, request, namespace, params, authorizer := inputs[0], inputs[1], inputs[2], inputs[3], inputs[4], inputs[5]
+
+	o := newOptions(opts)
+	if kind == "ValidatingAdmissionPolicy" {
+		if len(params) > 0 {
+			o.params = params
+		}
+		policyRequest, err := decodeValidatingAdmissionPolicyRequest(policyInput, oldObject, object, namespace, request, authorizer, o)
+		if err != nil {
+			return nil, err
+		}
+		return EvaluateValidatingAdmissionPolicy(o.context(), policyRequest)
+	}
+	policyRequest, err := decodeWebhookRequest(policyInput, oldObject, object, request, authorizer, o)
+	if err != nil {
+		return nil, err
+	}
+	return EvaluateWebhook(o.context(), policyRequest)
+}
+
+// nodeInput returns the document held by the node, either the node itself or the string it holds, or nil when the
+// node is not set.
+func nodeInput(node *yaml.Node) ([]byte, error) {
+	switch {
+	case node.Kind == 0 || node.ShortTag() == "!!null":
+		return nil, nil
+	case node.Kind == yaml.ScalarNode && node.ShortTag() == "!!str":
+		return []byte(node.Value), nil
+	default:
+		return yaml.Marshal(node)
+	}
+}
+
+// diff describes each expectation the response does not meet.
+func (e *Expectation) diff(response *EvalResponse, failClosed bool) []string {
+	var diffs []string
+	compare := func(name string, expected, actual any) {
+		if !jsonEqual(expected, actual) {
+			expectedJSON, _ := json.Marshal(expected)
+			actualJSON, _ := json.Marshal(actual)
+			diffs = append(diffs, fmt.Sprintf("%s: expected %s, got %s", name, expectedJSON, actualJSON))
+		}
+	}
+
+	if e.Matched != nil {
+		compare("matched", *e.Matched, response.Matched())
+	}
+	if e.Allowed != nil {
+		compare("allowed", *e.Allowed, response.Allowed(failClosed))
+	}
+	if e.Webhooks != nil {
+		compare("webhooks", e.Webhooks, response.WebhooksMatched())
+	}
+	if e.Messages != nil {
+		messages := []string{}
+		for _, validation := range response.Validations {
+			if validation.IsError {
+				messages = append(messages, *validation.Error)
+			} else if validation.Result != true {
+				message, _ := validation.Message.(string)
+				messages = append(messages, message)
+			}
+		}
+		compare("messages", e.Messages, messages)
+	}
+	if e.AuditAnnotations != nil {
+		annotations := map[string]any{}
+		for _, annotation := range response.AuditAnnotations {
+			if annotation.Name == nil {
+				continue
+			}
+			if annotation.IsError {
+				annotations[*annotation.Name] = *annotation.Error
+			} else {
+				annotations[*annotation.Name] = annotation.Message
+			}
+		}
+		compare("auditAnnotations", e.AuditAnnotations, annotations)
+	}
+	if e.Variables != nil {
+		variables := map[string]any{}
+		for _, variable := range append(response.MatchConditionsVariables, response.ValidationVariables...) {
+			if variable.IsError {
+				variables[variable.Name] = *variable.Error
+			} else {
+				variables[variable.Name] = variable.Value
+			}
+		}
+		names := make([]string, 0, len(e.Variables))
+		for name := range e.Variables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			compare("variables."+name, e.Variables[name], variables[name])
+		}
+	}
+	return diffs
+}
+
+// jsonEqual compares the values as JSON, so that the values decoded from YAML compare equal to the ones of responses.
+// Integers compare equal to their decimal strings, as responses encode ints and uints.
+func jsonEqual(a, b any) bool {
+	var decoded [2]any
+	for i, value := range []any{a, b} {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return false
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&decoded[i]); err != nil {
+			return false
+		}
+		decoded[i] = integersAsStrings(decoded[i])
+	}
+	return reflect.DeepEqual(decoded[0], decoded[1])
+}
+
+// integersAsStrings replaces the integers of a decoded JSON value with their decimal strings, and other numbers with
+// doubles.
+func integersAsStrings(value any) any {
+	switch value := value.(type) {
+	case json.Number:
+		if !strings.ContainsAny(value.String(), ".eE") {
+			return value.String()
+		}
+		f, _ := value.Float64()
+		return f
+	case []any:
+		for i, item := range value {
+			value[i] = integersAsStrings(item)
+		}
+	case map[string]any:
+		for key, item := range value {
+			value[key] = integersAsStrings(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/undistro/cel-playground/k8s"
+)
+
+func TestTestSuites(t *testing.T) {
+	entries, err := testdata.ReadDir(testfile("suite"))
+	if err != nil {
+		t.Fatalf("failed to read test data: %v", err)
+	}
+	for _, entry := range entries {
+		t.Run(entry.Name(), func(t *testing.T) {
+			suite, err := testdata.ReadFile(testfile("suite/" + entry.Name()))
+			if err != nil {
+				t.Fatalf("failed to read test data: %v", err)
+			}
+			result, err := k8s.RunTestSuite(suite)
+			if err != nil {
+				t.Fatalf("RunTestSuite() error = %v", err)
+			}
+			if result.Failed > 0 || result.Passed == 0 {
+				for _, testCase := range result.Cases {
+					if !testCase.Passed {
+						t.Errorf("%s: %v %s", testCase.Name, testCase.Diffs, testCase.Error)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTestSuiteFailures(t *testing.T) {
+	suite := `
+policy:
+  apiVersion: admissionregistration.k8s.io/v1
+  kind: ValidatingAdmissionPolicy
+  metadata:
+    name: "replicas-limit"
+  spec:
+    validations:
+      - expression: "object.spec.replicas <= 5"
+        message: "too many replicas"
+      - expression: "object.spec.paused"
+cases:
+  - object: {spec: {replicas: 10, paused: true}}
+    expect:
+      allowed: true
+      messages: ["too many"]
+  - name: failed validation
+    object: {spec: {replicas: 1}}
+    expect:
+      allowed: false
+      messages: ["too many replicas"]
+  - name: invalid input
+    object: "spec: ["
+`
+	result, err := k8s.RunTestSuite([]byte(suite))
+	if err != nil {
+		t.Fatalf("RunTestSuite() error = %v", err)
+	}
+	expected := []*k8s.TestCaseResult{{
+		Name:  "case 1",
+		Diffs: []string{`allowed: expected true, got false`, `messages: expected ["too many"], got ["too many replicas"]`},
+	}, {
+		Name:  "failed validation",
+		Diffs: []string{`messages: expected ["too many replicas"], got ["unexpected error evaluating expression object.spec.paused: no such key: paused"]`},
+	}, {
+		Name:  "invalid input",
+		Error: "failed to decode input for the new resource value: yaml: line 1: did not find expected node content",
+	}}
+	if !reflect.DeepEqual(expected, result.Cases) || result.Failed != 3 || result.Passed != 0 {
+		t.Errorf("Expected %v\n, received %v", expected, result.Cases)
+	}
+
+	if _, err := k8s.RunTestSuite([]byte("cases: []")); err == nil {
+		t.Errorf("Expected a suite without policy to fail")
+	}
+}
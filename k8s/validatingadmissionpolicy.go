@@ -15,14 +15,13 @@
 package k8s
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"reflect"
 
-	"github.com/google/cel-go/cel"
-	"github.com/google/cel-go/common/types/ref"
 	"github.com/google/cel-go/interpreter"
-	"gopkg.in/yaml.v3"
+	"github.com/undistro/cel-playground/utils"
 )
 
 const (
@@ -81,77 +80,106 @@ var stringType = reflect.TypeOf("")
 //     are overwritten by values in `Y` when the key sets of `X` and `Y` intersect. Elements in `Y` with
 //     non-intersecting keys are appended, retaining their partial order.
 //
-// TODO: Support parameters
-func EvalValidatingAdmissionPolicy(policyInput, oldObjectInput, objectValueInput, namespaceInput, requestInput, authorizerInput []byte) (string, error) {
-	celInfo, err := extractCelInformation(policyInput)
+// Parameters are given with WithParams.
+func EvalValidatingAdmissionPolicy(policyInput, oldObjectInput, objectValueInput, namespaceInput, requestInput, authorizerInput []byte, opts ...Option) (string, error) {
+	o := newOptions(opts)
+	request, err := decodeValidatingAdmissionPolicyRequest(policyInput, oldObjectInput, objectValueInput, namespaceInput, requestInput, authorizerInput, o)
 	if err != nil {
 		return "", err
 	}
-
-	var oldObjectValue map[string]any
-	if err := yaml.Unmarshal(oldObjectInput, &oldObjectValue); err != nil {
-		return "", fmt.Errorf("failed to decode input for the old resource value: %w", err)
-	}
-
-	var objectValue map[string]any
-	if err := yaml.Unmarshal(objectValueInput, &objectValue); err != nil {
-		return "", fmt.Errorf("failed to decode input for the new resource value: %w", err)
-	}
-
-	namespaceObject, err := deserializeNamespace(namespaceInput)
+	response, err := EvaluateValidatingAdmissionPolicy(o.context(), request)
 	if err != nil {
 		return "", err
 	}
-
-	request, err := deserializeRequest(requestInput)
+	out, err := json.Marshal(response)
 	if err != nil {
 		return "", err
 	}
+	return string(out), nil
+}
 
-	var authorizer Authorizer
-	if err := yaml.Unmarshal(authorizerInput, &authorizer); err != nil {
-		return "", fmt.Errorf("failed to decode input for the authorizer: %w", err)
+func decodeValidatingAdmissionPolicyRequest(policyInput, oldObjectInput, objectValueInput, namespaceInput, requestInput, authorizerInput []byte, o options) (*PolicyRequest, error) {
+	request := &PolicyRequest{Policy: policyInput, Trace: o.trace, Lint: o.lint, CostLimit: o.costLimit}
+	var err error
+	if request.OldObject, err = utils.Decode(oldObjectInput); err != nil {
+		return nil, fmt.Errorf("failed to decode input for the old resource value: %w", err)
+	}
+	if request.Object, err = utils.Decode(objectValueInput); err != nil {
+		return nil, fmt.Errorf("failed to decode input for the new resource value: %w", err)
+	}
+	if request.Params, err = utils.Decode(o.params); err != nil {
+		return nil, fmt.Errorf("failed to decode input for the params: %w", err)
+	}
+	if request.Namespace, err = deserializeNamespace(namespaceInput); err != nil {
+		return nil, err
 	}
-	initReceiver(&authorizer.receiverOnlyObjectVal, AuthorizerType)
+	if request.Request, err = deserializeRequest(requestInput); err != nil {
+		return nil, err
+	}
+	if request.Authorizer, err = deserializeAuthorizer(authorizerInput); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
 
-	authorizerRequestResource, err := getAuthorizerRequestResource(&authorizer, request)
+// EvaluateValidatingAdmissionPolicy evaluates the validating admission policy of the request against its decoded
+// inputs, see EvalValidatingAdmissionPolicy. The evaluation stops with a utils.InterruptedError, carrying the cost
+// incurred until then, when the context is done.
+func EvaluateValidatingAdmissionPolicy(ctx context.Context, r *PolicyRequest) (*EvalResponse, error) {
+	o := r.options()
+	objectValue, oldObjectValue, params := r.Object, r.OldObject, r.Params
+	namespaceObject, request, err := r.typedInputs()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	authorizer := r.authorizer()
+	authorizerRequestResource, err := getAuthorizerRequestResource(authorizer, request)
+	if err != nil {
+		return nil, err
 	}
 
-	validationCelVars := []cel.EnvOption{}
 	validationInputData := map[string]any{}
-	matchConditionsCelVars := []cel.EnvOption{}
 	matchConditionsInputData := map[string]any{}
 
 	if objectValue != nil {
 		cleanMetaData(objectValue)
-		validationCelVars = updateVars("object", validationCelVars, validationInputData, objectValue)
-		matchConditionsCelVars = updateVars("object", matchConditionsCelVars, matchConditionsInputData, objectValue)
+		validationInputData["object"] = objectValue
+		matchConditionsInputData["object"] = objectValue
 	}
 
+	// as in the apiserver, oldObject is null for CREATE requests
+	validationInputData["oldObject"] = nil
+	matchConditionsInputData["oldObject"] = nil
 	if oldObjectValue != nil {
 		cleanMetaData(oldObjectValue)
-		validationCelVars = updateVars("oldObject", validationCelVars, validationInputData, oldObjectValue)
-		matchConditionsCelVars = updateVars("oldObject", matchConditionsCelVars, matchConditionsInputData, oldObjectValue)
+		validationInputData["oldObject"] = oldObjectValue
+		matchConditionsInputData["oldObject"] = oldObjectValue
 	}
 
 	if request != nil {
-		validationCelVars = updateVars("request", validationCelVars, validationInputData, request)
-		matchConditionsCelVars = updateVars("request", matchConditionsCelVars, matchConditionsInputData, request)
+		validationInputData["request"] = request
+		matchConditionsInputData["request"] = request
 	}
 
 	if namespaceObject != nil {
-		validationCelVars = updateVars("namespaceObject", validationCelVars, validationInputData, namespaceObject)
+		validationInputData["namespaceObject"] = namespaceObject
+	}
+
+	// as in the apiserver, params is null when there is no parameter resource
+	validationInputData["params"] = nil
+	matchConditionsInputData["params"] = nil
+	if params != nil {
+		validationInputData["params"] = params
+		matchConditionsInputData["params"] = params
 	}
 
 	if authorizerRequestResource != nil {
-		validationCelVars = updateVars("authorizer.requestResource", validationCelVars, validationInputData, authorizerRequestResource)
-		matchConditionsCelVars = updateVars("authorizer.requestResource", matchConditionsCelVars, matchConditionsInputData, authorizerRequestResource)
+		validationInputData["authorizer.requestResource"] = authorizerRequestResource
+		matchConditionsInputData["authorizer.requestResource"] = authorizerRequestResource
 	}
 
-	validationCelVars = updateVars("authorizer", validationCelVars, validationInputData, &authorizer)
-	matchConditionsCelVars = updateVars("authorizer", matchConditionsCelVars, matchConditionsInputData, &authorizer)
+	validationInputData["authorizer"] = authorizer
+	matchConditionsInputData["authorizer"] = authorizer
 
 	// The exact matching logic is (in order):
 	//   1. If ANY matchCondition evaluates to FALSE, the policy is skipped.
@@ -165,44 +193,35 @@ func EvalValidatingAdmissionPolicy(policyInput, oldObjectInput, objectValueInput
 	// 'authorizer' - A CEL Authorizer. May be used to perform authorization checks for the principal (user or service account) of the request.
 	// 'authorizer.requestResource' - A CEL ResourceCheck constructed from the 'authorizer' and configured with the request resource.
 
-	matchConditionsEnvOptions := append([]cel.EnvOption{}, celEnvOptions...)
-	matchConditionsEnvOptions = append(matchConditionsEnvOptions, matchConditionsCelVars...)
-	matchConditionsEnv, err := cel.NewEnv(matchConditionsEnvOptions...)
+	policy, err := compileValidatingAdmissionPolicy(r.Policy, o)
 	if err != nil {
-		return "", fmt.Errorf("failed to create CEL env: %w", err)
+		return nil, err
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, utils.NewInterruptedError(err, 0)
+	}
+	e := &evaluation{ctx: ctx}
 	matchConditionsExprActivations, err := interpreter.NewActivation(matchConditionsInputData)
 	if err != nil {
-		return "", fmt.Errorf("failed to create CEL activations: %w", err)
+		return nil, fmt.Errorf("failed to create CEL activations: %w", err)
 	}
 
 	matchConditionsVariableLazyEvals := lazyEvalMap{}
-	matchConditionsVariableNames := []string{}
-
-	if len(celInfo.variables) > 0 {
-		matchConditionsEnv, matchConditionsVariableNames, err = initVars(matchConditionsEnv, celInfo.variables /*matchConditionsCelVars,*/, matchConditionsVariableLazyEvals, matchConditionsExprActivations, matchConditionsInputData)
-		if err != nil {
-			return "", fmt.Errorf("failed to initialize variables: %w", err)
-		}
-	}
+	matchConditionsExprActivations, matchConditionsVariableNames := initVars(e, policy.variables, matchConditionsVariableLazyEvals, matchConditionsExprActivations)
 
 	matchConditions := true
 	matchConditionsEvals := []*evalResponse{}
 
-	for _, matchCondition := range celInfo.matchConditions {
-		ast, issues := matchConditionsEnv.Parse(matchCondition.expression)
-		if issues.Err() != nil {
-			return "", fmt.Errorf("failed to parse expression %s: %w", matchCondition.expression, issues.Err())
-		}
+	for _, matchCondition := range policy.matchConditions {
 		var val *evalResponse
-		if prog, err := matchConditionsEnv.Program(ast, celProgramOptions...); err != nil {
-			val = newEvalResponseErr("parsing", matchCondition.expression, err)
-		} else if exprEval, details, err := prog.Eval(matchConditionsExprActivations); err != nil {
-			val = newEvalResponseErr("evaluating", matchCondition.expression, err)
+		if prog, err := matchCondition.program(); err != nil {
+			val = newEvalResponseErr("parsing", matchCondition.expression, matchCondition.path, err)
+		} else if exprEval, details, err := e.eval(prog, matchConditionsExprActivations); err != nil {
+			val = newEvalResponseErr("evaluating", matchCondition.expression, matchCondition.path, err)
 		} else {
 			matchConditions = matchConditions && (exprEval.Value() == true)
-			val = newEvalResponse(matchCondition.name, exprEval, details, "", nil)
+			val = newEvalResponse(matchCondition.name, exprEval, details, "", nil, matchCondition.trace(details))
 		}
 		matchConditionsEvals = append(matchConditionsEvals, val)
 	}
@@ -214,73 +233,49 @@ func EvalValidatingAdmissionPolicy(policyInput, oldObjectInput, objectValueInput
 
 	// run validations only if matchConditions pass
 	if matchConditions {
-		validationEnvOptions := append([]cel.EnvOption{}, celEnvOptions...)
-		validationEnvOptions = append(validationEnvOptions, validationCelVars...)
-		validationEnv, err := cel.NewEnv(validationEnvOptions...)
-		if err != nil {
-			return "", fmt.Errorf("failed to create CEL env: %w", err)
-		}
-
 		validationExprActivations, err := interpreter.NewActivation(validationInputData)
 		if err != nil {
-			return "", fmt.Errorf("failed to create CEL activations: %w", err)
-		}
-		if len(celInfo.variables) > 0 {
-			validationEnv, validationVariableNames, err = initVars(validationEnv, celInfo.variables, validationVariableLazyEvals, validationExprActivations, validationInputData)
-			if err != nil {
-				return "", fmt.Errorf("failed to initialize variables: %w", err)
-			}
+			return nil, fmt.Errorf("failed to create CEL activations: %w", err)
 		}
+		validationExprActivations, validationVariableNames = initVars(e, policy.variables, validationVariableLazyEvals, validationExprActivations)
 
 		validationResult := true
-		for _, validation := range celInfo.validations {
-			ast, issues := validationEnv.Parse(validation.expression)
-			if issues.Err() != nil {
-				return "", fmt.Errorf("failed to parse expression %s: %w", validation.expression, issues.Err())
-			}
+		for _, validation := range policy.validations {
 			var val *evalResponse
-			if prog, err := validationEnv.Program(ast, celProgramOptions...); err != nil {
-				val = newEvalResponseErr("parsing", validation.expression, err)
-			} else if exprEval, details, err := prog.Eval(validationExprActivations); err != nil {
-				val = newEvalResponseErr("evaluating", validation.expression, err)
+			if prog, err := validation.program(); err != nil {
+				val = newEvalResponseErr("parsing", validation.expression, validation.path, err)
+			} else if exprEval, details, err := e.eval(prog, validationExprActivations); err != nil {
+				val = newEvalResponseErr("evaluating", validation.expression, validation.path, err)
 			} else if exprEval.Value() == true {
-				val = newEvalResponse("", exprEval, details, "", nil)
+				val = newEvalResponse("", exprEval, details, "", nil, validation.trace(details))
 			} else {
 				validationResult = false
 				if validation.message != "" {
-					val = newEvalResponse("", exprEval, details, validation.message, nil)
-				} else if validation.messageExpression != "" {
-					msgAst, issues := validationEnv.Parse(validation.messageExpression)
-					if issues.Err() != nil {
-						return "", fmt.Errorf("failed to parse expression %s: %w", validation.messageExpression, issues.Err())
-					}
-					if msgProg, err := validationEnv.Program(msgAst, celProgramOptions...); err != nil {
-						val = newEvalResponseErr("parsing", validation.messageExpression, err)
-					} else if msgExprEval, details, err := msgProg.Eval(validationExprActivations); err != nil {
-						val = newEvalResponseErr("evaluating", validation.messageExpression, err)
+					val = newEvalResponse("", exprEval, details, validation.message, nil, validation.trace(details))
+				} else if validation.messageExpression != nil {
+					if msgProg, err := validation.messageExpression.program(); err != nil {
+						val = newEvalResponseErr("parsing", validation.messageExpression.expression, validation.messageExpression.path, err)
+					} else if msgExprEval, msgDetails, err := e.eval(msgProg, validationExprActivations); err != nil {
+						val = newEvalResponseErr("evaluating", validation.messageExpression.expression, validation.messageExpression.path, err)
 					} else {
-						val = newEvalResponse("", exprEval, details, "", msgExprEval)
+						val = newEvalResponse("", exprEval, msgDetails, "", msgExprEval, validation.trace(details))
 					}
 				} else {
-					val = newEvalResponse("", exprEval, details, validation.message, nil)
+					val = newEvalResponse("", exprEval, details, validation.message, nil, validation.trace(details))
 				}
 			}
 			validationEvals = append(validationEvals, val)
 		}
 
 		if validationResult {
-			for _, auditAnnotation := range celInfo.auditAnnotations {
-				ast, issues := validationEnv.Parse(auditAnnotation.expression)
-				if issues.Err() != nil {
-					return "", fmt.Errorf("failed to parse expression %s: %w", auditAnnotation.expression, issues.Err())
-				}
+			for _, auditAnnotation := range policy.auditAnnotations {
 				var val *evalResponse
-				if prog, err := validationEnv.Program(ast, celProgramOptions...); err != nil {
-					val = newEvalResponseErr("parsing", auditAnnotation.expression, err)
-				} else if exprEval, details, err := prog.Eval(validationExprActivations); err != nil {
-					val = newEvalResponseErr("evaluating", auditAnnotation.expression, err)
+				if prog, err := auditAnnotation.program(); err != nil {
+					val = newEvalResponseErr("parsing", auditAnnotation.expression, auditAnnotation.path, err)
+				} else if exprEval, details, err := e.eval(prog, validationExprActivations); err != nil {
+					val = newEvalResponseErr("evaluating", auditAnnotation.expression, auditAnnotation.path, err)
 				} else {
-					val = newEvalResponse(auditAnnotation.key, nil, details, "", exprEval)
+					val = newEvalResponse(auditAnnotation.key, nil, details, "", exprEval, auditAnnotation.trace(details))
 				}
 				auditAnnotationEvals = append(auditAnnotationEvals, val)
 			}
@@ -290,18 +285,11 @@ func EvalValidatingAdmissionPolicy(policyInput, oldObjectInput, objectValueInput
 	response := generateEvalResponse(matchConditionsVariableNames, matchConditionsVariableLazyEvals, matchConditionsEvals,
 		validationVariableNames, validationVariableLazyEvals, validationEvals,
 		auditAnnotationEvals, nil)
-
-	out, err := json.Marshal(response)
-	if err != nil {
-		return "", err
+	response.Diagnostics = append(response.Diagnostics, policy.diagnostics...)
+	if err := e.interrupted(response); err != nil {
+		return nil, err
 	}
-	return string(out), nil
-}
-
-func updateVars(name string, celVars []cel.EnvOption, inputData map[string]any, value any) []cel.EnvOption {
-	celVars = append(celVars, cel.Variable(name, cel.DynType))
-	inputData[name] = value
-	return celVars
+	return response, nil
 }
 
 func cleanMetaData(obj map[string]any) {
@@ -319,27 +307,16 @@ func cleanMetaData(obj map[string]any) {
 	// }
 }
 
-func initVars(env *cel.Env, variableInfos []CelVariableInfo /*celVars []cel.EnvOption,*/, lazyEvals lazyEvalMap, activation interpreter.Activation, inputData map[string]any) (*cel.Env, []string, error) {
+// initVars registers a lazy evaluation for each composited variable and returns the activation resolving them,
+// each variable is evaluated at most once per activation.
+func initVars(e *evaluation, variables []*compiledVariable, lazyEvals lazyEvalMap, activation interpreter.Activation) (interpreter.Activation, []string) {
 	names := []string{}
-	for _, variable := range variableInfos {
-		ast, issues := env.Parse(variable.expression)
-		if issues.Err() != nil {
-			return nil, nil, fmt.Errorf("failed to parse expression for variable %s: %w", variable.name, issues.Err())
-		}
-		env, err := env.Extend(cel.Variable(variable.name, ast.OutputType()))
-		if err != nil {
-			return nil, nil, fmt.Errorf("could not append variable %s to CEL env: %w", variable.name, err)
-		}
-		variableLazyEval := lazyVariableEval{
-			name: variable.name,
-			ast:  ast,
-		}
+	for _, variable := range variables {
 		names = append(names, variable.name)
-		lazyEvals[variable.name] = &variableLazyEval
-		name := "variables." + variable.name
-		inputData[name] = func() ref.Val {
-			return variableLazyEval.eval(env, activation)
+		lazyEvals[variable.name] = &lazyVariableEval{
+			name:     variable.name,
+			variable: variable,
 		}
 	}
-	return env, names, nil
+	return &variablesActivation{parent: activation, lazyEvals: lazyEvals, evaluation: e}, names
 }
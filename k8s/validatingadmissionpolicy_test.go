@@ -15,11 +15,16 @@
 package k8s_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/undistro/cel-playground/k8s"
+	"github.com/undistro/cel-playground/utils"
 )
 
 func vapTestfile(file string) string {
@@ -63,7 +68,7 @@ func TestValidationEval(t *testing.T) {
 		orig:    "",
 		updated: "updated1.yaml",
 		expected: k8s.EvalResponse{
-			Validations: []*k8s.EvalResult{{Message: "All production deployments should be HA with at least three replicas", Result: false, Cost: uint64ptr(4)}},
+			Validations: []*k8s.EvalResult{{Message: "All production deployments should be HA with at least three replicas", Result: false, Type: "bool", Cost: uint64ptr(4)}},
 			Cost:        uint64ptr(4),
 		},
 	}, {
@@ -72,7 +77,7 @@ func TestValidationEval(t *testing.T) {
 		orig:    "",
 		updated: "updated2.yaml",
 		expected: k8s.EvalResponse{
-			Validations: []*k8s.EvalResult{{Result: true, Cost: uint64ptr(4)}},
+			Validations: []*k8s.EvalResult{{Result: true, Type: "bool", Cost: uint64ptr(4)}},
 			Cost:        uint64ptr(4),
 		},
 	}, {
@@ -82,11 +87,13 @@ func TestValidationEval(t *testing.T) {
 		updated: "variable1 updated.yaml",
 		expected: k8s.EvalResponse{
 			ValidationVariables: []*k8s.EvalVariable{{
-				Name:  "foo",
-				Value: "default",
-				Cost:  uint64ptr(6),
+				Name:       "foo",
+				References: 1,
+				Type:       "string",
+				Value:      "default",
+				Cost:       uint64ptr(6),
 			}},
-			Validations: []*k8s.EvalResult{{Result: false, Cost: uint64ptr(2)}},
+			Validations: []*k8s.EvalResult{{Result: false, Type: "bool", Cost: uint64ptr(2)}},
 			Cost:        uint64ptr(8),
 		},
 	}, {
@@ -96,20 +103,23 @@ func TestValidationEval(t *testing.T) {
 		updated: "variable2 updated.yaml",
 		expected: k8s.EvalResponse{
 			ValidationVariables: []*k8s.EvalVariable{{
-				Name:  "foo",
-				Value: "bar",
-				Cost:  uint64ptr(11),
+				Name:       "foo",
+				References: 2,
+				Type:       "string",
+				Value:      "bar",
+				Cost:       uint64ptr(11),
 			}},
 			Validations: []*k8s.EvalResult{{
 				Result: true,
+				Type:   "bool",
 				Cost:   uint64ptr(2),
 			}},
 			AuditAnnotations: []*k8s.EvalResult{{
 				Name:    strptr("foo-label"),
 				Message: "Label for foo is set to bar",
-				Cost:    uint64ptr(2),
+				Cost:    uint64ptr(4),
 			}},
-			Cost: uint64ptr(15),
+			Cost: uint64ptr(17),
 		},
 	}, {
 		name:    "test an expression with variables evaluating to a map, expression should succeed",
@@ -118,30 +128,40 @@ func TestValidationEval(t *testing.T) {
 		updated: "variable3 updated.yaml",
 		expected: k8s.EvalResponse{
 			ValidationVariables: []*k8s.EvalVariable{{
-				Name: "labels",
+				Name:       "labels",
+				References: 1,
+				Type:       "map",
 				Value: map[string]any{
 					"app": "kubernetes-bootcamp",
 					"foo": "bar",
 				},
 				Cost: uint64ptr(5),
 			}},
-			Validations: []*k8s.EvalResult{{Result: true, Cost: uint64ptr(2)}},
+			Validations: []*k8s.EvalResult{{Result: true, Type: "bool", Cost: uint64ptr(2)}},
 			Cost:        uint64ptr(7),
 		},
 	}, {
-		name:    "test an expression with variables evaluating to query parameters in a URL, expression should succeed",
+		name:    "test a variable whose conditional branches have no common type, expression should fail to compile",
 		policy:  "variable4 policy.yaml",
 		orig:    "",
 		updated: "variable4 updated.yaml",
+		wantErr: true,
+	}, {
+		name:    "test an expression with variables evaluating to query parameters in a URL, expression should succeed",
+		policy:  "variable5 policy.yaml",
+		orig:    "",
+		updated: "variable4 updated.yaml",
 		expected: k8s.EvalResponse{
 			ValidationVariables: []*k8s.EvalVariable{{
-				Name: "foo",
+				Name:       "foo",
+				References: 1,
+				Type:       "map",
 				Value: map[string]any{
 					"query": []any{"val"},
 				},
 				Cost: uint64ptr(14),
 			}},
-			Validations: []*k8s.EvalResult{{Result: true, Cost: uint64ptr(2)}},
+			Validations: []*k8s.EvalResult{{Result: true, Type: "bool", Cost: uint64ptr(2)}},
 			Cost:        uint64ptr(16),
 		},
 	}, {
@@ -154,19 +174,21 @@ func TestValidationEval(t *testing.T) {
 			MatchConditions: []*k8s.EvalResult{{
 				Name:   strptr("exclude-leases"),
 				Result: true,
+				Type:   "bool",
 				Cost:   uint64ptr(5),
 			}, {
 				Name:   strptr("exclude-kubelet-requests"),
 				Result: true,
+				Type:   "bool",
 				Cost:   uint64ptr(5),
 			}},
-			Validations: []*k8s.EvalResult{{Result: true, Cost: uint64ptr(5)}},
+			Validations: []*k8s.EvalResult{{Result: true, Type: "bool", Cost: uint64ptr(6)}},
 			AuditAnnotations: []*k8s.EvalResult{{
 				Name:    strptr("test-annotation"),
 				Message: "Name is kubernetes-bootcamp, namespace is default",
-				Cost:    uint64ptr(9),
+				Cost:    uint64ptr(19),
 			}},
-			Cost: uint64ptr(24),
+			Cost: uint64ptr(35),
 		},
 	}, {
 		name:    "test invalid matchConditions, should not see validations and auditAnnotations",
@@ -176,17 +198,21 @@ func TestValidationEval(t *testing.T) {
 		request: "match2 request.yaml",
 		expected: k8s.EvalResponse{
 			MatchConditionsVariables: []*k8s.EvalVariable{{
-				Name:  "isLease",
-				Value: false,
-				Cost:  uint64ptr(4),
+				Name:       "isLease",
+				References: 1,
+				Type:       "bool",
+				Value:      false,
+				Cost:       uint64ptr(4),
 			}},
 			MatchConditions: []*k8s.EvalResult{{
 				Name:   strptr("exclude-leases"),
 				Result: true,
+				Type:   "bool",
 				Cost:   uint64ptr(2),
 			}, {
 				Name:   strptr("exclude-kubelet-requests"),
 				Result: false,
+				Type:   "bool",
 				Cost:   uint64ptr(5),
 			}},
 			Cost: uint64ptr(11),
@@ -199,15 +225,21 @@ func TestValidationEval(t *testing.T) {
 		namespace: "namespace1 namespace.yaml",
 		expected: k8s.EvalResponse{
 			ValidationVariables: []*k8s.EvalVariable{{
-				Name:  "environment",
-				Value: "prod",
-				Cost:  uint64ptr(7),
+				Name:       "environment",
+				References: 1,
+				Type:       "string",
+				Value:      "prod",
+				Cost:       uint64ptr(7),
 			}, {
-				Name:  "exempt",
-				Value: false,
-				Cost:  uint64ptr(9),
+				Name:       "exempt",
+				References: 1,
+				Type:       "bool",
+				Value:      false,
+				Cost:       uint64ptr(9),
 			}, {
-				Name: "containers",
+				Name:       "containers",
+				References: 1,
+				Type:       "list",
 				Value: []any{
 					map[string]any{
 						"image":                    "prod.policy.example.com/google-samples/kubernetes-bootcamp:v1",
@@ -220,7 +252,9 @@ func TestValidationEval(t *testing.T) {
 				},
 				Cost: uint64ptr(5),
 			}, {
-				Name: "containersToCheck",
+				Name:       "containersToCheck",
+				References: 1,
+				Type:       "list",
 				Value: []any{
 					map[string]any{
 						"image":                    "prod.policy.example.com/google-samples/kubernetes-bootcamp:v1",
@@ -231,13 +265,14 @@ func TestValidationEval(t *testing.T) {
 						"terminationMessagePolicy": "File",
 					},
 				},
-				Cost: uint64ptr(18),
+				Cost: uint64ptr(31),
 			}},
 			Validations: []*k8s.EvalResult{{
 				Result: true,
-				Cost:   uint64ptr(11),
+				Type:   "bool",
+				Cost:   uint64ptr(17),
 			}},
-			Cost: uint64ptr(50),
+			Cost: uint64ptr(69),
 		},
 	}, {
 		name:    "test an expression using request attributes",
@@ -246,7 +281,7 @@ func TestValidationEval(t *testing.T) {
 		updated: "request1 updated.yaml",
 		request: "request1 request.yaml",
 		expected: k8s.EvalResponse{
-			Validations: []*k8s.EvalResult{{Result: true, Cost: uint64ptr(12)}},
+			Validations: []*k8s.EvalResult{{Result: true, Type: "bool", Cost: uint64ptr(12)}},
 			Cost:        uint64ptr(12),
 		},
 	}, {
@@ -258,24 +293,29 @@ func TestValidationEval(t *testing.T) {
 		authorizer: "authorizer1 authorizer.yaml",
 		expected: k8s.EvalResponse{
 			ValidationVariables: []*k8s.EvalVariable{{
-				Name:  "environment",
-				Value: "prod",
-				Cost:  uint64ptr(7),
+				Name:       "environment",
+				References: 1,
+				Type:       "string",
+				Value:      "prod",
+				Cost:       uint64ptr(7),
 			}, {
-				Name:  "isProd",
-				Value: true,
-				Cost:  uint64ptr(2),
+				Name:       "isProd",
+				References: 1,
+				Type:       "bool",
+				Value:      true,
+				Cost:       uint64ptr(2),
 			}},
 			Validations: []*k8s.EvalResult{{
 				Result: true,
+				Type:   "bool",
 				Cost:   uint64ptr(10),
 			}},
 			AuditAnnotations: []*k8s.EvalResult{{
 				Name:    strptr("test-annotation"),
 				Message: "Deployment is allowed in namespace default",
-				Cost:    uint64ptr(4),
+				Cost:    uint64ptr(8),
 			}},
-			Cost: uint64ptr(23),
+			Cost: uint64ptr(27),
 		},
 	}, {
 		name:       "test an expression using disallowed authorizer checks",
@@ -286,16 +326,21 @@ func TestValidationEval(t *testing.T) {
 		authorizer: "authorizer2 authorizer.yaml",
 		expected: k8s.EvalResponse{
 			ValidationVariables: []*k8s.EvalVariable{{
-				Name:  "environment",
-				Value: "prod",
-				Cost:  uint64ptr(7),
+				Name:       "environment",
+				References: 1,
+				Type:       "string",
+				Value:      "prod",
+				Cost:       uint64ptr(7),
 			}, {
-				Name:  "isProd",
-				Value: true,
-				Cost:  uint64ptr(2),
+				Name:       "isProd",
+				References: 1,
+				Type:       "bool",
+				Value:      true,
+				Cost:       uint64ptr(2),
 			}},
 			Validations: []*k8s.EvalResult{{
 				Result: false,
+				Type:   "bool",
 				Cost:   uint64ptr(10),
 			}},
 			Cost: uint64ptr(19),
@@ -307,13 +352,16 @@ func TestValidationEval(t *testing.T) {
 		updated: "broken1 updated.yaml",
 		expected: k8s.EvalResponse{
 			ValidationVariables: []*k8s.EvalVariable{{
-				Name:  "foo",
-				Value: "default",
-				Cost:  uint64ptr(6),
+				Name:       "foo",
+				References: 2,
+				Type:       "string",
+				Value:      "default",
+				Cost:       uint64ptr(6),
 			}, {
-				Name:    "containers",
-				IsError: true,
-				Error:   strptr("unexpected error evaluating expression containers: no such key: spc"),
+				Name:       "containers",
+				References: 1,
+				IsError:    true,
+				Error:      strptr("unexpected error evaluating expression containers: no such key: spc"),
 			}},
 			Validations: []*k8s.EvalResult{{
 				IsError: true,
@@ -322,19 +370,36 @@ func TestValidationEval(t *testing.T) {
 			AuditAnnotations: []*k8s.EvalResult{{
 				Name:    strptr("foo-label"),
 				Message: "Label for foo is set to default",
-				Cost:    uint64ptr(2),
+				Cost:    uint64ptr(5),
+			}},
+			Cost: uint64ptr(11),
+			Diagnostics: []utils.Diagnostic{{
+				Severity: utils.SeverityError,
+				Message:  "unexpected error evaluating expression containers: no such key: spc",
+				Path:     "spec.variables[1].expression",
+			}, {
+				Severity: utils.SeverityError,
+				Message:  "unexpected error evaluating expression 'variables.foo == 'default' && variables.containers.all(c, c.image.startsWith(\"test\"))', caused by nested exception: 'no such key: spc'",
+				Path:     "spec.validations[0].expression",
 			}},
-			Cost: uint64ptr(8),
 		},
 	}, {
-		name:    "test optional.none() dereference",
+		name:    "test a field selection on an optional value, expression should fail to compile",
 		policy:  "optional_none_dereference policy.yaml",
 		orig:    "",
 		updated: "optional_none_dereference updated.yaml",
+		wantErr: true,
+	}, {
+		name:    "test optional.none() dereference",
+		policy:  "optional_none_orvalue policy.yaml",
+		orig:    "",
+		updated: "optional_none_dereference updated.yaml",
 
 		expected: k8s.EvalResponse{
 			ValidationVariables: []*k8s.EvalVariable{{
-				Name: "containers",
+				Name:       "containers",
+				References: 2,
+				Type:       "list",
 				Value: []any{
 					map[string]any{
 						"image":                    "gcr.io/google-samples/kubernetes-bootcamp:v1",
@@ -347,11 +412,15 @@ func TestValidationEval(t *testing.T) {
 				},
 				Cost: uint64ptr(5),
 			}, {
-				Name:  "securityContexts",
-				Value: []any{nil},
-				Cost:  uint64ptr(15),
+				Name:       "securityContexts",
+				References: 4,
+				Type:       "list",
+				Value:      []any{nil},
+				Cost:       uint64ptr(15),
 			}, {
-				Name: "namedSecurityContexts",
+				Name:       "namedSecurityContexts",
+				References: 1,
+				Type:       "list",
 				Value: []any{
 					map[string]any{
 						"kubernetes-bootcamp": nil,
@@ -361,24 +430,99 @@ func TestValidationEval(t *testing.T) {
 			}},
 			Validations: []*k8s.EvalResult{{
 				Result:  false,
+				Type:    "bool",
 				Message: "all containers must set runAsNonRoot to true",
 				Cost:    uint64ptr(8),
 			}, {
 				Result:  false,
+				Type:    "bool",
 				Message: "all containers must set readOnlyRootFilesystem to true",
 				Cost:    uint64ptr(8),
 			}, {
 				Result: true,
+				Type:   "bool",
 				Cost:   uint64ptr(8),
 			}, {
 				Result: true,
+				Type:   "bool",
 				Cost:   uint64ptr(8),
 			}, {
 				Result: true,
-				Cost:   uint64ptr(8),
+				Type:   "bool",
+				Cost:   uint64ptr(10),
+			}},
+			Cost: uint64ptr(109),
+		},
+	}, {
+		name:    "test variables referencing earlier variables with their checked types",
+		policy:  "scoping1 policy.yaml",
+		orig:    "",
+		updated: "variable1 updated.yaml",
+		expected: k8s.EvalResponse{
+			ValidationVariables: []*k8s.EvalVariable{{
+				Name:       "replicas",
+				References: 1,
+				Type:       "int",
+				Value:      "1",
+				Cost:       uint64ptr(4),
+			}, {
+				Name:       "doubled",
+				References: 1,
+				Type:       "int",
+				Value:      "2",
+				Cost:       uint64ptr(2),
 			}},
-			Cost: uint64ptr(107),
+			Validations: []*k8s.EvalResult{{Result: true, Type: "bool", Cost: uint64ptr(2)}},
+			Cost:        uint64ptr(8),
 		},
+	}, {
+		name:    "test a variable referencing a variable declared after it",
+		policy:  "scoping2 policy.yaml",
+		orig:    "",
+		updated: "variable1 updated.yaml",
+		wantErr: true,
+	}, {
+		name:    "test a variable misusing the type of an earlier variable",
+		policy:  "scoping3 policy.yaml",
+		orig:    "",
+		updated: "variable1 updated.yaml",
+		wantErr: true,
+	}, {
+		name:    "test a variable referencing itself",
+		policy:  "scoping4 policy.yaml",
+		orig:    "",
+		updated: "variable1 updated.yaml",
+		wantErr: true,
+	}, {
+		name:    "test a validation which does not evaluate to a bool",
+		policy:  "typecheck1 policy.yaml",
+		orig:    "",
+		updated: "variable1 updated.yaml",
+		wantErr: true,
+	}, {
+		name:    "test a messageExpression which does not evaluate to a string",
+		policy:  "typecheck2 policy.yaml",
+		orig:    "",
+		updated: "variable1 updated.yaml",
+		wantErr: true,
+	}, {
+		name:    "test an audit annotation which does not evaluate to a string",
+		policy:  "typecheck3 policy.yaml",
+		orig:    "",
+		updated: "variable1 updated.yaml",
+		wantErr: true,
+	}, {
+		name:    "test an authorizer call with a wrong overload",
+		policy:  "typecheck4 policy.yaml",
+		orig:    "",
+		updated: "variable1 updated.yaml",
+		wantErr: true,
+	}, {
+		name:    "test a field selection on an optional value",
+		policy:  "typecheck5 policy.yaml",
+		orig:    "",
+		updated: "variable1 updated.yaml",
+		wantErr: true,
 	}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -409,3 +553,262 @@ func TestValidationEval(t *testing.T) {
 		})
 	}
 }
+
+func TestValidationDiagnostics(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		expected []utils.Diagnostic
+		// located are the spans of the diagnostics in the policy
+		located [2]utils.Position
+	}{{
+		name:   "test a validation which does not evaluate to a bool",
+		policy: "typecheck1 policy.yaml",
+		expected: []utils.Diagnostic{{
+			Severity: utils.SeverityError,
+			Message:  "expression must evaluate to bool but evaluates to string",
+			Path:     "spec.validations[0].expression",
+			Start:    &utils.Position{Line: 1, Column: 7},
+			End:      &utils.Position{Line: 1, Column: 8},
+		}},
+		located: [2]utils.Position{{Line: 14, Column: 26}, {Line: 14, Column: 27}},
+	}, {
+		name:   "test a variable referencing a variable declared after it",
+		policy: "scoping2 policy.yaml",
+		expected: []utils.Diagnostic{{
+			Severity: utils.SeverityError,
+			Message:  "forward reference: variable doubled references variable replicas which is declared after it",
+			Path:     "spec.variables[0].expression",
+			Start:    &utils.Position{Line: 1, Column: 10},
+			End:      &utils.Position{Line: 1, Column: 19},
+		}},
+		located: [2]utils.Position{{Line: 15, Column: 29}, {Line: 15, Column: 38}},
+	}, {
+		name:   "test an authorizer call with a wrong overload",
+		policy: "typecheck4 policy.yaml",
+		expected: []utils.Diagnostic{{
+			Severity: utils.SeverityError,
+			Message:  "found no matching overload for 'group' applied to 'playground.k8s.Authorizer.(int)'",
+			Path:     "spec.validations[0].expression",
+			Start:    &utils.Position{Line: 1, Column: 17},
+			End:      &utils.Position{Line: 1, Column: 18},
+		}},
+		located: [2]utils.Position{{Line: 14, Column: 36}, {Line: 14, Column: 37}},
+	}, {
+		name:   "test a field selection on an optional value",
+		policy: "typecheck5 policy.yaml",
+		expected: []utils.Diagnostic{{
+			Severity: utils.SeverityError,
+			Message:  "type 'optional(dyn)' does not support field selection",
+			Path:     "spec.validations[0].expression",
+			Start:    &utils.Position{Line: 1, Column: 32},
+			End:      &utils.Position{Line: 1, Column: 45},
+		}},
+		located: [2]utils.Position{{Line: 17, Column: 51}, {Line: 17, Column: 64}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, _, updated, _, _, _, err := readValidationTestData(tt.policy, "", "variable1 updated.yaml", "", "", "")
+			if err != nil {
+				t.Fatalf("failed to read test data: %v", err)
+			}
+			_, err = k8s.EvalValidatingAdmissionPolicy(policy, nil, updated, nil, nil, nil)
+			if err == nil {
+				t.Fatalf("Eval() expected an error")
+			}
+			if diagnostics := utils.ErrorDiagnostics(err); !reflect.DeepEqual(tt.expected, diagnostics) {
+				expected, _ := json.Marshal(tt.expected)
+				received, _ := json.Marshal(diagnostics)
+				t.Errorf("Expected %s\n, received %s", expected, received)
+			}
+			located := utils.LocateDiagnostics(policy, utils.ErrorDiagnostics(err))
+			if len(located) != 1 || located[0].Path != "" || *located[0].Start != tt.located[0] || *located[0].End != tt.located[1] {
+				received, _ := json.Marshal(located)
+				t.Errorf("Expected the diagnostic located at %v, received %s", tt.located, received)
+			}
+		})
+	}
+}
+
+func TestValidationTrace(t *testing.T) {
+	policy, _, updated, _, _, _, err := readValidationTestData("variable1 policy.yaml", "", "variable1 updated.yaml", "", "", "")
+	if err != nil {
+		t.Fatalf("failed to read test data: %v", err)
+	}
+	results, err := k8s.EvalValidatingAdmissionPolicy(policy, nil, updated, nil, nil, nil, k8s.WithTrace())
+	if err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	evalResponse := k8s.EvalResponse{}
+	if err := json.Unmarshal([]byte(results), &evalResponse); err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	expected := []utils.TraceEntry{{
+		Start:      utils.Position{Line: 1, Column: 1},
+		End:        utils.Position{Line: 1, Column: 23},
+		Expression: "variables.foo == 'bar'",
+		Type:       "bool",
+		Value:      false,
+	}, {
+		Start:      utils.Position{Line: 1, Column: 1},
+		End:        utils.Position{Line: 1, Column: 14},
+		Expression: "variables.foo",
+		Type:       "string",
+		Value:      "default",
+	}, {
+		Start:      utils.Position{Line: 1, Column: 18},
+		End:        utils.Position{Line: 1, Column: 23},
+		Expression: "'bar'",
+		Type:       "string",
+		Value:      "bar",
+	}}
+	if len(evalResponse.Validations) != 1 || !reflect.DeepEqual(expected, evalResponse.Validations[0].Trace) {
+		t.Errorf("Expected the validation trace %v\n, received %v", expected, evalResponse.Validations)
+	}
+	if len(evalResponse.ValidationVariables) != 1 || len(evalResponse.ValidationVariables[0].Trace) == 0 {
+		t.Fatalf("Expected a trace for the variable, received %v", evalResponse.ValidationVariables)
+	}
+	if entry := evalResponse.ValidationVariables[0].Trace[0]; entry.Value != "default" || entry.Start.Column != 1 {
+		t.Errorf("Expected the variable trace to start with the whole expression, received %v", entry)
+	}
+}
+
+func TestValidationCostLimit(t *testing.T) {
+	policy, _, updated, _, _, _, err := readValidationTestData("variable1 policy.yaml", "", "variable1 updated.yaml", "", "", "")
+	if err != nil {
+		t.Fatalf("failed to read test data: %v", err)
+	}
+	results, err := k8s.EvalValidatingAdmissionPolicy(policy, nil, updated, nil, nil, nil, k8s.WithCostLimit(1))
+	if err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	evalResponse := k8s.EvalResponse{}
+	if err := json.Unmarshal([]byte(results), &evalResponse); err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	if len(evalResponse.Validations) != 1 || !evalResponse.Validations[0].IsError ||
+		!strings.Contains(*evalResponse.Validations[0].Error, "cost limit exceeded") {
+		t.Errorf("Expected the validation to exceed the cost limit, received %v", evalResponse.Validations)
+	}
+}
+
+func TestEvaluateValidatingAdmissionPolicy(t *testing.T) {
+	policy, _, _, _, _, _, err := readValidationTestData("variable1 policy.yaml", "", "", "", "", "")
+	if err != nil {
+		t.Fatalf("failed to read test data: %v", err)
+	}
+	request := &k8s.PolicyRequest{
+		Policy: policy,
+		Object: map[string]any{"spec": map[string]any{"template": map[string]any{"metadata": map[string]any{
+			"labels": map[string]any{"foo": "bar"},
+		}}}},
+		Request: &k8s.AdmissionRequest{
+			Kind:      k8s.GVKType{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Resource:  k8s.GVRType{Group: "apps", Version: "v1", Resource: "deployments"},
+			Name:      "foo",
+			Operation: "CREATE",
+		},
+	}
+	response, err := k8s.EvaluateValidatingAdmissionPolicy(context.Background(), request)
+	if err != nil {
+		t.Fatalf("EvaluateValidatingAdmissionPolicy() error = %v", err)
+	}
+	if !response.Allowed(true) || len(response.AuditAnnotations) != 1 || response.AuditAnnotations[0].Message != "Label for foo is set to bar" {
+		t.Errorf("Expected the policy to admit the request, received %v", response)
+	}
+}
+
+func TestValidationTimeout(t *testing.T) {
+	policy := []byte(`apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingAdmissionPolicy
+metadata:
+  name: items
+spec:
+  variables:
+    - name: sums
+      expression: object.items.all(i, object.items.all(j, i + j >= 0))
+  validations:
+    - expression: variables.sums
+    - expression: object.items.size() > 0
+`)
+	items := make([]any, 2000)
+	for i := range items {
+		items[i] = i
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := k8s.EvaluateValidatingAdmissionPolicy(ctx, &k8s.PolicyRequest{
+		Policy: policy,
+		Object: map[string]any{"items": items},
+	})
+	var interrupted *utils.InterruptedError
+	if !errors.As(err, &interrupted) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the evaluation to be interrupted by the deadline, received %v", err)
+	}
+	if interrupted.Cost == 0 {
+		t.Errorf("Expected the cost incurred before the deadline, received %v", err)
+	}
+}
+
+func TestValidationLint(t *testing.T) {
+	policy, _, updated, _, _, _, err := readValidationTestData("lint1 policy.yaml", "", "variable1 updated.yaml", "", "", "")
+	if err != nil {
+		t.Fatalf("failed to read test data: %v", err)
+	}
+	results, err := k8s.EvalValidatingAdmissionPolicy(policy, nil, updated, nil, nil, nil, k8s.WithLint())
+	if err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	evalResponse := k8s.EvalResponse{}
+	if err := json.Unmarshal([]byte(results), &evalResponse); err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	expected := []utils.Diagnostic{{
+		Severity: utils.SeverityWarning,
+		Message:  "object.spec.template.spec.containers may not be set, selecting it fails with 'no such key'",
+		Path:     "spec.variables[0].expression",
+		Start:    &utils.Position{Line: 1, Column: 1},
+		End:      &utils.Position{Line: 1, Column: 37},
+		Rule:     utils.RuleHasCheck,
+		Fix:      "test its presence first with has(object.spec.template.spec.containers), or select it optionally with object.spec.template.spec.?containers",
+	}, {
+		Severity: utils.SeverityInfo,
+		Message:  "exists() is false for empty lists and holds as soon as a single element matches",
+		Path:     "spec.validations[0].expression",
+		Start:    &utils.Position{Line: 1, Column: 1},
+		End:      &utils.Position{Line: 1, Column: 70},
+		Rule:     utils.RuleExistsAssertion,
+		Fix:      "if every element must match, use variables.containers.all(c, c.image.matches(object.metadata.name)), and test size() > 0 if the list must not be empty",
+	}, {
+		Severity: utils.SeverityWarning,
+		Message:  "the regular expression of matches() is not a literal and is compiled at every evaluation",
+		Path:     "spec.validations[0].expression",
+		Start:    &utils.Position{Line: 1, Column: 48},
+		End:      &utils.Position{Line: 1, Column: 68},
+		Rule:     utils.RuleDynamicRegex,
+		Fix:      "use a string literal, which is compiled once with the expression and validated beforehand",
+	}, {
+		Severity: utils.SeverityInfo,
+		Message:  "the message is static and its placeholders are not replaced",
+		Path:     "spec.validations[0].message",
+		Rule:     utils.RuleMessageExpression,
+		Fix:      `use messageExpression: string(object.metadata.name) + " must use its own image"`,
+	}}
+	if !reflect.DeepEqual(expected, evalResponse.Diagnostics) {
+		expected, _ := json.Marshal(expected)
+		received, _ := json.Marshal(evalResponse.Diagnostics)
+		t.Errorf("Expected %s\n, received %s", expected, received)
+	}
+}
+
+func BenchmarkValidationEval(b *testing.B) {
+	policy, orig, updated, namespace, request, authorizer, err := readValidationTestData("namespace1 policy.yaml", "", "namespace1 updated.yaml", "namespace1 namespace.yaml", "", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		if _, err := k8s.EvalValidatingAdmissionPolicy(policy, orig, updated, namespace, request, authorizer); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -15,68 +15,87 @@
 package k8s
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
-	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/interpreter"
-	"gopkg.in/yaml.v3"
+	"github.com/undistro/cel-playground/utils"
 )
 
-func EvalWebhook(webhookInput, oldObjectInput, objectValueInput, requestInput, authorizerInput []byte) (string, error) {
-	celInfo, err := extractCelInformation(webhookInput)
+// EvalWebhook evaluates the match conditions of the webhook configuration against the YAML or JSON inputs, see
+// EvaluateWebhook, and returns the JSON encoded response.
+func EvalWebhook(webhookInput, oldObjectInput, objectValueInput, requestInput, authorizerInput []byte, opts ...Option) (string, error) {
+	o := newOptions(opts)
+	request, err := decodeWebhookRequest(webhookInput, oldObjectInput, objectValueInput, requestInput, authorizerInput, o)
 	if err != nil {
 		return "", err
 	}
-
-	var oldObjectValue map[string]any
-	if err := yaml.Unmarshal(oldObjectInput, &oldObjectValue); err != nil {
-		return "", fmt.Errorf("failed to decode input for the old object resource value: %w", err)
-	}
-
-	var objectValue map[string]any
-	if err := yaml.Unmarshal(objectValueInput, &objectValue); err != nil {
-		return "", fmt.Errorf("failed to decode input for the object resource value: %w", err)
+	response, err := EvaluateWebhook(o.context(), request)
+	if err != nil {
+		return "", err
 	}
-
-	request, err := deserializeRequest(requestInput)
+	out, err := json.Marshal(response)
 	if err != nil {
 		return "", err
 	}
+	return string(out), nil
+}
 
-	var authorizer Authorizer
-	if err := yaml.Unmarshal(authorizerInput, &authorizer); err != nil {
-		return "", fmt.Errorf("failed to decode input for the authorizer: %w", err)
+func decodeWebhookRequest(webhookInput, oldObjectInput, objectValueInput, requestInput, authorizerInput []byte, o options) (*PolicyRequest, error) {
+	request := &PolicyRequest{Policy: webhookInput, Trace: o.trace, Lint: o.lint, CostLimit: o.costLimit}
+	var err error
+	if request.OldObject, err = utils.Decode(oldObjectInput); err != nil {
+		return nil, fmt.Errorf("failed to decode input for the old object resource value: %w", err)
+	}
+	if request.Object, err = utils.Decode(objectValueInput); err != nil {
+		return nil, fmt.Errorf("failed to decode input for the object resource value: %w", err)
+	}
+	if request.Request, err = deserializeRequest(requestInput); err != nil {
+		return nil, err
+	}
+	if request.Authorizer, err = deserializeAuthorizer(authorizerInput); err != nil {
+		return nil, err
 	}
-	initReceiver(&authorizer.receiverOnlyObjectVal, AuthorizerType)
+	return request, nil
+}
 
-	authorizerRequestResource, err := getAuthorizerRequestResource(&authorizer, request)
+// EvaluateWebhook evaluates the match conditions of each webhook of the configuration of the request against its
+// decoded inputs, the namespace and params of the request are not used. The evaluation stops with a
+// utils.InterruptedError, carrying the cost incurred until then, when the context is done.
+func EvaluateWebhook(ctx context.Context, r *PolicyRequest) (*EvalResponse, error) {
+	objectValue, oldObjectValue := r.Object, r.OldObject
+	_, request, err := r.typedInputs()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	authorizer := r.authorizer()
+	authorizerRequestResource, err := getAuthorizerRequestResource(authorizer, request)
+	if err != nil {
+		return nil, err
 	}
 
-	matchConditionsCelVars := []cel.EnvOption{}
 	matchConditionsInputData := map[string]any{}
 
 	if objectValue != nil {
 		cleanMetaData(objectValue)
-		matchConditionsCelVars = updateVars("object", matchConditionsCelVars, matchConditionsInputData, objectValue)
+		matchConditionsInputData["object"] = objectValue
 	}
 
 	if oldObjectValue != nil {
 		cleanMetaData(oldObjectValue)
-		matchConditionsCelVars = updateVars("oldObject", matchConditionsCelVars, matchConditionsInputData, oldObjectValue)
+		matchConditionsInputData["oldObject"] = oldObjectValue
 	}
 
 	if request != nil {
-		matchConditionsCelVars = updateVars("request", matchConditionsCelVars, matchConditionsInputData, request)
+		matchConditionsInputData["request"] = request
 	}
 
 	if authorizerRequestResource != nil {
-		matchConditionsCelVars = updateVars("authorizer.requestResource", matchConditionsCelVars, matchConditionsInputData, authorizerRequestResource)
+		matchConditionsInputData["authorizer.requestResource"] = authorizerRequestResource
 	}
 
-	matchConditionsCelVars = updateVars("authorizer", matchConditionsCelVars, matchConditionsInputData, &authorizer)
+	matchConditionsInputData["authorizer"] = authorizer
 
 	// 'object' - The object from the incoming request. The value is null for DELETE requests.
 	// 'oldObject' - The existing object. The value is null for CREATE requests.
@@ -84,33 +103,31 @@ func EvalWebhook(webhookInput, oldObjectInput, objectValueInput, requestInput, a
 	// 'authorizer' - A CEL Authorizer. May be used to perform authorization checks for the principal (user or service account) of the request.
 	// 'authorizer.requestResource' - A CEL ResourceCheck constructed from the 'authorizer' and configured with the request resource.
 
-	matchConditionsEnvOptions := append([]cel.EnvOption{}, celEnvOptions...)
-	matchConditionsEnvOptions = append(matchConditionsEnvOptions, matchConditionsCelVars...)
-	matchConditionsEnv, err := cel.NewEnv(matchConditionsEnvOptions...)
+	policy, err := compileWebhook(r.Policy, r.options())
 	if err != nil {
-		return "", fmt.Errorf("failed to create CEL env: %w", err)
+		return nil, err
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, utils.NewInterruptedError(err, 0)
+	}
+	e := &evaluation{ctx: ctx}
 	matchConditionsExprActivations, err := interpreter.NewActivation(matchConditionsInputData)
 	if err != nil {
-		return "", fmt.Errorf("failed to create CEL activations: %w", err)
+		return nil, fmt.Errorf("failed to create CEL activations: %w", err)
 	}
 
 	matchConditionsEvals := []evalResponses{}
-	for _, webhookMatchConditions := range celInfo.webhookMatchConditions {
+	for _, webhookMatchConditions := range policy.webhookMatchConditions {
 		matchConditionsEval := []*evalResponse{}
 		for _, matchCondition := range webhookMatchConditions {
-			ast, issues := matchConditionsEnv.Parse(matchCondition.expression)
-			if issues.Err() != nil {
-				return "", fmt.Errorf("failed to parse expression %s: %w", matchCondition.expression, issues.Err())
-			}
 			var val *evalResponse
-			if prog, err := matchConditionsEnv.Program(ast, celProgramOptions...); err != nil {
-				val = newEvalResponseErr("parsing", matchCondition.expression, err)
-			} else if exprEval, details, err := prog.Eval(matchConditionsExprActivations); err != nil {
-				val = newEvalResponseErr("evaluating", matchCondition.expression, err)
+			if prog, err := matchCondition.program(); err != nil {
+				val = newEvalResponseErr("parsing", matchCondition.expression, matchCondition.path, err)
+			} else if exprEval, details, err := e.eval(prog, matchConditionsExprActivations); err != nil {
+				val = newEvalResponseErr("evaluating", matchCondition.expression, matchCondition.path, err)
 			} else {
-				val = newEvalResponse(matchCondition.name, exprEval, details, "", nil)
+				val = newEvalResponse(matchCondition.name, exprEval, details, "", nil, matchCondition.trace(details))
 			}
 			matchConditionsEval = append(matchConditionsEval, val)
 		}
@@ -118,10 +135,9 @@ func EvalWebhook(webhookInput, oldObjectInput, objectValueInput, requestInput, a
 	}
 
 	response := generateEvalResponse(nil, nil, nil, nil, nil, nil, nil, matchConditionsEvals)
-
-	out, err := json.Marshal(response)
-	if err != nil {
-		return "", err
+	response.Diagnostics = append(response.Diagnostics, policy.diagnostics...)
+	if err := e.interrupted(response); err != nil {
+		return nil, err
 	}
-	return string(out), nil
+	return response, nil
 }
@@ -58,7 +58,7 @@ func TestWebhookEval(t *testing.T) {
 		webhook: "webhook1.yaml",
 		updated: "updated1.yaml",
 		expected: k8s.EvalResponse{
-			WebhookMatchConditions: [][]*k8s.EvalResult{{{Name: strptr("include-bootcamp"), Result: true, Cost: uint64ptr(6)}}},
+			WebhookMatchConditions: [][]*k8s.EvalResult{{{Name: strptr("include-bootcamp"), Result: true, Type: "bool", Cost: uint64ptr(6)}}},
 			Cost:                   uint64ptr(6),
 		},
 	}, {
@@ -66,7 +66,7 @@ func TestWebhookEval(t *testing.T) {
 		webhook: "webhook2.yaml",
 		updated: "updated2.yaml",
 		expected: k8s.EvalResponse{
-			WebhookMatchConditions: [][]*k8s.EvalResult{{{Name: strptr("exclude-bootcamp"), Result: false, Cost: uint64ptr(7)}}},
+			WebhookMatchConditions: [][]*k8s.EvalResult{{{Name: strptr("exclude-bootcamp"), Result: false, Type: "bool", Cost: uint64ptr(7)}}},
 			Cost:                   uint64ptr(7),
 		},
 	}, {
@@ -76,8 +76,8 @@ func TestWebhookEval(t *testing.T) {
 		request: "request3.yaml",
 		expected: k8s.EvalResponse{
 			WebhookMatchConditions: [][]*k8s.EvalResult{{
-				{Name: strptr("exclude-leases"), Result: true, Cost: uint64ptr(5)},
-				{Name: strptr("exclude-kubelet-requests"), Result: true, Cost: uint64ptr(5)},
+				{Name: strptr("exclude-leases"), Result: true, Type: "bool", Cost: uint64ptr(5)},
+				{Name: strptr("exclude-kubelet-requests"), Result: true, Type: "bool", Cost: uint64ptr(5)},
 			}},
 			Cost: uint64ptr(10),
 		},
@@ -89,7 +89,7 @@ func TestWebhookEval(t *testing.T) {
 		authorizer: "authorizer4.yaml",
 		expected: k8s.EvalResponse{
 			WebhookMatchConditions: [][]*k8s.EvalResult{{
-				{Name: strptr("breakglass"), Result: true, Cost: uint64ptr(7)},
+				{Name: strptr("breakglass"), Result: true, Type: "bool", Cost: uint64ptr(7)},
 			}},
 			Cost: uint64ptr(7),
 		},
@@ -101,8 +101,8 @@ func TestWebhookEval(t *testing.T) {
 		authorizer: "multi authorizer1.yaml",
 		expected: k8s.EvalResponse{
 			WebhookMatchConditions: [][]*k8s.EvalResult{
-				{{Name: strptr("breakglass"), Result: true, Cost: uint64ptr(7)}},
-				{{Name: strptr("exclude-leases"), Result: true, Cost: uint64ptr(5)}, {Name: strptr("exclude-kubelet-requests"), Result: true, Cost: uint64ptr(5)}},
+				{{Name: strptr("breakglass"), Result: true, Type: "bool", Cost: uint64ptr(7)}},
+				{{Name: strptr("exclude-leases"), Result: true, Type: "bool", Cost: uint64ptr(5)}, {Name: strptr("exclude-kubelet-requests"), Result: true, Type: "bool", Cost: uint64ptr(5)}},
 			},
 			Cost: uint64ptr(17),
 		},
@@ -114,8 +114,8 @@ func TestWebhookEval(t *testing.T) {
 		authorizer: "multi authorizer2.yaml",
 		expected: k8s.EvalResponse{
 			WebhookMatchConditions: [][]*k8s.EvalResult{
-				{{Name: strptr("breakglass"), Result: false, Cost: uint64ptr(7)}},
-				{{Name: strptr("exclude-bootcamp"), Result: false, Cost: uint64ptr(7)}},
+				{{Name: strptr("breakglass"), Result: false, Type: "bool", Cost: uint64ptr(7)}},
+				{{Name: strptr("exclude-bootcamp"), Result: false, Type: "bool", Cost: uint64ptr(7)}},
 			},
 			Cost: uint64ptr(14),
 		},
@@ -127,11 +127,16 @@ func TestWebhookEval(t *testing.T) {
 		authorizer: "multi authorizer3.yaml",
 		expected: k8s.EvalResponse{
 			WebhookMatchConditions: [][]*k8s.EvalResult{
-				{{Name: strptr("breakglass"), Result: false, Cost: uint64ptr(7)}},
-				{{Name: strptr("exclude-leases"), Result: true, Cost: uint64ptr(5)}, {Name: strptr("exclude-kubelet-requests"), Result: true, Cost: uint64ptr(5)}},
+				{{Name: strptr("breakglass"), Result: false, Type: "bool", Cost: uint64ptr(7)}},
+				{{Name: strptr("exclude-leases"), Result: true, Type: "bool", Cost: uint64ptr(5)}, {Name: strptr("exclude-kubelet-requests"), Result: true, Type: "bool", Cost: uint64ptr(5)}},
 			},
 			Cost: uint64ptr(17),
 		},
+	}, {
+		name:    "test a match condition which does not evaluate to a bool",
+		webhook: "typecheck webhook1.yaml",
+		updated: "updated1.yaml",
+		wantErr: true,
 	}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
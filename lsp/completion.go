@@ -0,0 +1,251 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsp
+
+import (
+	"regexp"
+	"strings"
+)
+
+// function is a function of the CEL libraries of the Kubernetes environments, receiver is the kind of the type of the
+// target of member functions, see typeKind, and is empty for global functions.
+type function struct {
+	name      string
+	receiver  string
+	signature string
+}
+
+// functions are listed as the environments do not expose their declarations.
+var functions = []function{
+	// standard definitions and macros
+	{"has", "", "has(e.f) -> bool"},
+	{"size", "", "size(string | bytes | list | map) -> int"},
+	{"int", "", "int(value) -> int"},
+	{"uint", "", "uint(value) -> uint"},
+	{"double", "", "double(value) -> double"},
+	{"string", "", "string(value) -> string"},
+	{"bytes", "", "bytes(string) -> bytes"},
+	{"timestamp", "", "timestamp(string) -> google.protobuf.Timestamp"},
+	{"duration", "", "duration(string) -> google.protobuf.Duration"},
+	{"type", "", "type(value) -> type"},
+	{"dyn", "", "dyn(value) -> dyn"},
+	{"matches", "", "matches(string, string) -> bool"},
+	{"optional.of", "", "optional.of(T) -> optional_type(T)"},
+	{"optional.ofNonZeroValue", "", "optional.ofNonZeroValue(T) -> optional_type(T)"},
+	{"optional.none", "", "optional.none() -> optional_type(T)"},
+	{"url", "", "url(string) -> kubernetes.URL"},
+	{"isURL", "", "isURL(string) -> bool"},
+	{"quantity", "", "quantity(string) -> kubernetes.Quantity"},
+	{"isQuantity", "", "isQuantity(string) -> bool"},
+	{"size", "string", "string.size() -> int"},
+	{"contains", "string", "string.contains(string) -> bool"},
+	{"startsWith", "string", "string.startsWith(string) -> bool"},
+	{"endsWith", "string", "string.endsWith(string) -> bool"},
+	{"matches", "string", "string.matches(string) -> bool"},
+	{"size", "bytes", "bytes.size() -> int"},
+	{"size", "list", "list.size() -> int"},
+	{"size", "map", "map.size() -> int"},
+	{"all", "list", "list.all(x, predicate) -> bool"},
+	{"exists", "list", "list.exists(x, predicate) -> bool"},
+	{"exists_one", "list", "list.exists_one(x, predicate) -> bool"},
+	{"map", "list", "list.map(x, transform) -> list"},
+	{"filter", "list", "list.filter(x, predicate) -> list"},
+	{"all", "map", "map.all(k, predicate) -> bool"},
+	{"exists", "map", "map.exists(k, predicate) -> bool"},
+	{"exists_one", "map", "map.exists_one(k, predicate) -> bool"},
+	{"map", "map", "map.map(k, transform) -> list"},
+	{"filter", "map", "map.filter(k, predicate) -> list"},
+	{"getFullYear", "timestamp", "timestamp.getFullYear([timezone]) -> int"},
+	{"getMonth", "timestamp", "timestamp.getMonth([timezone]) -> int"},
+	{"getDate", "timestamp", "timestamp.getDate([timezone]) -> int"},
+	{"getDayOfMonth", "timestamp", "timestamp.getDayOfMonth([timezone]) -> int"},
+	{"getDayOfWeek", "timestamp", "timestamp.getDayOfWeek([timezone]) -> int"},
+	{"getDayOfYear", "timestamp", "timestamp.getDayOfYear([timezone]) -> int"},
+	{"getHours", "timestamp", "timestamp.getHours([timezone]) -> int"},
+	{"getMinutes", "timestamp", "timestamp.getMinutes([timezone]) -> int"},
+	{"getSeconds", "timestamp", "timestamp.getSeconds([timezone]) -> int"},
+	{"getMilliseconds", "timestamp", "timestamp.getMilliseconds([timezone]) -> int"},
+	{"getHours", "duration", "duration.getHours() -> int"},
+	{"getMinutes", "duration", "duration.getMinutes() -> int"},
+	{"getSeconds", "duration", "duration.getSeconds() -> int"},
+	{"getMilliseconds", "duration", "duration.getMilliseconds() -> int"},
+	{"hasValue", "optional", "optional.hasValue() -> bool"},
+	{"value", "optional", "optional.value() -> T"},
+	{"orValue", "optional", "optional.orValue(T) -> T"},
+	{"or", "optional", "optional.or(optional_type(T)) -> optional_type(T)"},
+
+	// extended strings
+	{"charAt", "string", "string.charAt(int) -> string"},
+	{"indexOf", "string", "string.indexOf(string, [int]) -> int"},
+	{"lastIndexOf", "string", "string.lastIndexOf(string, [int]) -> int"},
+	{"lowerAscii", "string", "string.lowerAscii() -> string"},
+	{"upperAscii", "string", "string.upperAscii() -> string"},
+	{"replace", "string", "string.replace(string, string, [int]) -> string"},
+	{"split", "string", "string.split(string, [int]) -> list(string)"},
+	{"substring", "string", "string.substring(int, [int]) -> string"},
+	{"trim", "string", "string.trim() -> string"},
+	{"join", "list", "list(string).join([string]) -> string"},
+
+	// Kubernetes regex, lists, URLs and quantities
+	{"find", "string", "string.find(string) -> string"},
+	{"findAll", "string", "string.findAll(string, [int]) -> list(string)"},
+	{"isSorted", "list", "list.isSorted() -> bool"},
+	{"sum", "list", "list.sum() -> T"},
+	{"min", "list", "list.min() -> T"},
+	{"max", "list", "list.max() -> T"},
+	{"indexOf", "list", "list.indexOf(T) -> int"},
+	{"lastIndexOf", "list", "list.lastIndexOf(T) -> int"},
+	{"getScheme", "kubernetes.URL", "URL.getScheme() -> string"},
+	{"getHost", "kubernetes.URL", "URL.getHost() -> string"},
+	{"getHostname", "kubernetes.URL", "URL.getHostname() -> string"},
+	{"getPort", "kubernetes.URL", "URL.getPort() -> string"},
+	{"getEscapedPath", "kubernetes.URL", "URL.getEscapedPath() -> string"},
+	{"getQuery", "kubernetes.URL", "URL.getQuery() -> map(string, list(string))"},
+	{"isInteger", "kubernetes.Quantity", "Quantity.isInteger() -> bool"},
+	{"asInteger", "kubernetes.Quantity", "Quantity.asInteger() -> int"},
+	{"asApproximateFloat", "kubernetes.Quantity", "Quantity.asApproximateFloat() -> double"},
+	{"sign", "kubernetes.Quantity", "Quantity.sign() -> int"},
+	{"add", "kubernetes.Quantity", "Quantity.add(Quantity | int) -> Quantity"},
+	{"sub", "kubernetes.Quantity", "Quantity.sub(Quantity | int) -> Quantity"},
+	{"isGreaterThan", "kubernetes.Quantity", "Quantity.isGreaterThan(Quantity) -> bool"},
+	{"isLessThan", "kubernetes.Quantity", "Quantity.isLessThan(Quantity) -> bool"},
+	{"compareTo", "kubernetes.Quantity", "Quantity.compareTo(Quantity) -> int"},
+
+	// authorizer
+	{"path", "playground.k8s.Authorizer", "Authorizer.path(string) -> PathCheck"},
+	{"group", "playground.k8s.Authorizer", "Authorizer.group(string) -> GroupCheck"},
+	{"serviceAccount", "playground.k8s.Authorizer", "Authorizer.serviceAccount(string, string) -> Authorizer"},
+	{"check", "playground.k8s.PathCheck", "PathCheck.check(string) -> Decision"},
+	{"resource", "playground.k8s.GroupCheck", "GroupCheck.resource(string) -> ResourceCheck"},
+	{"subresource", "playground.k8s.ResourceCheck", "ResourceCheck.subresource(string) -> ResourceCheck"},
+	{"namespace", "playground.k8s.ResourceCheck", "ResourceCheck.namespace(string) -> ResourceCheck"},
+	{"name", "playground.k8s.ResourceCheck", "ResourceCheck.name(string) -> ResourceCheck"},
+	{"check", "playground.k8s.ResourceCheck", "ResourceCheck.check(string) -> Decision"},
+	{"allowed", "playground.k8s.Decision", "Decision.allowed() -> bool"},
+	{"reason", "playground.k8s.Decision", "Decision.reason() -> string"},
+	{"errored", "playground.k8s.Decision", "Decision.errored() -> bool"},
+	{"error", "playground.k8s.Decision", "Decision.error() -> string"},
+}
+
+var (
+	objectFields   = []string{"apiVersion", "kind", "metadata", "spec", "status"}
+	metadataFields = []string{"name", "namespace", "generateName", "labels", "annotations", "uid", "resourceVersion",
+		"generation", "creationTimestamp", "deletionTimestamp", "ownerReferences", "finalizers"}
+	gvkFields = []string{"group", "version", "kind"}
+	gvrFields = []string{"group", "version", "resource"}
+
+	// fields are the known fields of the variables, which are declared as dyn, by path.
+	fields = map[string][]string{
+		"object":                   objectFields,
+		"oldObject":                objectFields,
+		"namespaceObject":          objectFields,
+		"params":                   objectFields,
+		"object.metadata":          metadataFields,
+		"oldObject.metadata":       metadataFields,
+		"namespaceObject.metadata": metadataFields,
+		"params.metadata":          metadataFields,
+		"request": {"kind", "resource", "subResource", "requestKind", "requestResource", "requestSubResource", "name",
+			"namespace", "operation", "userInfo", "dryRun", "options"},
+		"request.kind":            gvkFields,
+		"request.requestKind":     gvkFields,
+		"request.resource":        gvrFields,
+		"request.requestResource": gvrFields,
+		"request.userInfo":        {"username", "uid", "groups", "extra"},
+	}
+)
+
+var (
+	selectionPrefix  = regexp.MustCompile(`([_a-zA-Z][_a-zA-Z0-9]*(?:\.[_a-zA-Z][_a-zA-Z0-9]*)*)\.[_a-zA-Z0-9]*$`)
+	identifierPrefix = regexp.MustCompile(`(^|[^._a-zA-Z0-9])[_a-zA-Z0-9]*$`)
+)
+
+// completions returns the completion items at the offset of the expression: the members of the operand when a field
+// is selected, or the variables and global functions otherwise. Items are filtered by the client.
+func (p *policy) completions(e *locatedExpression, offset int) []CompletionItem {
+	prefix := string([]rune(e.Expression)[:offset])
+	if match := selectionPrefix.FindStringSubmatch(prefix); match != nil {
+		return p.memberCompletions(e, match[1])
+	}
+	if !identifierPrefix.MatchString(prefix) {
+		return []CompletionItem{}
+	}
+	items := []CompletionItem{}
+	for _, name := range p.analysis.Globals {
+		items = append(items, CompletionItem{Label: name, Kind: completionVariable})
+	}
+	if len(p.analysis.Variables) > 0 {
+		items = append(items, CompletionItem{Label: "variables", Kind: completionVariable, Detail: "composited variables"})
+	}
+	for _, f := range functions {
+		if f.receiver == "" {
+			items = append(items, CompletionItem{Label: f.name, Kind: completionFunction, Detail: f.signature})
+		}
+	}
+	return items
+}
+
+func (p *policy) memberCompletions(e *locatedExpression, operand string) []CompletionItem {
+	items := []CompletionItem{}
+	if operand == "variables" {
+		for _, variable := range p.analysis.Variables {
+			items = append(items, CompletionItem{Label: variable.Name, Kind: completionVariable, Detail: variable.Type})
+		}
+		return items
+	}
+	if names, ok := fields[operand]; ok {
+		for _, name := range names {
+			items = append(items, CompletionItem{Label: name, Kind: completionField})
+		}
+		return items
+	}
+	kind := "dyn"
+	if t, ok := e.Check(operand); ok {
+		kind = typeKind(t)
+	} else {
+		// not a value, but maybe the namespace of functions, such as 'optional'
+		return qualifiedCompletions(operand)
+	}
+	for _, f := range functions {
+		if f.receiver != "" && (kind == "dyn" || f.receiver == kind) {
+			items = append(items, CompletionItem{Label: f.name, Kind: completionFunction, Detail: f.signature})
+		}
+	}
+	return items
+}
+
+// qualifiedCompletions returns the functions of the namespace, such as 'optional'.
+func qualifiedCompletions(namespace string) []CompletionItem {
+	items := []CompletionItem{}
+	for _, f := range functions {
+		if name, ok := strings.CutPrefix(f.name, namespace+"."); ok && f.receiver == "" {
+			items = append(items, CompletionItem{Label: name, Kind: completionFunction, Detail: f.signature})
+		}
+	}
+	return items
+}
+
+// typeKind returns the kind of the receivers of the functions of a type, e.g. 'list' for 'list(string)'.
+func typeKind(t string) string {
+	name, _, _ := strings.Cut(t, "(")
+	switch name {
+	case "google.protobuf.Timestamp":
+		return "timestamp"
+	case "google.protobuf.Duration":
+		return "duration"
+	case "optional_type":
+		return "optional"
+	}
+	return name
+}
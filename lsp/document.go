@@ -0,0 +1,207 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsp
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/undistro/cel-playground/k8s"
+	"github.com/undistro/cel-playground/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// document is an open text document, a stream of YAML documents some of which are policies.
+// Characters are counted in runes, which matches the UTF-16 positions of the protocol for the characters of the Basic
+// Multilingual Plane.
+type document struct {
+	uri      string
+	lines    [][]rune
+	policies []*policy
+	// err is the failure to decode the YAML stream, the documents before the failure are still analyzed
+	err error
+}
+
+// policy is a YAML document holding CEL expressions, with the analysis of its expressions.
+type policy struct {
+	root        *yaml.Node
+	analysis    *k8s.Analysis
+	expressions []*locatedExpression
+}
+
+// locatedExpression is an expression along with the position in the document of each of its characters and of its
+// end.
+type locatedExpression struct {
+	*k8s.AnalyzedExpression
+	positions []Position
+}
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+):`)
+
+func newDocument(uri, text string) *document {
+	d := &document{uri: uri}
+	d.lines = utils.DocumentLines(text)
+	decoder := yaml.NewDecoder(strings.NewReader(text))
+	for {
+		root := &yaml.Node{}
+		if err := decoder.Decode(root); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			d.err = err
+			break
+		}
+		input, err := yaml.Marshal(root)
+		if err != nil {
+			continue
+		}
+		analysis, err := k8s.Analyze(input)
+		if err != nil {
+			// not a policy
+			continue
+		}
+		p := &policy{root: root, analysis: analysis}
+		for _, expression := range analysis.Expressions {
+			if node := utils.FindNode(root, expression.Path); node != nil {
+				var positions []Position
+				for _, position := range utils.ScalarPositions(d.lines, node) {
+					positions = append(positions, Position{Line: position.Line - 1, Character: position.Column - 1})
+				}
+				p.expressions = append(p.expressions, &locatedExpression{AnalyzedExpression: expression, positions: positions})
+			}
+		}
+		d.policies = append(d.policies, p)
+	}
+	return d
+}
+
+// nodeRange returns the range of a scalar written on a single line.
+func nodeRange(node *yaml.Node) Range {
+	start := Position{Line: node.Line - 1, Character: node.Column - 1}
+	end := Position{Line: start.Line, Character: start.Character + len([]rune(node.Value))}
+	if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 {
+		end.Character += 2
+	}
+	return Range{Start: start, End: end}
+}
+
+// expressionAt returns the expression at the position and the offset of the position within it.
+func (d *document) expressionAt(pos Position) (*policy, *locatedExpression, int) {
+	for _, p := range d.policies {
+		for _, expression := range p.expressions {
+			last := len(expression.positions) - 1
+			if before(pos, expression.positions[0]) || before(expression.positions[last], pos) {
+				continue
+			}
+			offset := 0
+			for i, position := range expression.positions {
+				if before(pos, position) {
+					break
+				}
+				offset = i
+			}
+			return p, expression, offset
+		}
+	}
+	return nil, nil, 0
+}
+
+func before(a, b Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Character < b.Character
+}
+
+// rangeOf returns the range of the characters of the expression between the offsets.
+func (e *locatedExpression) rangeOf(start, end int) Range {
+	last := len(e.positions) - 1
+	start, end = min(max(start, 0), last), min(max(end, 0), last)
+	return Range{Start: e.positions[start], End: e.positions[end]}
+}
+
+// diagnostics converts the diagnostics of the analysis into diagnostics of the document.
+func (d *document) diagnostics() []Diagnostic {
+	diagnostics := []Diagnostic{}
+	if d.err != nil {
+		line := 0
+		if match := yamlErrorLine.FindStringSubmatch(d.err.Error()); match != nil {
+			line, _ = strconv.Atoi(match[1])
+			line--
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Range:    Range{Start: Position{Line: line}, End: Position{Line: line, Character: d.lineLength(line)}},
+			Severity: diagnosticError,
+			Source:   source,
+			Message:  d.err.Error(),
+		})
+	}
+	for _, p := range d.policies {
+		for _, diagnostic := range p.analysis.Diagnostics {
+			r, ok := p.diagnosticRange(diagnostic)
+			if !ok {
+				continue
+			}
+			diagnostics = append(diagnostics, Diagnostic{
+				Range:    r,
+				Severity: severity(diagnostic.Severity),
+				Code:     diagnostic.Rule,
+				Source:   source,
+				Message:  diagnosticMessage(diagnostic),
+			})
+		}
+	}
+	return diagnostics
+}
+
+func (p *policy) diagnosticRange(diagnostic utils.Diagnostic) (Range, bool) {
+	for _, expression := range p.expressions {
+		if expression.Path != diagnostic.Path {
+			continue
+		}
+		if diagnostic.Start == nil || diagnostic.End == nil {
+			return expression.rangeOf(0, len(expression.positions)-1), true
+		}
+		return expression.rangeOf(utils.Offset(expression.Expression, *diagnostic.Start), utils.Offset(expression.Expression, *diagnostic.End)), true
+	}
+	if node := utils.FindNode(p.root, diagnostic.Path); node != nil {
+		return nodeRange(node), true
+	}
+	return Range{}, false
+}
+
+func (d *document) lineLength(line int) int {
+	if line < 0 || line >= len(d.lines) {
+		return 0
+	}
+	return len(d.lines[line])
+}
+
+func severity(s utils.Severity) int {
+	switch s {
+	case utils.SeverityWarning:
+		return diagnosticWarning
+	case utils.SeverityInfo:
+		return diagnosticInformation
+	default:
+		return diagnosticError
+	}
+}
+
+func diagnosticMessage(diagnostic utils.Diagnostic) string {
+	if diagnostic.Fix == "" {
+		return diagnostic.Message
+	}
+	return diagnostic.Message + "\nfix: " + diagnostic.Fix
+}
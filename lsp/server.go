@@ -0,0 +1,241 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lsp implements a Language Server Protocol server for the CEL expressions embedded in Kubernetes YAML
+// documents: validating admission policies, webhook configurations and the validation rules of CRDs.
+// It publishes the compilation errors and lint findings of the expressions, shows the type of the subexpression under
+// the cursor, completes variables, fields and functions, and goes to the declaration of composited variables.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/undistro/cel-playground/utils"
+)
+
+// source is the source of the diagnostics published by the server.
+const source = "cel"
+
+// Server serves a single client over a stream, documents are synchronized in full.
+type Server struct {
+	documents map[string]*document
+	w         io.Writer
+}
+
+func NewServer() *Server {
+	return &Server{documents: map[string]*document{}}
+}
+
+type handler func(s *Server, params json.RawMessage) (any, error)
+
+var handlers = map[string]handler{
+	"initialize":              (*Server).initialize,
+	"initialized":             ignore,
+	"shutdown":                ignore,
+	"textDocument/didOpen":    (*Server).didOpen,
+	"textDocument/didChange":  (*Server).didChange,
+	"textDocument/didClose":   (*Server).didClose,
+	"textDocument/didSave":    ignore,
+	"textDocument/hover":      (*Server).hover,
+	"textDocument/completion": (*Server).completion,
+	"textDocument/definition": (*Server).definition,
+}
+
+// Serve reads the messages of the client from r and writes the responses and notifications to w until the client
+// exits or r is closed.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.w = w
+	reader := bufio.NewReader(r)
+	for {
+		msg, err := readMessage(reader)
+		var parseErr *responseError
+		if errors.As(err, &parseErr) {
+			if err := writeMessage(w, &message{ID: &nullID, Error: parseErr}); err != nil {
+				return err
+			}
+			continue
+		} else if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read the message: %w", err)
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		if err := s.handle(msg); err != nil {
+			return err
+		}
+	}
+}
+
+var nullID = json.RawMessage("null")
+
+func (s *Server) handle(msg *message) error {
+	h, ok := handlers[msg.Method]
+	if !ok {
+		if msg.ID == nil {
+			// notifications of unsupported methods are ignored
+			return nil
+		}
+		return writeMessage(s.w, &message{ID: msg.ID, Error: &responseError{
+			Code:    codeMethodNotFound,
+			Message: fmt.Sprintf("method %s is not supported", msg.Method),
+		}})
+	}
+	result, err := h(s, msg.Params)
+	if msg.ID == nil {
+		return nil
+	}
+	response := &message{ID: msg.ID}
+	if err != nil {
+		response.Error = &responseError{Code: codeInvalidParams, Message: err.Error()}
+	} else if response.Result, err = json.Marshal(result); err != nil {
+		return fmt.Errorf("failed to marshal the result: %w", err)
+	}
+	return writeMessage(s.w, response)
+}
+
+func (s *Server) notify(method string, params any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the params: %w", err)
+	}
+	return writeMessage(s.w, &message{Method: method, Params: data})
+}
+
+func ignore(*Server, json.RawMessage) (any, error) {
+	return nil, nil
+}
+
+func (s *Server) initialize(json.RawMessage) (any, error) {
+	return map[string]any{
+		"capabilities": map[string]any{
+			"textDocumentSync":   1,
+			"hoverProvider":      true,
+			"completionProvider": map[string]any{"triggerCharacters": []string{"."}},
+			"definitionProvider": true,
+		},
+		"serverInfo": map[string]any{"name": "cel-playground"},
+	}, nil
+}
+
+func (s *Server) didOpen(data json.RawMessage) (any, error) {
+	var params didOpenParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, fmt.Errorf("failed to decode the params: %w", err)
+	}
+	return nil, s.update(params.TextDocument.URI, params.TextDocument.Text)
+}
+
+func (s *Server) didChange(data json.RawMessage) (any, error) {
+	var params didChangeParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, fmt.Errorf("failed to decode the params: %w", err)
+	}
+	if len(params.ContentChanges) == 0 {
+		return nil, nil
+	}
+	// the documents are synchronized in full, the last change is the whole text
+	return nil, s.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+}
+
+func (s *Server) didClose(data json.RawMessage) (any, error) {
+	var params didCloseParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, fmt.Errorf("failed to decode the params: %w", err)
+	}
+	delete(s.documents, params.TextDocument.URI)
+	return nil, s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+		URI:         params.TextDocument.URI,
+		Diagnostics: []Diagnostic{},
+	})
+}
+
+func (s *Server) update(uri, text string) error {
+	d := newDocument(uri, text)
+	s.documents[uri] = d
+	return s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Diagnostics: d.diagnostics()})
+}
+
+// position returns the expression at the position of the params, and the offset of the position within it.
+func (s *Server) position(data json.RawMessage) (*document, *policy, *locatedExpression, int, error) {
+	var params textDocumentPositionParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, nil, nil, 0, fmt.Errorf("failed to decode the params: %w", err)
+	}
+	d, ok := s.documents[params.TextDocument.URI]
+	if !ok {
+		return nil, nil, nil, 0, fmt.Errorf("document %s is not open", params.TextDocument.URI)
+	}
+	p, e, offset := d.expressionAt(params.Position)
+	return d, p, e, offset, nil
+}
+
+func (s *Server) hover(data json.RawMessage) (any, error) {
+	_, _, e, offset, err := s.position(data)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	span, t, ok := e.TypeAt(offset)
+	if !ok {
+		return nil, nil
+	}
+	r := e.rangeOf(span.Start, span.End)
+	text := string([]rune(e.Expression)[span.Start:span.End])
+	return &Hover{
+		Contents: markupContent{Kind: "markdown", Value: fmt.Sprintf("```cel\n%s: %s\n```", text, t)},
+		Range:    &r,
+	}, nil
+}
+
+func (s *Server) completion(data json.RawMessage) (any, error) {
+	_, p, e, offset, err := s.position(data)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return []CompletionItem{}, nil
+	}
+	return p.completions(e, offset), nil
+}
+
+var variableReference = regexp.MustCompile(`\bvariables\.([_a-zA-Z][_a-zA-Z0-9]*)`)
+
+func (s *Server) definition(data json.RawMessage) (any, error) {
+	d, p, e, offset, err := s.position(data)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	for _, match := range variableReference.FindAllStringSubmatchIndex(e.Expression, -1) {
+		start := utf8.RuneCountInString(e.Expression[:match[0]])
+		end := utf8.RuneCountInString(e.Expression[:match[1]])
+		if offset < start || offset > end {
+			continue
+		}
+		variable := p.analysis.Variable(e.Expression[match[2]:match[3]])
+		if variable == nil {
+			return nil, nil
+		}
+		if node := utils.FindNode(p.root, variable.NamePath); node != nil {
+			return &Location{URI: d.uri, Range: nodeRange(node)}, nil
+		}
+	}
+	return nil, nil
+}
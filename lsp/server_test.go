@@ -0,0 +1,215 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+const policyDocument = `apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingAdmissionPolicy
+metadata:
+  name: replicas
+spec:
+  variables:
+    - name: replicas
+      expression: object.spec.replicas
+    - name: limit
+      expression: |
+        int(params.data.limit)
+  validations:
+    - expression: variables.limit > "5"
+    - expression: '!request.userInfo.username.startsWith("system:")'
+    - expression: variables.replicas <= variables.limit
+`
+
+// serve sends the requests to a server, after opening the document, and returns the messages it writes.
+func serve(t *testing.T, requests ...message) []*message {
+	t.Helper()
+	var in bytes.Buffer
+	open, _ := json.Marshal(didOpenParams{TextDocument: textDocumentItem{URI: "file:///policy.yaml", Text: policyDocument}})
+	requests = append([]message{{Method: "textDocument/didOpen", Params: open}}, requests...)
+	for _, request := range requests {
+		if err := writeMessage(&in, &request); err != nil {
+			t.Fatalf("writeMessage() error = %v", err)
+		}
+	}
+	var out bytes.Buffer
+	if err := NewServer().Serve(&in, &out); err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	var messages []*message
+	reader := bufio.NewReader(&out)
+	for {
+		msg, err := readMessage(reader)
+		if errors.Is(err, io.EOF) {
+			return messages
+		} else if err != nil {
+			t.Fatalf("readMessage() error = %v", err)
+		}
+		messages = append(messages, msg)
+	}
+}
+
+func request(method string, line, character int) message {
+	id := json.RawMessage("1")
+	params, _ := json.Marshal(textDocumentPositionParams{
+		TextDocument: textDocumentIdentifier{URI: "file:///policy.yaml"},
+		Position:     Position{Line: line, Character: character},
+	})
+	return message{ID: &id, Method: method, Params: params}
+}
+
+func TestDiagnostics(t *testing.T) {
+	messages := serve(t)
+	if len(messages) != 1 || messages[0].Method != "textDocument/publishDiagnostics" {
+		t.Fatalf("expected diagnostics to be published, got %v", messages)
+	}
+	var params publishDiagnosticsParams
+	if err := json.Unmarshal(messages[0].Params, &params); err != nil {
+		t.Fatalf("failed to decode diagnostics: %v", err)
+	}
+	expected := []struct {
+		r        Range
+		severity int
+		code     string
+	}{
+		{Range{Start: Position{Line: 7, Character: 18}, End: Position{Line: 7, Character: 38}}, diagnosticWarning, "has-check"},
+		{Range{Start: Position{Line: 10, Character: 12}, End: Position{Line: 10, Character: 29}}, diagnosticWarning, "has-check"},
+		{Range{Start: Position{Line: 12, Character: 34}, End: Position{Line: 12, Character: 35}}, diagnosticError, ""},
+	}
+	if len(params.Diagnostics) != len(expected) {
+		t.Fatalf("expected %d diagnostics, got %v", len(expected), params.Diagnostics)
+	}
+	for i, diagnostic := range params.Diagnostics {
+		if diagnostic.Range != expected[i].r || diagnostic.Severity != expected[i].severity || diagnostic.Code != expected[i].code {
+			t.Errorf("expected %v, got %v", expected[i], diagnostic)
+		}
+	}
+}
+
+func TestHover(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      int
+		character int
+		expected  *Hover
+	}{{
+		name:      "block scalar",
+		line:      10,
+		character: 8,
+		expected: &Hover{
+			Contents: markupContent{Kind: "markdown", Value: "```cel\nint(params.data.limit): int\n```"},
+			Range:    &Range{Start: Position{Line: 10, Character: 8}, End: Position{Line: 10, Character: 30}},
+		},
+	}, {
+		name:      "variable",
+		line:      14,
+		character: 45,
+		expected: &Hover{
+			Contents: markupContent{Kind: "markdown", Value: "```cel\nvariables.limit: int\n```"},
+			Range:    &Range{Start: Position{Line: 14, Character: 40}, End: Position{Line: 14, Character: 55}},
+		},
+	}, {
+		name:      "outside expressions",
+		line:      3,
+		character: 8,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := serve(t, request("textDocument/hover", tt.line, tt.character))
+			var hover *Hover
+			if err := json.Unmarshal(messages[1].Result, &hover); err != nil {
+				t.Fatalf("failed to decode hover: %v", err)
+			}
+			if !reflect.DeepEqual(hover, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, hover)
+			}
+		})
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      int
+		character int
+		expected  []string
+	}{{
+		name:      "variables",
+		line:      12,
+		character: 28,
+		expected:  []string{"replicas", "limit"},
+	}, {
+		name:      "request",
+		line:      13,
+		character: 28,
+		expected:  []string{"userInfo"},
+	}, {
+		name:      "user info",
+		line:      13,
+		character: 37,
+		expected:  []string{"username", "groups"},
+	}, {
+		name:      "functions",
+		line:      13,
+		character: 46,
+		expected:  []string{"startsWith", "lowerAscii"},
+	}, {
+		name:      "globals",
+		line:      7,
+		character: 18,
+		expected:  []string{"object", "variables", "quantity"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := serve(t, request("textDocument/completion", tt.line, tt.character))
+			var items []CompletionItem
+			if err := json.Unmarshal(messages[1].Result, &items); err != nil {
+				t.Fatalf("failed to decode completion items: %v", err)
+			}
+			labels := map[string]bool{}
+			for _, item := range items {
+				labels[item.Label] = true
+			}
+			for _, label := range tt.expected {
+				if !labels[label] {
+					t.Errorf("expected %s to be completed, got %v", label, items)
+				}
+			}
+		})
+	}
+}
+
+func TestDefinition(t *testing.T) {
+	messages := serve(t, request("textDocument/definition", 12, 22))
+	var location *Location
+	if err := json.Unmarshal(messages[1].Result, &location); err != nil {
+		t.Fatalf("failed to decode location: %v", err)
+	}
+	expected := &Location{
+		URI:   "file:///policy.yaml",
+		Range: Range{Start: Position{Line: 8, Character: 12}, End: Position{Line: 8, Character: 17}},
+	}
+	if !reflect.DeepEqual(location, expected) {
+		t.Errorf("expected %v, got %v", expected, location)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modes
+
+import (
+	"context"
+
+	"github.com/undistro/cel-playground/eval"
+)
+
+var celMode = &Mode{
+	Name: "CEL Expression",
+	Inputs: []Input{
+		{ID: "cel", Label: "CEL Expression", Language: "javascript", Required: true},
+		{ID: "dataInput", Label: "Input", Language: "javascript"},
+		{ID: "dataDeclarations", Label: "Declarations", Language: "yaml"},
+		{ID: "dataDescriptors", Label: "Descriptors", Language: "text"},
+		{ID: "dataUnknowns", Label: "Unknowns", Language: "yaml"},
+	},
+	Examples: "examples.yaml",
+	// Eval evaluates the expression against each document of the input, or each item of a List, with the batch flag.
+	Eval: func(ctx context.Context, args Args, opts Options) (string, error) {
+		evalOpts, err := evalOptions(ctx, args, opts)
+		if err != nil {
+			return "", err
+		}
+		if args.Flag("batch") {
+			return eval.CelEvalBatch(args.Input("cel"), args.Input("dataInput"), evalOpts...)
+		}
+		return eval.CelEval(args.Input("cel"), args.Input("dataInput"), evalOpts...)
+	},
+	// Check type-checks the expression against the variables argument, the types of the variables, or else the input.
+	Check: func(ctx context.Context, args Args, opts Options) (string, error) {
+		variables := args.Input("variables")
+		if len(variables) == 0 {
+			variables = args.Input("dataInput")
+		}
+		evalOpts, err := evalOptions(ctx, args, opts)
+		if err != nil {
+			return "", err
+		}
+		return eval.CelCheck(args.Input("cel"), variables, evalOpts...)
+	},
+	Format: func(_ context.Context, args Args, _ Options) (string, error) {
+		return eval.Format(string(args.Input("cel")), formatOptions(args)...)
+	},
+}
+
+func evalOptions(ctx context.Context, args Args, opts Options) ([]eval.Option, error) {
+	evalOpts := []eval.Option{eval.WithContext(ctx)}
+	if opts.CostLimit > 0 {
+		evalOpts = append(evalOpts, eval.WithCostLimit(opts.CostLimit))
+	}
+	if args.Flag("trace") {
+		evalOpts = append(evalOpts, eval.WithTrace())
+	}
+	if args.Flag("lint") {
+		evalOpts = append(evalOpts, eval.WithLint())
+	}
+	if input := args.Input("dataDeclarations"); len(input) > 0 {
+		declarations, err := eval.ParseDeclarations(input)
+		if err != nil {
+			return nil, err
+		}
+		evalOpts = append(evalOpts, eval.WithDeclarations(declarations))
+	}
+	if input := args.Input("dataDescriptors"); len(input) > 0 {
+		descriptors, err := eval.ParseDescriptors(input)
+		if err != nil {
+			return nil, err
+		}
+		evalOpts = append(evalOpts, eval.WithDescriptors(descriptors))
+	}
+	if input := args.Input("dataUnknowns"); len(input) > 0 {
+		unknowns, err := eval.ParseUnknowns(input)
+		if err != nil {
+			return nil, err
+		}
+		evalOpts = append(evalOpts, eval.WithUnknowns(unknowns...))
+	}
+	return evalOpts, nil
+}
+
+func formatOptions(args Args) []eval.Option {
+	if width, ok := args.Int("width"); ok {
+		return []eval.Option{eval.WithWidth(width)}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modes
+
+import (
+	"context"
+
+	"github.com/undistro/cel-playground/eval"
+	"github.com/undistro/cel-playground/k8s"
+)
+
+var vapMode = &Mode{
+	Name: "Validating Admission Policy",
+	Inputs: []Input{
+		{ID: "vap", Label: "Validating Admission Policy", Language: "yaml", Required: true},
+		{ID: "dataObject", Label: "Object", Language: "yaml"},
+		{ID: "dataOldObject", Label: "Old Object", Language: "yaml"},
+		{ID: "dataNamespace", Label: "Namespace", Language: "yaml"},
+		{ID: "dataRequest", Label: "Request", Language: "yaml"},
+		{ID: "dataAuthorizer", Label: "Authorizer", Language: "yaml"},
+	},
+	Examples: "validating_examples.yaml",
+	Eval: func(ctx context.Context, args Args, opts Options) (string, error) {
+		return k8s.EvalValidatingAdmissionPolicy(
+			args.Input("vap"),
+			args.Input("dataOldObject"),
+			args.Input("dataObject"),
+			args.Input("dataNamespace"),
+			args.Input("dataRequest"),
+			args.Input("dataAuthorizer"),
+			k8sOptions(ctx, args, opts)...,
+		)
+	},
+	Format: formatDocument("vap"),
+}
+
+var webhooksMode = &Mode{
+	Name: "Web Hooks",
+	Inputs: []Input{
+		{ID: "webhooks", Label: "Web Hooks", Language: "yaml", Required: true},
+		{ID: "dataObject", Label: "Object", Language: "yaml"},
+		{ID: "dataOldObject", Label: "Old Object", Language: "yaml"},
+		{ID: "dataRequest", Label: "Request", Language: "yaml"},
+		{ID: "dataAuthorizer", Label: "Authorizer", Language: "yaml"},
+	},
+	Examples: "webhooks_examples.yaml",
+	Eval: func(ctx context.Context, args Args, opts Options) (string, error) {
+		return k8s.EvalWebhook(
+			args.Input("webhooks"),
+			args.Input("dataOldObject"),
+			args.Input("dataObject"),
+			args.Input("dataRequest"),
+			args.Input("dataAuthorizer"),
+			k8sOptions(ctx, args, opts)...,
+		)
+	},
+	Format: formatDocument("webhooks"),
+}
+
+var auditMode = &Mode{
+	Name: "Policy Audit",
+	Inputs: []Input{
+		{ID: "audit", Label: "Validating Admission Policy", Language: "yaml", Required: true},
+		{ID: "dataObjects", Label: "Objects", Language: "yaml", Required: true},
+	},
+	Examples: "audit_examples.yaml",
+	Eval: func(ctx context.Context, args Args, opts Options) (string, error) {
+		k8sOpts := []k8s.Option{k8s.WithContext(ctx)}
+		if opts.CostLimit > 0 {
+			k8sOpts = append(k8sOpts, k8s.WithCostLimit(opts.CostLimit))
+		}
+		return k8s.AuditValidatingAdmissionPolicy(args.Input("audit"), args.Input("dataObjects"), args.Flag("create"), k8sOpts...)
+	},
+	Format: formatDocument("audit"),
+}
+
+func k8sOptions(ctx context.Context, args Args, opts Options) []k8s.Option {
+	k8sOpts := []k8s.Option{k8s.WithContext(ctx)}
+	if opts.CostLimit > 0 {
+		k8sOpts = append(k8sOpts, k8s.WithCostLimit(opts.CostLimit))
+	}
+	if args.Flag("trace") {
+		k8sOpts = append(k8sOpts, k8s.WithTrace())
+	}
+	if args.Flag("lint") {
+		k8sOpts = append(k8sOpts, k8s.WithLint())
+	}
+	return k8sOpts
+}
+
+// formatDocument formats the expressions of the document of the input.
+func formatDocument(id string) Func {
+	return func(_ context.Context, args Args, _ Options) (string, error) {
+		formatted, err := eval.FormatDocument(args.Input(id), formatOptions(args)...)
+		return string(formatted), err
+	}
+}
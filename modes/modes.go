@@ -0,0 +1,145 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package modes is the registry of the modes of the playground. Each mode declares its inputs, its examples and the
+// functions evaluating, checking and formatting them, which the WebAssembly module and the HTTP API dispatch to and
+// from which the data of the front end is generated.
+package modes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Input is an input of a mode. Its ID names the argument of the functions and the field of the requests, Language is
+// the one of its editor and Example its content when an example leaves it out.
+type Input struct {
+	ID       string `json:"id"`
+	Label    string `json:"name"`
+	Language string `json:"mode"`
+	Required bool   `json:"required,omitempty"`
+	Example  string `json:"example,omitempty"`
+}
+
+// Args are the arguments of the functions of a mode: its inputs, YAML or JSON documents, and the flags and numbers
+// setting their options, by name.
+type Args interface {
+	Input(id string) []byte
+	Flag(name string) bool
+	Int(name string) (int, bool)
+}
+
+// Options are set by the host of the functions rather than by their callers.
+type Options struct {
+	// CostLimit bounds the runtime cost of evaluations, 0 leaves it unbounded.
+	CostLimit uint64
+}
+
+type Func func(ctx context.Context, args Args, opts Options) (string, error)
+
+// Operation names the functions of modes.
+type Operation string
+
+const (
+	Eval   Operation = "eval"
+	Check  Operation = "check"
+	Format Operation = "format"
+)
+
+// Operations are the operations modes may support, in order.
+var Operations = []Operation{Eval, Check, Format}
+
+// Mode is a mode of the playground. Its expression, a CEL expression or a document holding some, is its first input
+// and its ID is the one of the expression.
+type Mode struct {
+	Name   string
+	Inputs []Input
+	// Examples is the path of the YAML file of the examples of the mode, relative to the root of the repository.
+	Examples string
+	Eval     Func
+	Check    Func
+	Format   Func
+}
+
+// modes are the registered modes, in the order of the front end.
+var modes = []*Mode{celMode, vapMode, webhooksMode, auditMode}
+
+// All returns the registered modes.
+func All() []*Mode {
+	return modes
+}
+
+// Get returns the mode with the ID, or nil.
+func Get(id string) *Mode {
+	for _, mode := range modes {
+		if mode.ID() == id {
+			return mode
+		}
+	}
+	return nil
+}
+
+func (m *Mode) ID() string {
+	return m.Inputs[0].ID
+}
+
+// Func returns the function of the operation, or nil when the mode does not support it.
+func (m *Mode) Func(operation Operation) Func {
+	switch operation {
+	case Eval:
+		return m.Eval
+	case Check:
+		return m.Check
+	case Format:
+		return m.Format
+	}
+	return nil
+}
+
+// Run runs the function of the operation with the arguments, which must hold the required inputs to be evaluated.
+func (m *Mode) Run(ctx context.Context, operation Operation, args Args, opts Options) (string, error) {
+	fn := m.Func(operation)
+	if fn == nil {
+		return "", fmt.Errorf("mode %s does not support %s", m.ID(), operation)
+	}
+	if operation == Eval {
+		for _, input := range m.Inputs {
+			if input.Required && len(args.Input(input.ID)) == 0 {
+				return "", fmt.Errorf("the %s input is required", input.Label)
+			}
+		}
+	}
+	return fn(ctx, args, opts)
+}
+
+// MarshalJSON encodes the mode as the front end describes it: the expression input along with the name of the mode,
+// its other inputs as tabs and the operations it supports.
+func (m *Mode) MarshalJSON() ([]byte, error) {
+	expression := m.Inputs[0]
+	operations := []Operation{}
+	for _, operation := range Operations {
+		if m.Func(operation) != nil {
+			operations = append(operations, operation)
+		}
+	}
+	return json.Marshal(struct {
+		ID         string      `json:"id"`
+		Name       string      `json:"name"`
+		Language   string      `json:"mode"`
+		Example    string      `json:"example,omitempty"`
+		Tabs       []Input     `json:"tabs"`
+		Operations []Operation `json:"operations"`
+	}{expression.ID, m.Name, expression.Language, expression.Example, m.Inputs[1:], operations})
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modes_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/undistro/cel-playground/modes"
+	"gopkg.in/yaml.v3"
+)
+
+type args map[string]string
+
+func (a args) Input(id string) []byte {
+	return []byte(a[id])
+}
+
+func (a args) Flag(name string) bool {
+	return a[name] == "true"
+}
+
+func (a args) Int(string) (int, bool) {
+	return 0, false
+}
+
+func TestExamples(t *testing.T) {
+	for _, mode := range modes.All() {
+		t.Run(mode.ID(), func(t *testing.T) {
+			data, err := os.ReadFile("../" + mode.Examples)
+			if err != nil {
+				t.Fatalf("failed to read the examples: %v", err)
+			}
+			var examples struct {
+				Examples []map[string]any `yaml:"examples"`
+			}
+			if err := yaml.Unmarshal(data, &examples); err != nil {
+				t.Fatalf("failed to decode the examples: %v", err)
+			}
+			if len(examples.Examples) == 0 {
+				t.Fatalf("expected examples")
+			}
+			ids := map[string]bool{"name": true, "category": true}
+			for _, input := range mode.Inputs {
+				ids[input.ID] = true
+			}
+			for _, example := range examples.Examples {
+				for key := range example {
+					if !ids[key] {
+						t.Errorf("example %v sets %s, which is not an input of the mode", example["name"], key)
+					}
+				}
+			}
+			if modes.Get(mode.ID()) != mode {
+				t.Errorf("expected the mode to be registered by its ID")
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	mode := modes.Get("cel")
+	output, err := mode.Run(context.Background(), modes.Eval, args{"cel": "object.replicas > 1", "dataInput": "object: {replicas: 2}"}, modes.Options{})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if !strings.Contains(output, `"result":true`) {
+		t.Errorf("expected the expression to be true, got %s", output)
+	}
+	if _, err := mode.Run(context.Background(), modes.Eval, args{}, modes.Options{}); err == nil || !strings.Contains(err.Error(), "required") {
+		t.Errorf("expected the expression to be required, got %v", err)
+	}
+	if _, err := modes.Get("vap").Run(context.Background(), modes.Check, args{"vap": "{}"}, modes.Options{}); err == nil {
+		t.Errorf("expected validating admission policies not to be checked")
+	}
+}
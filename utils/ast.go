@@ -0,0 +1,307 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// VisitExpr walks the expression tree in depth-first order, the children of an expression are only visited when
+// visit returns true for it.
+func VisitExpr(expr *exprpb.Expr, visit func(expr *exprpb.Expr) bool) {
+	if expr == nil || !visit(expr) {
+		return
+	}
+	switch e := expr.GetExprKind().(type) {
+	case *exprpb.Expr_SelectExpr:
+		VisitExpr(e.SelectExpr.GetOperand(), visit)
+	case *exprpb.Expr_CallExpr:
+		VisitExpr(e.CallExpr.GetTarget(), visit)
+		for _, arg := range e.CallExpr.GetArgs() {
+			VisitExpr(arg, visit)
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, elem := range e.ListExpr.GetElements() {
+			VisitExpr(elem, visit)
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range e.StructExpr.GetEntries() {
+			VisitExpr(entry.GetMapKey(), visit)
+			VisitExpr(entry.GetValue(), visit)
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		VisitExpr(e.ComprehensionExpr.GetIterRange(), visit)
+		VisitExpr(e.ComprehensionExpr.GetAccuInit(), visit)
+		VisitExpr(e.ComprehensionExpr.GetLoopCondition(), visit)
+		VisitExpr(e.ComprehensionExpr.GetLoopStep(), visit)
+		VisitExpr(e.ComprehensionExpr.GetResult(), visit)
+	}
+}
+
+// SelectPath returns the qualified name of a chain of field selections on an identifier, such as 'variables.foo',
+// or false when the expression is not such a chain.
+func SelectPath(expr *exprpb.Expr) (string, bool) {
+	switch e := expr.GetExprKind().(type) {
+	case *exprpb.Expr_IdentExpr:
+		return e.IdentExpr.GetName(), true
+	case *exprpb.Expr_SelectExpr:
+		if e.SelectExpr.GetTestOnly() {
+			return "", false
+		}
+		if operand, ok := SelectPath(e.SelectExpr.GetOperand()); ok {
+			return operand + "." + e.SelectExpr.GetField(), true
+		}
+	}
+	return "", false
+}
+
+// References returns the sorted names of the declared variables and of the functions referenced by a checked
+// expression. Operators and local variables, such as comprehension variables, are left out.
+func References(checked *exprpb.CheckedExpr, declared []string) (variables []string, functions []string) {
+	isDeclared := map[string]bool{}
+	for _, name := range declared {
+		isDeclared[name] = true
+	}
+	variableSet, functionSet := map[string]bool{}, map[string]bool{}
+	VisitExpr(checked.GetExpr(), func(expr *exprpb.Expr) bool {
+		reference := checked.GetReferenceMap()[expr.GetId()]
+		if call := expr.GetCallExpr(); call != nil && len(reference.GetOverloadId()) > 0 && !isOperator(call.GetFunction()) {
+			functionSet[call.GetFunction()] = true
+		} else if name := reference.GetName(); name != "" && isDeclared[name] {
+			variableSet[name] = true
+		}
+		return true
+	})
+	return sortedKeys(variableSet), sortedKeys(functionSet)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Span is a range of characters of an expression source, End being exclusive.
+type Span struct {
+	Start int
+	End   int
+}
+
+// ExprSpans returns the source span of every expression of the tree, as character offsets in the source.
+// The parser only records the position of the operator of an expression, e.g. the '(' of a call, so spans are computed
+// from the positions of the operands and from the source. Macro expansions, such as 'all' or 'has', span the original
+// call, which requires the source info to track macro calls.
+func ExprSpans(expr *exprpb.Expr, info *exprpb.SourceInfo, source string) map[int64]Span {
+	s := &spanner{info: info, source: []rune(source), spans: map[int64]Span{}}
+	s.span(expr)
+	return s.spans
+}
+
+type spanner struct {
+	info   *exprpb.SourceInfo
+	source []rune
+	spans  map[int64]Span
+}
+
+func (s *spanner) span(expr *exprpb.Expr) (Span, bool) {
+	if expr == nil {
+		return Span{}, false
+	}
+	span, ok := s.exprSpan(expr)
+	if ok {
+		s.spans[expr.GetId()] = span
+	}
+	return span, ok
+}
+
+func (s *spanner) exprSpan(expr *exprpb.Expr) (Span, bool) {
+	offset, hasOffset := s.info.GetPositions()[expr.GetId()]
+	b := spanBuilder{start: -1, end: -1}
+	if macro, ok := s.info.GetMacroCalls()[expr.GetId()]; ok {
+		expr = &exprpb.Expr{Id: expr.GetId(), ExprKind: macro.GetExprKind()}
+	}
+	if !hasOffset {
+		offset = -1
+	}
+	at := int(offset)
+
+	switch e := expr.GetExprKind().(type) {
+	case *exprpb.Expr_ConstExpr:
+		if at >= 0 {
+			b.add(at, s.scanLiteral(at))
+		}
+	case *exprpb.Expr_IdentExpr:
+		if name := e.IdentExpr.GetName(); at >= 0 {
+			// checked expressions resolve qualified names, e.g. 'variables.foo', positioned at their last dot
+			if dot := strings.LastIndex(name, "."); dot > 0 {
+				b.add(at-utf8.RuneCountInString(name[:dot]), at+utf8.RuneCountInString(name[dot:]))
+			} else {
+				b.add(at, at+utf8.RuneCountInString(name))
+			}
+		}
+	case *exprpb.Expr_SelectExpr:
+		b.merge(s.span(e.SelectExpr.GetOperand()))
+		if at >= 0 {
+			b.add(at, s.scanIdentifier(at+1))
+		}
+	case *exprpb.Expr_CallExpr:
+		function := e.CallExpr.GetFunction()
+		b.merge(s.span(e.CallExpr.GetTarget()))
+		for _, arg := range e.CallExpr.GetArgs() {
+			b.merge(s.span(arg))
+		}
+		if at >= 0 {
+			b.add(at, at+1)
+			switch {
+			case function == "_[_]" || function == "_[?_]":
+				b.end = s.scanClosing(b.end, ']')
+			case !isOperator(function):
+				if e.CallExpr.GetTarget() == nil {
+					b.add(at-utf8.RuneCountInString(function), at)
+				}
+				b.end = s.scanClosing(b.end, ')')
+			}
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, elem := range e.ListExpr.GetElements() {
+			b.merge(s.span(elem))
+		}
+		if at >= 0 {
+			b.add(at, at+1)
+			b.end = s.scanClosing(b.end, ']')
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range e.StructExpr.GetEntries() {
+			b.merge(s.span(entry.GetMapKey()))
+			b.merge(s.span(entry.GetValue()))
+		}
+		if at >= 0 {
+			b.add(at-utf8.RuneCountInString(e.StructExpr.GetMessageName()), at+1)
+			b.end = s.scanClosing(b.end, '}')
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		b.merge(s.span(e.ComprehensionExpr.GetIterRange()))
+		b.merge(s.span(e.ComprehensionExpr.GetLoopStep()))
+	}
+	return Span{Start: b.start, End: b.end}, b.start >= 0
+}
+
+// scanLiteral returns the end of the literal starting at offset.
+func (s *spanner) scanLiteral(offset int) int {
+	i, raw := offset, false
+	for i < len(s.source) && strings.ContainsRune("rRbB", s.source[i]) {
+		raw = raw || s.source[i] == 'r' || s.source[i] == 'R'
+		i++
+	}
+	if i >= len(s.source) || (s.source[i] != '"' && s.source[i] != '\'') {
+		i = offset
+		if i < len(s.source) && s.source[i] == '-' {
+			i++
+		}
+		for i < len(s.source) && (isIdentifierRune(s.source[i]) || s.source[i] == '.' ||
+			(strings.ContainsRune("+-", s.source[i]) && strings.ContainsRune("eE", s.source[i-1]))) {
+			i++
+		}
+		return i
+	}
+	quote := []rune{s.source[i]}
+	if s.hasPrefix(i, []rune{quote[0], quote[0], quote[0]}) {
+		quote = []rune{quote[0], quote[0], quote[0]}
+	}
+	for i += len(quote); i < len(s.source); i++ {
+		if s.source[i] == '\\' && !raw {
+			i++
+		} else if s.hasPrefix(i, quote) {
+			return i + len(quote)
+		}
+	}
+	return len(s.source)
+}
+
+func (s *spanner) hasPrefix(offset int, prefix []rune) bool {
+	if offset+len(prefix) > len(s.source) {
+		return false
+	}
+	for i, r := range prefix {
+		if s.source[offset+i] != r {
+			return false
+		}
+	}
+	return true
+}
+
+// scanIdentifier returns the end of the identifier starting at offset, after any whitespace.
+func (s *spanner) scanIdentifier(offset int) int {
+	i := s.skipSpaces(offset)
+	for i < len(s.source) && isIdentifierRune(s.source[i]) {
+		i++
+	}
+	return i
+}
+
+// scanClosing returns the end of the closing bracket following offset, or offset when there is none.
+func (s *spanner) scanClosing(offset int, closing rune) int {
+	i := offset
+	for i < len(s.source) && (unicode.IsSpace(s.source[i]) || s.source[i] == ',') {
+		i++
+	}
+	if i < len(s.source) && s.source[i] == closing {
+		return i + 1
+	}
+	return offset
+}
+
+func (s *spanner) skipSpaces(offset int) int {
+	for offset < len(s.source) && unicode.IsSpace(s.source[offset]) {
+		offset++
+	}
+	return offset
+}
+
+type spanBuilder struct {
+	start int
+	end   int
+}
+
+func (b *spanBuilder) add(start, end int) {
+	if start < 0 {
+		start = 0
+	}
+	if b.start < 0 || start < b.start {
+		b.start = start
+	}
+	if end > b.end {
+		b.end = end
+	}
+}
+
+func (b *spanBuilder) merge(span Span, ok bool) {
+	if ok {
+		b.add(span.Start, span.End)
+	}
+}
+
+// isOperator reports whether the function is an operator, such as '_+_', '!_' or '@in', rather than a named function.
+func isOperator(function string) bool {
+	return strings.HasPrefix(function, "_") || strings.HasSuffix(function, "_") || strings.HasPrefix(function, "@")
+}
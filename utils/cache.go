@@ -0,0 +1,84 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// Cache is a size bounded, least recently used cache safe for concurrent use.
+// It is used to keep compiled CEL programs around between evaluations.
+type Cache[V any] struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type cacheEntry[V any] struct {
+	key   string
+	value V
+}
+
+func NewCache[V any](size int) *Cache[V] {
+	return &Cache[V]{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Get returns the value stored for the key, marking it as recently used.
+func (c *Cache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*cacheEntry[V]).value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Add stores the value for the key, evicting the least recently used entry when the cache is full.
+func (c *Cache[V]) Add(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry[V]).value = value
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry[V]{key: key, value: value})
+	for c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry[V]).key)
+	}
+}
+
+// Len returns the number of cached entries.
+func (c *Cache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// CacheKey joins the parts identifying a compiled program into a single cache key.
+func CacheKey(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
@@ -17,7 +17,10 @@ package utils
 import (
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"strconv"
+	"time"
 
 	"github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
@@ -30,11 +33,57 @@ type conversionTraits interface {
 	traits.Indexer
 }
 
-var stringType = reflect.TypeOf("")
+var jsonValueType = reflect.TypeOf(&structpb.Value{})
 
+// ConvertValToNative converts a CEL value into a value which can be encoded to JSON without losing information:
+//   - ints and uints become decimal strings, as in protobuf JSON, since JSON numbers lose precision beyond 2^53
+//   - doubles which JSON can not represent become the strings "NaN", "Infinity" and "-Infinity"
+//   - bytes are base64 encoded by the JSON encoder
+//   - timestamps become RFC 3339 strings and durations strings in seconds, e.g. "1.5s"
+//   - types become their name, e.g. "int"
+//   - optionals become their value, or nil when empty
+//   - opaque values, such as quantities, URLs, IPs and CIDRs, become their string representation
+//
+// Messages and other values are converted with their JSON conversion. See TypeName for the type of the value.
 func ConvertValToNative(val ref.Val) (any, error) {
-	valType := val.Type()
-	switch valType {
+	switch val := val.(type) {
+	case types.Bool:
+		return bool(val), nil
+	case types.Int:
+		return strconv.FormatInt(int64(val), 10), nil
+	case types.Uint:
+		return strconv.FormatUint(uint64(val), 10), nil
+	case types.Double:
+		switch f := float64(val); {
+		case math.IsNaN(f):
+			return "NaN", nil
+		case math.IsInf(f, 1):
+			return "Infinity", nil
+		case math.IsInf(f, -1):
+			return "-Infinity", nil
+		default:
+			return f, nil
+		}
+	case types.String:
+		return string(val), nil
+	case types.Bytes:
+		return []byte(val), nil
+	case types.Null:
+		return nil, nil
+	case types.Timestamp:
+		return val.Time.Format(time.RFC3339Nano), nil
+	case types.Duration:
+		return val.ConvertToType(types.StringType).Value(), nil
+	case ref.Type:
+		return val.TypeName(), nil
+	case *types.Optional:
+		if !val.HasValue() {
+			return nil, nil
+		}
+		return ConvertValToNative(val.GetValue())
+	}
+
+	switch val.Type() {
 	case types.ListType:
 		if iterable, ok := val.(conversionTraits); !ok {
 			return nil, errors.New("type conversion error from list to iterable")
@@ -58,30 +107,37 @@ func ConvertValToNative(val ref.Val) (any, error) {
 			iter := iterable.Iterator()
 			for iter.HasNext() == types.True {
 				keyVal := iter.Next()
-				if key, err := keyVal.ConvertToNative(stringType); err != nil {
+				if key, ok := keyVal.ConvertToType(types.StringType).(types.String); !ok {
 					return nil, fmt.Errorf("unexpected map key type: %v", keyVal.Type())
 				} else if value, err := ConvertValToNative(iterable.Get(keyVal)); err != nil {
 					return nil, err
 				} else {
-					values[key.(string)] = value
+					values[string(key)] = value
 				}
 			}
 			return values, nil
 		}
-	case types.OptionalType:
-		opt, ok := val.(*types.Optional)
-		if !ok {
-			return nil, errors.New("type conversion error for optional")
-		} else if !opt.HasValue() {
-			return nil, nil
-		}
-		val = opt.GetValue()
-		fallthrough
-	default:
-		if value, err := val.ConvertToNative(reflect.TypeOf(&structpb.Value{})); err != nil {
-			return nil, err
-		} else {
-			return value, nil
+	}
+
+	if value, err := val.ConvertToNative(jsonValueType); err == nil {
+		return value, nil
+	} else if s, ok := val.ConvertToType(types.StringType).(types.String); ok {
+		return string(s), nil
+	} else if stringer, ok := val.Value().(fmt.Stringer); ok {
+		return stringer.String(), nil
+	} else {
+		return nil, err
+	}
+}
+
+// TypeName returns the name of the CEL type of the value, as the type() function does, e.g. "int", "list",
+// "google.protobuf.Timestamp" or "kubernetes.Quantity". Optional values are named after the type of their value.
+func TypeName(val ref.Val) string {
+	if optional, ok := val.(*types.Optional); ok {
+		if !optional.HasValue() {
+			return "optional_type"
 		}
+		return "optional_type(" + TypeName(optional.GetValue()) + ")"
 	}
+	return val.Type().TypeName()
 }
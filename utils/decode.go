@@ -0,0 +1,305 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	typeAnnotationKey  = "@type"
+	valueAnnotationKey = "value"
+
+	durationTag = "!duration"
+	uintTag     = "!uint"
+)
+
+// Decode decodes a YAML or JSON document whose root is a map, keeping the values CEL has native types for:
+//   - timestamps, plain or tagged with '!!timestamp', become time.Time, quoted ones are kept as strings
+//   - '!!binary' values become []byte
+//   - values tagged with '!duration', in Go duration format, become time.Duration
+//   - values tagged with '!uint', and integers too large for int64, become uint64
+//
+// As JSON has no tags, the same values can be given as a map annotated with their type, e.g.
+// '{"@type": "timestamp", "value": "2023-10-13T20:32:04Z"}', where the type is one of timestamp, duration, bytes
+// (base64 encoded) and uint. An empty document decodes to a nil map.
+func Decode(input []byte) (map[string]any, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(input, &root); err != nil {
+		return nil, err
+	}
+	return decodeDocument(&root)
+}
+
+// DecodeDocuments decodes each document of a YAML stream as Decode does, skipping the empty ones.
+func DecodeDocuments(input []byte) ([]map[string]any, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(input))
+	var documents []map[string]any
+	for {
+		var root yaml.Node
+		if err := decoder.Decode(&root); errors.Is(err, io.EOF) {
+			return documents, nil
+		} else if err != nil {
+			return nil, err
+		}
+		document, err := decodeDocument(&root)
+		if err != nil {
+			return nil, err
+		}
+		if document != nil {
+			documents = append(documents, document)
+		}
+	}
+}
+
+// ListItems returns the items of a Kubernetes List, a document with an apiVersion, a kind ending with List, e.g. List
+// or PodList, and a list of items. ok is false for other documents.
+func ListItems(document map[string]any) (items []map[string]any, ok bool, err error) {
+	_, hasAPIVersion := document["apiVersion"].(string)
+	kind, _ := document["kind"].(string)
+	list, hasItems := document["items"].([]any)
+	if !hasAPIVersion || !strings.HasSuffix(kind, "List") || !hasItems {
+		return nil, false, nil
+	}
+	items = make([]map[string]any, 0, len(list))
+	for i, item := range list {
+		object, isObject := item.(map[string]any)
+		if !isObject {
+			return nil, true, fmt.Errorf("item %d of the %s is not an object", i, kind)
+		}
+		items = append(items, object)
+	}
+	return items, true, nil
+}
+
+func decodeDocument(root *yaml.Node) (map[string]any, error) {
+	if len(root.Content) == 0 {
+		return nil, nil
+	}
+	value, err := decodeNode(root.Content[0])
+	if err != nil {
+		return nil, err
+	}
+	switch value := value.(type) {
+	case map[string]any:
+		return value, nil
+	case nil:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("line %d: expected a map, got %T", root.Content[0].Line, value)
+	}
+}
+
+func decodeNode(node *yaml.Node) (any, error) {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return decodeNode(node.Alias)
+	case yaml.SequenceNode:
+		values := make([]any, 0, len(node.Content))
+		for _, elem := range node.Content {
+			value, err := decodeNode(elem)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case yaml.MappingNode:
+		return decodeMapping(node)
+	case yaml.ScalarNode:
+		return decodeScalar(node)
+	}
+	var value any
+	err := node.Decode(&value)
+	return value, err
+}
+
+func decodeMapping(node *yaml.Node) (any, error) {
+	entries := map[any]any{}
+	keys := []any{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		if keyNode.ShortTag() == "!!merge" {
+			if err := mergeMappings(valueNode, entries, &keys); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		key, err := decodeNode(keyNode)
+		if err != nil {
+			return nil, err
+		}
+		value, err := decodeNode(valueNode)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := entries[key]; !ok {
+			keys = append(keys, key)
+		}
+		entries[key] = value
+	}
+
+	if value, ok, err := decodeAnnotated(node, entries); ok || err != nil {
+		return value, err
+	}
+	return newMap(keys, entries), nil
+}
+
+// mergeMappings adds the entries of the merged mappings, which are overridden by the entries of the mapping itself.
+func mergeMappings(node *yaml.Node, entries map[any]any, keys *[]any) error {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.SequenceNode {
+		for _, elem := range node.Content {
+			if err := mergeMappings(elem, entries, keys); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	value, err := decodeNode(node)
+	if err != nil {
+		return err
+	}
+	mapping, ok := value.(map[string]any)
+	if !ok {
+		return fmt.Errorf("line %d: map merge requires a map", node.Line)
+	}
+	for key, elem := range mapping {
+		if _, ok := entries[key]; !ok {
+			*keys = append(*keys, key)
+			entries[key] = elem
+		}
+	}
+	return nil
+}
+
+// newMap returns a map with string keys, as yaml.v3 does, unless some keys are not strings.
+func newMap(keys []any, entries map[any]any) any {
+	stringEntries := make(map[string]any, len(entries))
+	for _, key := range keys {
+		s, ok := key.(string)
+		if !ok {
+			return entries
+		}
+		stringEntries[s] = entries[key]
+	}
+	return stringEntries
+}
+
+// decodeAnnotated decodes a map annotated with its type, it returns false when the map is not annotated.
+func decodeAnnotated(node *yaml.Node, entries map[any]any) (any, bool, error) {
+	typeName, ok := entries[typeAnnotationKey].(string)
+	if !ok || len(entries) != 2 {
+		return nil, false, nil
+	}
+	value, ok := entries[valueAnnotationKey]
+	if !ok {
+		return nil, false, nil
+	}
+	var decoded any
+	var err error
+	switch typeName {
+	case "timestamp":
+		decoded, err = parseTypedString(value, parseTimestamp)
+	case "duration":
+		decoded, err = parseTypedString(value, parseDuration)
+	case "bytes":
+		decoded, err = parseTypedString(value, parseBytes)
+	case "uint":
+		switch v := value.(type) {
+		case uint64:
+			return v, true, nil
+		case int:
+			if v < 0 {
+				return nil, true, fmt.Errorf("line %d: invalid uint: negative value %d", node.Line, v)
+			}
+			return uint64(v), true, nil
+		}
+		decoded, err = parseTypedString(value, parseUint)
+	default:
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, fmt.Errorf("line %d: invalid %s: %w", node.Line, typeName, err)
+	}
+	return decoded, true, nil
+}
+
+func parseTypedString(value any, parse func(string) (any, error)) (any, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a string, got %T", value)
+	}
+	return parse(s)
+}
+
+func decodeScalar(node *yaml.Node) (any, error) {
+	if node.Style&yaml.TaggedStyle != 0 {
+		var parse func(string) (any, error)
+		switch node.ShortTag() {
+		case "!!timestamp":
+			parse = parseTimestamp
+		case "!!binary":
+			parse = parseBytes
+		case durationTag:
+			parse = parseDuration
+		case uintTag:
+			parse = parseUint
+		}
+		if parse != nil {
+			value, err := parse(node.Value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid %s value: %w", node.Line, node.ShortTag(), err)
+			}
+			return value, nil
+		}
+	}
+	var value any
+	if err := node.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func parseTimestamp(s string) (any, error) {
+	var timestamp time.Time
+	if err := (&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!timestamp", Value: s}).Decode(&timestamp); err != nil {
+		return nil, err
+	}
+	return timestamp, nil
+}
+
+func parseDuration(s string) (any, error) {
+	return time.ParseDuration(s)
+}
+
+func parseBytes(s string) (any, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+func parseUint(s string) (any, error) {
+	return strconv.ParseUint(s, 0, 64)
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	"github.com/google/cel-go/cel"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	SeverityInfo    Severity = "info"
+)
+
+// Position is a 1-based line and column within an expression, columns are counted in characters.
+type Position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Diagnostic describes a problem found in an expression.
+// Path is the YAML path of the field holding the expression, e.g. 'spec.validations[2].expression', and is empty
+// for standalone expressions. Start and End delimit the offending span within the expression, End being exclusive,
+// and are omitted when the problem has no location, e.g. most evaluation errors.
+// Findings of the lint rules also have the identifier of their rule and a suggested fix, see Lint.
+type Diagnostic struct {
+	Severity Severity  `json:"severity"`
+	Message  string    `json:"message"`
+	Path     string    `json:"path,omitempty"`
+	Start    *Position `json:"start,omitempty"`
+	End      *Position `json:"end,omitempty"`
+	Rule     string    `json:"rule,omitempty"`
+	Fix      string    `json:"fix,omitempty"`
+}
+
+// DiagnosticsError is an error carrying the diagnostics of the failure, its message is the one of the wrapped error.
+type DiagnosticsError struct {
+	err         error
+	Diagnostics []Diagnostic
+}
+
+func NewDiagnosticsError(err error, diagnostics []Diagnostic) *DiagnosticsError {
+	return &DiagnosticsError{err: err, Diagnostics: diagnostics}
+}
+
+func (e *DiagnosticsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *DiagnosticsError) Unwrap() error {
+	return e.err
+}
+
+// ErrorDiagnostics returns the diagnostics carried by the error, or a single diagnostic with its message otherwise.
+func ErrorDiagnostics(err error) []Diagnostic {
+	var diagnosticsErr *DiagnosticsError
+	if errors.As(err, &diagnosticsErr) {
+		return diagnosticsErr.Diagnostics
+	}
+	return []Diagnostic{{Severity: SeverityError, Message: err.Error()}}
+}
+
+// IssuesDiagnostics converts the issues reported for the expression into diagnostics for the given path.
+// The span of an issue covers the identifier at its location, including the dot of field selections which are located
+// at their operator, or a single character otherwise.
+func IssuesDiagnostics(expression, path string, issues *cel.Issues) []Diagnostic {
+	if issues == nil {
+		return nil
+	}
+	lines := strings.Split(expression, "\n")
+	diagnostics := []Diagnostic{}
+	for _, issue := range issues.Errors() {
+		diagnostic := Diagnostic{Severity: SeverityError, Message: issue.Message, Path: path}
+		if line := issue.Location.Line(); line > 0 && line <= len(lines) {
+			start, end := issue.Location.Column(), issue.Location.Column()
+			runes := []rune(lines[line-1])
+			if end < len(runes) && runes[end] == '.' {
+				end++
+			}
+			for end < len(runes) && isIdentifierRune(runes[end]) {
+				end++
+			}
+			if end == start {
+				end++
+			}
+			diagnostic.Start = &Position{Line: line, Column: start + 1}
+			diagnostic.End = &Position{Line: line, Column: end + 1}
+		}
+		diagnostics = append(diagnostics, diagnostic)
+	}
+	return diagnostics
+}
+
+func isIdentifierRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
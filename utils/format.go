@@ -0,0 +1,364 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/parser"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+const formatIndent = "  "
+
+// FormatExpr prints the parsed expression back as CEL source, breaking the expressions which do not fit within the
+// width: chains of '&&' and '||' get an operand per line, conditionals a branch per line, and macros, calls, lists,
+// maps and messages an argument or element per line. Other expressions are printed on a single line.
+// Comments of the source are kept before the expression they precede when it starts a line, and at the top otherwise.
+// The source info must track macro calls.
+func FormatExpr(parsed *exprpb.ParsedExpr, source string, width int) (string, error) {
+	f := &formatter{
+		info:     parsed.GetSourceInfo(),
+		width:    width,
+		comments: map[int64][]string{},
+	}
+	trailing := f.attachComments(parsed.GetExpr(), source)
+	formatted := f.lineStart(parsed.GetExpr(), "")
+	if f.err != nil {
+		return "", f.err
+	}
+
+	var lines []string
+	for _, id := range f.commented {
+		lines = append(lines, f.comments[id]...)
+	}
+	lines = append(lines, formatted)
+	lines = append(lines, trailing...)
+	return strings.Join(lines, "\n"), nil
+}
+
+type formatter struct {
+	info  *exprpb.SourceInfo
+	width int
+	// comments are the comments preceding an expression, by expression id, and commented the ids whose comments are
+	// yet to be printed, in source order.
+	comments  map[int64][]string
+	commented []int64
+	err       error
+}
+
+// attachComments attaches the comments of the source to the outermost expression following them, and returns the
+// comments following the whole expression.
+func (f *formatter) attachComments(expr *exprpb.Expr, source string) []string {
+	spans := ExprSpans(expr, f.info, source)
+	s := &spanner{source: []rune(source)}
+	var pending []string
+	for i := 0; i < len(s.source); {
+		switch {
+		case s.source[i] == '"' || s.source[i] == '\'':
+			start := i
+			for start > 0 && i-start < 2 && strings.ContainsRune("rRbB", s.source[start-1]) {
+				start--
+			}
+			i = s.scanLiteral(start)
+		case s.hasPrefix(i, []rune("//")):
+			end := i
+			for end < len(s.source) && s.source[end] != '\n' {
+				end++
+			}
+			pending = append(pending, strings.TrimRightFunc(string(s.source[i:end]), isSpace))
+			i = end
+		case len(pending) > 0 && !isSpace(s.source[i]):
+			if id, ok := outermostFrom(spans, i); ok {
+				f.comments[id] = append(f.comments[id], pending...)
+				f.commented = append(f.commented, id)
+				pending = nil
+			}
+			i++
+		default:
+			i++
+		}
+	}
+	return pending
+}
+
+// outermostFrom returns the id of the outermost expression starting at or after the offset.
+func outermostFrom(spans map[int64]Span, offset int) (int64, bool) {
+	ids := make([]int64, 0, len(spans))
+	for id, span := range spans {
+		if span.Start >= offset {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, false
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := spans[ids[i]], spans[ids[j]]
+		if a.Start != b.Start {
+			return a.Start < b.Start
+		}
+		if a.End != b.End {
+			return a.End > b.End
+		}
+		return ids[i] < ids[j]
+	})
+	return ids[0], true
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// lineStart formats an expression starting a line, after the comments preceding it.
+func (f *formatter) lineStart(expr *exprpb.Expr, indent string) string {
+	var b strings.Builder
+	if comments, ok := f.comments[expr.GetId()]; ok {
+		for _, comment := range comments {
+			b.WriteString(comment + "\n" + indent)
+		}
+		f.printed(expr.GetId())
+	}
+	b.WriteString(f.format(expr, indent, len(indent)))
+	return b.String()
+}
+
+func (f *formatter) printed(id int64) {
+	for i, commented := range f.commented {
+		if commented == id {
+			f.commented = append(f.commented[:i], f.commented[i+1:]...)
+			return
+		}
+	}
+}
+
+// format formats an expression starting at the column of a line whose following lines are indented with indent.
+func (f *formatter) format(expr *exprpb.Expr, indent string, column int) string {
+	flat := f.flat(expr)
+	if column+utf8.RuneCountInString(flat) <= f.width && !f.hasInnerComments(expr) {
+		return flat
+	}
+
+	if macro, ok := f.info.GetMacroCalls()[expr.GetId()]; ok {
+		return f.formatCall(macro.GetCallExpr(), indent, true)
+	}
+	switch kind := expr.GetExprKind().(type) {
+	case *exprpb.Expr_CallExpr:
+		switch function := kind.CallExpr.GetFunction(); function {
+		case operators.LogicalAnd, operators.LogicalOr:
+			return f.formatChain(expr, function, indent)
+		case operators.Conditional:
+			return f.formatConditional(kind.CallExpr, indent)
+		default:
+			if !isOperator(function) {
+				return f.formatCall(kind.CallExpr, indent, false)
+			}
+		}
+	case *exprpb.Expr_ListExpr:
+		optional := map[int32]bool{}
+		for _, index := range kind.ListExpr.GetOptionalIndices() {
+			optional[index] = true
+		}
+		elements := make([]string, len(kind.ListExpr.GetElements()))
+		for i, element := range kind.ListExpr.GetElements() {
+			prefix := ""
+			if optional[int32(i)] {
+				prefix = "?"
+			}
+			elements[i] = prefix + f.lineStart(element, indent+formatIndent)
+		}
+		return f.block("[", elements, "]", indent)
+	case *exprpb.Expr_StructExpr:
+		entries := make([]string, len(kind.StructExpr.GetEntries()))
+		for i, entry := range kind.StructExpr.GetEntries() {
+			key := entry.GetFieldKey()
+			if entry.GetMapKey() != nil {
+				key = f.flat(entry.GetMapKey())
+			}
+			if entry.GetOptionalEntry() {
+				key = "?" + key
+			}
+			entryIndent := indent + formatIndent
+			entries[i] = key + ": " + f.format(entry.GetValue(), entryIndent, len(entryIndent)+len(key)+2)
+		}
+		return f.block(kind.StructExpr.GetMessageName()+"{", entries, "}", indent)
+	}
+	return flat
+}
+
+// formatChain formats a chain of the same logical operator with an operand per line, the operator leading the line.
+func (f *formatter) formatChain(expr *exprpb.Expr, function, indent string) string {
+	symbol, _ := operators.FindReverseBinaryOperator(function)
+	operands := chainOperands(expr, function)
+	var b strings.Builder
+	for i, operand := range operands {
+		operandIndent := indent
+		if i > 0 {
+			b.WriteString("\n" + indent)
+			if comments, ok := f.comments[operand.GetId()]; ok {
+				for _, comment := range comments {
+					b.WriteString(comment + "\n" + indent)
+				}
+				f.printed(operand.GetId())
+			}
+			b.WriteString(symbol + " ")
+			operandIndent = indent + strings.Repeat(" ", len(symbol)+1)
+		}
+		b.WriteString(f.nested(operand, function, operandIndent))
+	}
+	return b.String()
+}
+
+func chainOperands(expr *exprpb.Expr, function string) []*exprpb.Expr {
+	call := expr.GetCallExpr()
+	if call == nil || call.GetFunction() != function {
+		return []*exprpb.Expr{expr}
+	}
+	var operands []*exprpb.Expr
+	for _, arg := range call.GetArgs() {
+		operands = append(operands, chainOperands(arg, function)...)
+	}
+	return operands
+}
+
+// nested formats an operand of the operator, in parentheses when its precedence is lower.
+func (f *formatter) nested(expr *exprpb.Expr, function string, indent string) string {
+	return f.operand(expr, function, false, indent)
+}
+
+// operand formats an operand of the operator, in parentheses when its precedence is lower, or as low when inclusive
+// is set, as for the condition and the first branch of a conditional, which only the last branch can nest unparenthesized.
+func (f *formatter) operand(expr *exprpb.Expr, function string, inclusive bool, indent string) string {
+	if call := expr.GetCallExpr(); call != nil && !f.isMacro(expr) && operators.Precedence(call.GetFunction()) > 0 {
+		precedence, parent := operators.Precedence(call.GetFunction()), operators.Precedence(function)
+		if precedence > parent || inclusive && precedence == parent {
+			return "(" + f.format(expr, indent+" ", len(indent)+1) + ")"
+		}
+	}
+	return f.format(expr, indent, len(indent))
+}
+
+// formatConditional formats a conditional with a branch per line.
+func (f *formatter) formatConditional(call *exprpb.Expr_Call, indent string) string {
+	args := call.GetArgs()
+	branchIndent := indent + formatIndent
+	return f.operand(args[0], operators.Conditional, true, indent) +
+		"\n" + branchIndent + "? " + f.operand(args[1], operators.Conditional, true, branchIndent+formatIndent) +
+		"\n" + branchIndent + ": " + f.format(args[2], branchIndent+formatIndent, len(branchIndent)+2)
+}
+
+// formatCall formats a function or macro call with an argument per line, the iteration variable of macros staying
+// on the line of the call.
+func (f *formatter) formatCall(call *exprpb.Expr_Call, indent string, macro bool) string {
+	prefix := call.GetFunction() + "("
+	if target := call.GetTarget(); target != nil {
+		prefix = f.nested(target, operators.Index, indent) + "." + prefix
+	}
+	args := call.GetArgs()
+	if len(args) == 0 {
+		return prefix + ")"
+	}
+	if macro && len(args) > 1 {
+		prefix += f.flat(args[0]) + ","
+		args = args[1:]
+	}
+	lines := make([]string, len(args))
+	for i, arg := range args {
+		lines[i] = f.lineStart(arg, indent+formatIndent)
+	}
+	return f.block(prefix, lines, ")", indent)
+}
+
+// block formats the elements of a call, a list or a map with an element per line.
+func (f *formatter) block(open string, elements []string, closing string, indent string) string {
+	if len(elements) == 0 {
+		return open + closing
+	}
+	var b strings.Builder
+	b.WriteString(open)
+	for i, element := range elements {
+		b.WriteString("\n" + indent + formatIndent + element)
+		if i < len(elements)-1 {
+			b.WriteString(",")
+		}
+	}
+	b.WriteString("\n" + indent + closing)
+	return b.String()
+}
+
+func (f *formatter) isMacro(expr *exprpb.Expr) bool {
+	_, ok := f.info.GetMacroCalls()[expr.GetId()]
+	return ok
+}
+
+// hasInnerComments returns whether comments precede subexpressions of the expression, which must then start a line.
+func (f *formatter) hasInnerComments(expr *exprpb.Expr) bool {
+	found := false
+	visitFormatted(expr, f.info, func(e *exprpb.Expr) {
+		if e != expr && len(f.comments[e.GetId()]) > 0 {
+			found = true
+		}
+	})
+	return found
+}
+
+// visitFormatted visits the expressions as they are formatted, i.e. the arguments of macro calls rather than their
+// expansions.
+func visitFormatted(expr *exprpb.Expr, info *exprpb.SourceInfo, visit func(*exprpb.Expr)) {
+	if expr == nil {
+		return
+	}
+	visit(expr)
+	if macro, ok := info.GetMacroCalls()[expr.GetId()]; ok {
+		visitFormatted(macro.GetCallExpr().GetTarget(), info, visit)
+		for _, arg := range macro.GetCallExpr().GetArgs() {
+			visitFormatted(arg, info, visit)
+		}
+		return
+	}
+	switch kind := expr.GetExprKind().(type) {
+	case *exprpb.Expr_SelectExpr:
+		visitFormatted(kind.SelectExpr.GetOperand(), info, visit)
+	case *exprpb.Expr_CallExpr:
+		visitFormatted(kind.CallExpr.GetTarget(), info, visit)
+		for _, arg := range kind.CallExpr.GetArgs() {
+			visitFormatted(arg, info, visit)
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, element := range kind.ListExpr.GetElements() {
+			visitFormatted(element, info, visit)
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range kind.StructExpr.GetEntries() {
+			visitFormatted(entry.GetMapKey(), info, visit)
+			visitFormatted(entry.GetValue(), info, visit)
+		}
+	}
+}
+
+// flat prints the expression on a single line.
+func (f *formatter) flat(expr *exprpb.Expr) string {
+	if macro, ok := f.info.GetMacroCalls()[expr.GetId()]; ok && expr.GetExprKind() == nil {
+		expr = macro
+	}
+	s, err := parser.Unparse(expr, f.info)
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return s
+}
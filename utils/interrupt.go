@@ -0,0 +1,107 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter"
+)
+
+// InterruptCheckFrequency is the number of iterations of comprehensions after which evaluations check whether their
+// context is done.
+const InterruptCheckFrequency = 100
+
+// InterruptProgramOptions plan programs whose evaluations with ContextEval stop when their context is done.
+var InterruptProgramOptions = append([]cel.ProgramOption{cel.InterruptCheckFrequency(InterruptCheckFrequency)}, yieldProgramOptions...)
+
+// InterruptedError is returned when the context of an evaluation is done before the evaluation completes, Cost is the
+// runtime cost incurred until then. It wraps the error of the context, e.g. context.DeadlineExceeded.
+type InterruptedError struct {
+	err  error
+	Cost uint64
+}
+
+func NewInterruptedError(err error, cost uint64) *InterruptedError {
+	return &InterruptedError{err: err, Cost: cost}
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("evaluation interrupted after a cost of %d: %v", e.Cost, e.err)
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.err
+}
+
+// ContextEval evaluates the program, planned with InterruptProgramOptions, returning an InterruptedError when its
+// evaluation fails because the context is done.
+func ContextEval(ctx context.Context, prog cel.Program, input any) (ref.Val, *cel.EvalDetails, error) {
+	var activation interpreter.Activation
+	switch v := input.(type) {
+	case interpreter.Activation:
+		activation = v
+	case map[string]any:
+		var err error
+		if activation, err = interpreter.NewActivation(v); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return prog.Eval(input)
+	}
+	val, details, err := prog.Eval(&interruptActivation{parent: activation, done: ctx.Done()})
+	if err != nil && ctx.Err() != nil {
+		var cost uint64
+		if details != nil && details.ActualCost() != nil {
+			cost = *details.ActualCost()
+		}
+		return val, details, NewInterruptedError(ctx.Err(), cost)
+	}
+	return val, details, err
+}
+
+// interruptActivation resolves the #interrupted variable comprehensions check, as the activation of
+// cel.Program.ContextEval does, but it stays interrupted once the context is done so that the comprehensions enclosing
+// an interrupted one stop at their next iteration rather than at their next multiple of the check frequency.
+type interruptActivation struct {
+	parent      interpreter.Activation
+	done        <-chan struct{}
+	checks      uint
+	interrupted bool
+}
+
+func (a *interruptActivation) ResolveName(name string) (any, bool) {
+	if name != "#interrupted" {
+		return a.parent.ResolveName(name)
+	}
+	if !a.interrupted {
+		a.checks++
+		if a.checks%InterruptCheckFrequency == 0 {
+			select {
+			case <-a.done:
+				a.interrupted = true
+			default:
+			}
+		}
+	}
+	return a.interrupted, a.interrupted
+}
+
+func (a *interruptActivation) Parent() interpreter.Activation {
+	return a.parent
+}
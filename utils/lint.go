@@ -0,0 +1,312 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/parser"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Lint rules, the identifiers of the findings reported by Lint.
+const (
+	// RuleHasCheck reports fields of maps and objects of unknown type selected without testing their presence first.
+	RuleHasCheck = "has-check"
+	// RuleExistsAssertion reports exists() asserted on a list, which is false for empty lists and holds for a single
+	// matching element, where all() was likely meant.
+	RuleExistsAssertion = "exists-assertion"
+	// RuleDynamicRegex reports regular expressions which are not literals, and are compiled at every evaluation.
+	RuleDynamicRegex = "dynamic-regex"
+	// RuleStringSize reports size() of strings, which counts characters rather than bytes.
+	RuleStringSize = "string-size"
+	// RuleNestedComprehension reports comprehensions nested in comprehensions over unrelated lists, whose cost is
+	// quadratic in the sizes of the lists.
+	RuleNestedComprehension = "nested-comprehension"
+	// RuleMessageExpression reports static messages of validations which try to interpolate values.
+	RuleMessageExpression = "message-expression"
+)
+
+// presentFields are the fields of Kubernetes objects and requests which are always set, by path below the variable.
+var presentFields = map[string]bool{
+	"metadata.name":     true,
+	"metadata.uid":      true,
+	"userInfo.username": true,
+	"kind.kind":         true,
+	"resource.resource": true,
+}
+
+// Lint returns the findings of the lint rules for the expression found at path, see the Rule constants.
+// The AST is expected to be checked, as some rules depend on the types of subexpressions, and to track macro calls,
+// so that the findings are located and their fixes printed.
+func Lint(ast *cel.Ast, path string) []Diagnostic {
+	l := &linter{ast: ast, path: path, source: []rune(ast.Source().Content()), types: map[int64]*exprpb.Type{}}
+	if ast.IsChecked() {
+		if checked, err := cel.AstToCheckedExpr(ast); err == nil {
+			l.types = checked.GetTypeMap()
+		}
+	}
+	l.spans = ExprSpans(ast.Expr(), ast.SourceInfo(), string(l.source))
+
+	l.hasChecks()
+	l.existsAssertions()
+	VisitExpr(ast.Expr(), func(expr *exprpb.Expr) bool {
+		l.dynamicRegex(expr)
+		l.stringSize(expr)
+		l.nestedComprehension(expr)
+		return true
+	})
+	sort.SliceStable(l.diagnostics, func(i, j int) bool {
+		a, b := l.diagnostics[i].Start, l.diagnostics[j].Start
+		if a == nil || b == nil {
+			return a != nil
+		}
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return l.diagnostics
+}
+
+type linter struct {
+	ast         *cel.Ast
+	path        string
+	source      []rune
+	types       map[int64]*exprpb.Type
+	spans       map[int64]Span
+	diagnostics []Diagnostic
+}
+
+func (l *linter) report(expr *exprpb.Expr, rule string, severity Severity, message, fix string) {
+	diagnostic := Diagnostic{Severity: severity, Message: message, Path: l.path, Rule: rule, Fix: fix}
+	if span, ok := l.spans[expr.GetId()]; ok && span.End <= len(l.source) {
+		start, end := sourcePosition(l.source, span.Start), sourcePosition(l.source, span.End)
+		diagnostic.Start, diagnostic.End = &start, &end
+	}
+	l.diagnostics = append(l.diagnostics, diagnostic)
+}
+
+// hasChecks reports the selections of fields nested in maps, or values of unknown type, whose presence is not tested
+// anywhere in the expression, either on the field itself or on a field nested in it.
+func (l *linter) hasChecks() {
+	var tested []string
+	VisitExpr(l.ast.Expr(), func(expr *exprpb.Expr) bool {
+		if sel := expr.GetSelectExpr(); sel != nil && sel.GetTestOnly() {
+			if operand, ok := SelectPath(sel.GetOperand()); ok {
+				tested = append(tested, operand+"."+sel.GetField())
+			}
+		}
+		return true
+	})
+	isTested := func(path string) bool {
+		for _, t := range tested {
+			if t == path || strings.HasPrefix(t, path+".") {
+				return true
+			}
+		}
+		return false
+	}
+
+	reported := map[string]bool{}
+	VisitExpr(l.ast.Expr(), func(expr *exprpb.Expr) bool {
+		sel := expr.GetSelectExpr()
+		if sel == nil || sel.GetTestOnly() {
+			return true
+		}
+		path, ok := SelectPath(expr)
+		if !ok {
+			return true
+		}
+		_, fields, _ := strings.Cut(path, ".")
+		if !strings.Contains(fields, ".") || presentFields[fields] || !l.mayBeAbsent(sel.GetOperand()) ||
+			isTested(path) || reported[path] {
+			return false
+		}
+		reported[path] = true
+		l.report(expr, RuleHasCheck, SeverityWarning,
+			fmt.Sprintf("%s may not be set, selecting it fails with 'no such key'", path),
+			fmt.Sprintf("test its presence first with has(%s), or select it optionally with %s.?%s",
+				path, strings.TrimSuffix(path, "."+sel.GetField()), sel.GetField()))
+		return false
+	})
+}
+
+// mayBeAbsent returns whether the fields of the value may be absent, i.e. it is a map or its type is unknown, unlike
+// messages whose fields have default values.
+func (l *linter) mayBeAbsent(expr *exprpb.Expr) bool {
+	t, ok := l.types[expr.GetId()]
+	return !ok || t.GetDyn() != nil || t.GetMapType() != nil
+}
+
+// existsAssertions reports exists() when it is the result of the expression, or one of the conditions of the result.
+func (l *linter) existsAssertions() {
+	for _, expr := range chainOperands(l.ast.Expr(), operators.LogicalAnd) {
+		comprehension := expr.GetComprehensionExpr()
+		if comprehension == nil || !isExists(comprehension) {
+			continue
+		}
+		fix := "use all() to require every element to match, and test size() > 0 if the list must not be empty"
+		if macro, ok := l.ast.SourceInfo().GetMacroCalls()[expr.GetId()]; ok {
+			// the call has no id, so that it is not printed as the original macro call
+			call := &exprpb.Expr{ExprKind: &exprpb.Expr_CallExpr{CallExpr: &exprpb.Expr_Call{
+				Target: macro.GetCallExpr().GetTarget(), Function: "all", Args: macro.GetCallExpr().GetArgs(),
+			}}}
+			if all, err := parser.Unparse(call, l.ast.SourceInfo()); err == nil {
+				fix = fmt.Sprintf("if every element must match, use %s, and test size() > 0 if the list must not be empty", all)
+			}
+		}
+		l.report(expr, RuleExistsAssertion, SeverityInfo,
+			"exists() is false for empty lists and holds as soon as a single element matches", fix)
+	}
+}
+
+// isExists returns whether the comprehension is the expansion of the exists() macro.
+func isExists(comprehension *exprpb.Expr_Comprehension) bool {
+	init := comprehension.GetAccuInit().GetConstExpr()
+	step := comprehension.GetLoopStep().GetCallExpr()
+	return init != nil && !init.GetBoolValue() && init.GetConstantKind() != nil &&
+		step != nil && step.GetFunction() == operators.LogicalOr
+}
+
+// regexFunctions are the functions taking a regular expression, by the index of the regular expression argument,
+// counting the target as the first argument.
+var regexFunctions = map[string]int{
+	"matches": 1,
+	"find":    1,
+	"findAll": 1,
+}
+
+func (l *linter) dynamicRegex(expr *exprpb.Expr) {
+	call := expr.GetCallExpr()
+	if call == nil {
+		return
+	}
+	index, ok := regexFunctions[call.GetFunction()]
+	if !ok {
+		return
+	}
+	args := call.GetArgs()
+	if call.GetTarget() != nil {
+		args = append([]*exprpb.Expr{call.GetTarget()}, args...)
+	}
+	if index >= len(args) || args[index].GetConstExpr() != nil {
+		return
+	}
+	l.report(args[index], RuleDynamicRegex, SeverityWarning,
+		fmt.Sprintf("the regular expression of %s() is not a literal and is compiled at every evaluation", call.GetFunction()),
+		"use a string literal, which is compiled once with the expression and validated beforehand")
+}
+
+func (l *linter) stringSize(expr *exprpb.Expr) {
+	call := expr.GetCallExpr()
+	if call == nil || call.GetFunction() != "size" {
+		return
+	}
+	arg := call.GetTarget()
+	if arg == nil && len(call.GetArgs()) == 1 {
+		arg = call.GetArgs()[0]
+	}
+	if arg == nil || l.types[arg.GetId()].GetPrimitive() != exprpb.Type_STRING {
+		return
+	}
+	fix := "use size(bytes(s)) for the length in bytes"
+	if s, err := parser.Unparse(arg, l.ast.SourceInfo()); err == nil {
+		fix = fmt.Sprintf("use size(bytes(%s)) for the length in bytes", s)
+	}
+	l.report(expr, RuleStringSize, SeverityInfo,
+		"size() of a string counts its characters, not its bytes, which differ for non-ASCII characters", fix)
+}
+
+// nestedComprehension reports the comprehensions nested in the step of the comprehension whose range does not depend
+// on the iteration variable, unless either range is a list literal.
+func (l *linter) nestedComprehension(expr *exprpb.Expr) {
+	outer := expr.GetComprehensionExpr()
+	if outer == nil || isBounded(outer.GetIterRange()) {
+		return
+	}
+	VisitExpr(outer.GetLoopStep(), func(e *exprpb.Expr) bool {
+		inner := e.GetComprehensionExpr()
+		if inner == nil {
+			return true
+		}
+		if !isBounded(inner.GetIterRange()) && !references(inner.GetIterRange(), outer.GetIterVar()) {
+			l.report(e, RuleNestedComprehension, SeverityWarning,
+				"comprehension nested in a comprehension over another list, its cost grows with the product of the sizes of the lists",
+				"build a map or a set of the inner list once, e.g. in a variable, and test membership with 'in', or bound the sizes of the lists")
+		}
+		return false
+	})
+}
+
+// isBounded returns whether the expression is a list or map literal, whose size is known.
+func isBounded(expr *exprpb.Expr) bool {
+	return expr.GetListExpr() != nil || expr.GetStructExpr() != nil
+}
+
+// references returns whether the identifier is referenced in the expression.
+func references(expr *exprpb.Expr, name string) bool {
+	found := false
+	VisitExpr(expr, func(e *exprpb.Expr) bool {
+		if e.GetIdentExpr().GetName() == name {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+var (
+	// placeholderRegexp matches the placeholders of templates, e.g. '{{ object.metadata.name }}' or '${name}'.
+	placeholderRegexp = regexp.MustCompile(`\{\{\s*([^{}]*?)\s*\}\}|\$\{\s*([^{}]*?)\s*\}`)
+	// verbRegexp matches the verbs of format strings, e.g. '%s'.
+	verbRegexp = regexp.MustCompile(`%[sdvq]`)
+)
+
+// LintMessage returns the finding of the message-expression rule for the static message of a validation found at
+// path, or nil when the message does not try to interpolate values. Placeholders which are CEL expressions are
+// converted into the suggested message expression.
+func LintMessage(message, path string) *Diagnostic {
+	matches := placeholderRegexp.FindAllStringSubmatchIndex(message, -1)
+	if len(matches) == 0 {
+		if !verbRegexp.MatchString(message) {
+			return nil
+		}
+		return &Diagnostic{Severity: SeverityInfo, Message: "the message is static and its format verbs are not replaced",
+			Path: path, Rule: RuleMessageExpression, Fix: "use messageExpression to build the message from the request"}
+	}
+
+	var parts []string
+	last := 0
+	for _, match := range matches {
+		if match[0] > last {
+			parts = append(parts, strconv.Quote(message[last:match[0]]))
+		}
+		start, end := match[2], match[3]
+		if start < 0 {
+			start, end = match[4], match[5]
+		}
+		parts = append(parts, "string("+message[start:end]+")")
+		last = match[1]
+	}
+	if last < len(message) {
+		parts = append(parts, strconv.Quote(message[last:]))
+	}
+	return &Diagnostic{Severity: SeverityInfo, Message: "the message is static and its placeholders are not replaced",
+		Path: path, Rule: RuleMessageExpression, Fix: "use messageExpression: " + strings.Join(parts, " + ")}
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/interpreter"
+)
+
+// ParseAttributePattern parses the path of an attribute whose value is unknown, e.g. 'request.userInfo',
+// "object.metadata.labels['app.kubernetes.io/name']" or 'object.spec.containers[*].image'. Fields are selected with
+// dots, map keys and list indexes with brackets, and '*' matches any field, key or index.
+// It also returns the name of the variable the attribute belongs to.
+func ParseAttributePattern(path string) (*interpreter.AttributePattern, string, error) {
+	p := &patternParser{path: path}
+	variable := p.identifier()
+	if variable == "" {
+		return nil, "", fmt.Errorf("invalid attribute %q: expected a variable name", path)
+	}
+	pattern := cel.AttributePattern(variable)
+	for p.pos < len(p.path) {
+		if err := p.qualifier(pattern); err != nil {
+			return nil, "", fmt.Errorf("invalid attribute %q at position %d: %w", path, p.pos+1, err)
+		}
+	}
+	return pattern, variable, nil
+}
+
+type patternParser struct {
+	path string
+	pos  int
+}
+
+func (p *patternParser) qualifier(pattern *interpreter.AttributePattern) error {
+	switch p.path[p.pos] {
+	case '.':
+		p.pos++
+		if p.consume("*") {
+			pattern.Wildcard()
+		} else if field := p.identifier(); field != "" {
+			pattern.QualString(field)
+		} else {
+			return fmt.Errorf("expected a field name or '*'")
+		}
+		return nil
+	case '[':
+		p.pos++
+		end := p.pos
+		if end < len(p.path) && (p.path[end] == '\'' || p.path[end] == '"') {
+			closing := strings.IndexByte(p.path[end+1:], p.path[end])
+			if closing < 0 {
+				return fmt.Errorf("unterminated key")
+			}
+			end += closing + 2
+		} else if closing := strings.IndexByte(p.path[end:], ']'); closing >= 0 {
+			end += closing
+		} else {
+			return fmt.Errorf("expected ']'")
+		}
+		qualifier := p.path[p.pos:end]
+		p.pos = end
+		if !p.consume("]") {
+			return fmt.Errorf("expected ']'")
+		}
+		switch {
+		case qualifier == "*":
+			pattern.Wildcard()
+		case strings.HasPrefix(qualifier, "'") || strings.HasPrefix(qualifier, `"`):
+			pattern.QualString(qualifier[1 : len(qualifier)-1])
+		default:
+			index, err := strconv.ParseInt(qualifier, 10, 64)
+			if err != nil {
+				return fmt.Errorf("expected an index, a quoted key or '*', got %q", qualifier)
+			}
+			pattern.QualInt(index)
+		}
+		return nil
+	}
+	return fmt.Errorf("expected '.' or '['")
+}
+
+func (p *patternParser) identifier() string {
+	start := p.pos
+	for p.pos < len(p.path) && isIdentifierRune(rune(p.path[p.pos])) {
+		p.pos++
+	}
+	return p.path[start:p.pos]
+}
+
+func (p *patternParser) consume(s string) bool {
+	if strings.HasPrefix(p.path[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"sort"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/interpreter"
+)
+
+// TraceEntry is the value a subexpression evaluated to, Start and End delimit the subexpression within the expression,
+// End being exclusive. Error is set instead of Value and Type when the subexpression failed.
+type TraceEntry struct {
+	Start      Position `json:"start"`
+	End        Position `json:"end"`
+	Expression string   `json:"expression"`
+	Type       string   `json:"type,omitempty"`
+	Value      any      `json:"value,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Trace returns the values recorded in the evaluation state for the subexpressions of the AST, ordered by their
+// position in the source, enclosing subexpressions first. Within comprehensions, the values are the ones of the last
+// iteration. Values which can not be converted to JSON, such as the authorizer types, are left out.
+func Trace(ast *cel.Ast, state interpreter.EvalState) []TraceEntry {
+	if ast == nil || state == nil {
+		return nil
+	}
+	source := []rune(ast.Source().Content())
+	type tracedSpan struct {
+		Span
+		entry TraceEntry
+	}
+	traced := []tracedSpan{}
+	for id, span := range ExprSpans(ast.Expr(), ast.SourceInfo(), string(source)) {
+		val, found := state.Value(id)
+		if !found || span.End > len(source) || types.IsUnknown(val) {
+			continue
+		}
+		entry := TraceEntry{Expression: string(source[span.Start:span.End])}
+		if types.IsError(val) {
+			entry.Error = val.(*types.Err).Error()
+		} else if value, err := ConvertValToNative(val); err == nil {
+			entry.Type = TypeName(val)
+			entry.Value = value
+		} else {
+			continue
+		}
+		traced = append(traced, tracedSpan{Span: span, entry: entry})
+	}
+	sort.Slice(traced, func(i, j int) bool {
+		if traced[i].Start != traced[j].Start {
+			return traced[i].Start < traced[j].Start
+		}
+		return traced[i].End > traced[j].End
+	})
+
+	entries := make([]TraceEntry, 0, len(traced))
+	for _, t := range traced {
+		t.entry.Start = sourcePosition(source, t.Start)
+		t.entry.End = sourcePosition(source, t.End)
+		entries = append(entries, t.entry)
+	}
+	return entries
+}
+
+// sourcePosition converts a character offset of the source into a 1-based line and column.
+func sourcePosition(source []rune, offset int) Position {
+	position := Position{Line: 1, Column: 1}
+	for _, r := range source[:offset] {
+		if r == '\n' {
+			position.Line++
+			position.Column = 1
+		} else {
+			position.Column++
+		}
+	}
+	return position
+}
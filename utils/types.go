@@ -0,0 +1,296 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var primitiveTypes = map[string]*cel.Type{
+	"bool":      cel.BoolType,
+	"int":       cel.IntType,
+	"uint":      cel.UintType,
+	"double":    cel.DoubleType,
+	"string":    cel.StringType,
+	"bytes":     cel.BytesType,
+	"dyn":       cel.DynType,
+	"any":       cel.AnyType,
+	"null_type": cel.NullType,
+	"timestamp": cel.TimestampType,
+	"duration":  cel.DurationType,
+}
+
+// ParseType parses a CEL type as it is written in type declarations, e.g. 'int', 'list(string)',
+// 'map(string, dyn)' or 'optional_type(int)'. Any other qualified name, such as 'google.protobuf.Struct', is a message
+// type, which must be known by the environment it is declared in.
+func ParseType(text string) (*cel.Type, error) {
+	p := &typeParser{text: text}
+	t, err := p.parseType()
+	if err == nil && p.skipSpaces() < len(p.text) {
+		err = p.errorf("unexpected %q", p.text[p.pos:])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid type %q: %w", text, err)
+	}
+	return t, nil
+}
+
+type typeParser struct {
+	text string
+	pos  int
+}
+
+func (p *typeParser) parseType() (*cel.Type, error) {
+	name := p.parseName()
+	if name == "" {
+		return nil, p.errorf("expected a type name")
+	}
+	var params []*cel.Type
+	if p.skipSpaces() < len(p.text) && p.text[p.pos] == '(' {
+		p.pos++
+		for {
+			param, err := p.parseType()
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, param)
+			if p.skipSpaces() >= len(p.text) {
+				return nil, p.errorf("expected ')'")
+			}
+			if p.text[p.pos] == ')' {
+				p.pos++
+				break
+			}
+			if p.text[p.pos] != ',' {
+				return nil, p.errorf("expected ',' or ')'")
+			}
+			p.pos++
+		}
+	}
+
+	switch {
+	case name == "list" && len(params) == 1:
+		return cel.ListType(params[0]), nil
+	case name == "map" && len(params) == 2:
+		return cel.MapType(params[0], params[1]), nil
+	case name == "optional_type" && len(params) == 1:
+		return cel.OptionalType(params[0]), nil
+	case name == "list" || name == "map" || name == "optional_type":
+		return nil, p.errorf("wrong number of type parameters for %s", name)
+	case len(params) > 0:
+		return nil, p.errorf("type %s has no type parameters", name)
+	}
+	if t, ok := primitiveTypes[name]; ok {
+		return t, nil
+	}
+	return cel.ObjectType(name), nil
+}
+
+func (p *typeParser) parseName() string {
+	start := p.skipSpaces()
+	for p.pos < len(p.text) {
+		r := rune(p.text[p.pos])
+		if r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+func (p *typeParser) skipSpaces() int {
+	for p.pos < len(p.text) && unicode.IsSpace(rune(p.text[p.pos])) {
+		p.pos++
+	}
+	return p.pos
+}
+
+func (p *typeParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("at position %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// CoerceValue converts a value decoded from YAML or JSON into the native value of the declared type, e.g. RFC 3339
+// strings into timestamps or integers into doubles. Messages of the given files are decoded from protobuf JSON maps or
+// protobuf text format strings. Values which need no conversion, or can not be converted, are returned as is and left
+// for the evaluation to report.
+func CoerceValue(value any, t *cel.Type, files *protoregistry.Files) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if _, ok := value.(ref.Val); ok {
+		// CEL values already have their type
+		return value, nil
+	}
+	switch t.Kind() {
+	case types.TimestampKind:
+		if s, ok := value.(string); ok {
+			timestamp, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q: %w", s, err)
+			}
+			return timestamp, nil
+		}
+	case types.DurationKind:
+		if s, ok := value.(string); ok {
+			duration, err := time.ParseDuration(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration %q: %w", s, err)
+			}
+			return duration, nil
+		}
+	case types.UintKind:
+		if i, ok := value.(int); ok && i >= 0 {
+			return uint64(i), nil
+		}
+	case types.DoubleKind:
+		if i, ok := value.(int); ok {
+			return float64(i), nil
+		}
+	case types.IntKind:
+		if f, ok := value.(float64); ok && f == float64(int64(f)) {
+			return int64(f), nil
+		}
+	case types.BytesKind:
+		if s, ok := value.(string); ok {
+			return []byte(s), nil
+		}
+	case types.ListKind:
+		if list, ok := value.([]any); ok {
+			coerced := make([]any, len(list))
+			for i, elem := range list {
+				var err error
+				if coerced[i], err = CoerceValue(elem, t.Parameters()[0], files); err != nil {
+					return nil, fmt.Errorf("[%d]: %w", i, err)
+				}
+			}
+			return coerced, nil
+		}
+	case types.MapKind:
+		return coerceMap(value, t.Parameters()[1], files)
+	case types.StructKind:
+		return coerceMessage(value, t.TypeName(), files)
+	}
+	return value, nil
+}
+
+func coerceMessage(value any, typeName string, files *protoregistry.Files) (any, error) {
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(typeName))
+	if err != nil {
+		return value, nil
+	}
+	msgDesc, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return value, nil
+	}
+	msg := dynamicpb.NewMessage(msgDesc)
+	switch value := value.(type) {
+	case string:
+		if err := (prototext.UnmarshalOptions{Resolver: dynamicpb.NewTypes(files)}).Unmarshal([]byte(value), msg); err != nil {
+			return nil, fmt.Errorf("invalid %s text: %w", typeName, err)
+		}
+	case map[any]any, map[string]any:
+		data, err := json.Marshal(jsonValue(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", typeName, err)
+		}
+		if err := (protojson.UnmarshalOptions{Resolver: dynamicpb.NewTypes(files)}).Unmarshal(data, msg); err != nil {
+			return nil, fmt.Errorf("invalid %s JSON: %w", typeName, err)
+		}
+	default:
+		return value, nil
+	}
+	return msg, nil
+}
+
+// jsonValue converts the maps decoded from YAML, whose keys can be of any type, into maps which can be encoded to JSON.
+func jsonValue(value any) any {
+	switch value := value.(type) {
+	case map[any]any:
+		converted := make(map[string]any, len(value))
+		for key, elem := range value {
+			converted[fmt.Sprint(key)] = jsonValue(elem)
+		}
+		return converted
+	case map[string]any:
+		converted := make(map[string]any, len(value))
+		for key, elem := range value {
+			converted[key] = jsonValue(elem)
+		}
+		return converted
+	case []any:
+		converted := make([]any, len(value))
+		for i, elem := range value {
+			converted[i] = jsonValue(elem)
+		}
+		return converted
+	}
+	return value
+}
+
+func coerceMap(value any, valueType *cel.Type, files *protoregistry.Files) (any, error) {
+	coerced := map[any]any{}
+	coerce := func(key, elem any) error {
+		var err error
+		if coerced[key], err = CoerceValue(elem, valueType, files); err != nil {
+			return fmt.Errorf("[%v]: %w", key, err)
+		}
+		return nil
+	}
+	switch m := value.(type) {
+	case map[any]any:
+		for key, elem := range m {
+			if err := coerce(key, elem); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]any:
+		for key, elem := range m {
+			if err := coerce(key, elem); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return value, nil
+	}
+	return coerced, nil
+}
+
+// FormatDeclarations returns the declarations in a canonical form, e.g. to key caches.
+func FormatDeclarations(declarations map[string]*cel.Type) string {
+	names := make([]string, 0, len(declarations))
+	for name := range declarations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, name+": "+declarations[name].String())
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FindNode returns the node at the YAML path, e.g. 'spec.validations[0].expression', or nil.
+func FindNode(root *yaml.Node, path string) *yaml.Node {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, segment := range strings.Split(path, ".") {
+		key, index, hasIndex := strings.Cut(segment, "[")
+		if node = mappingValue(node, key); node == nil {
+			return nil
+		}
+		if hasIndex {
+			i, err := strconv.Atoi(strings.TrimSuffix(index, "]"))
+			if err != nil || node.Kind != yaml.SequenceNode || i >= len(node.Content) {
+				return nil
+			}
+			node = node.Content[i]
+		}
+	}
+	return node
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// DocumentLines splits the document into lines of characters, without their line breaks.
+func DocumentLines(document string) [][]rune {
+	var lines [][]rune
+	for _, line := range strings.Split(document, "\n") {
+		lines = append(lines, []rune(strings.TrimSuffix(line, "\r")))
+	}
+	return lines
+}
+
+// ScalarPositions locates each character of the value of the scalar in the lines of its document, and its end.
+// Characters are matched in order from the start of the scalar, so that the indentation of block scalars, the line
+// breaks folded into spaces and the escape sequences of quoted scalars are skipped.
+func ScalarPositions(lines [][]rune, node *yaml.Node) []Position {
+	line, column := node.Line-1, node.Column-1
+	if node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		// the content of block scalars starts on the line after their header
+		line, column = node.Line, 0
+	}
+	value := []rune(node.Value)
+	positions := make([]Position, 0, len(value)+1)
+	for _, r := range value {
+		for line < len(lines) {
+			if column >= len(lines[line]) {
+				if r == '\n' || r == ' ' {
+					// a line break of the value, or folded into a space
+					break
+				}
+				line, column = line+1, 0
+				continue
+			}
+			if lines[line][column] == r {
+				break
+			}
+			column++
+		}
+		positions = append(positions, Position{Line: line + 1, Column: column + 1})
+		if line < len(lines) && column >= len(lines[line]) {
+			line, column = line+1, 0
+		} else {
+			column++
+		}
+	}
+	return append(positions, Position{Line: line + 1, Column: column + 1})
+}
+
+// Offset returns the character offset of the position within the source.
+func Offset(source string, position Position) int {
+	line, offset := 1, 0
+	for _, r := range source {
+		if line == position.Line {
+			break
+		}
+		if r == '\n' {
+			line++
+		}
+		offset++
+	}
+	return offset + position.Column - 1
+}
+
+// LocateDiagnostics returns the diagnostics with their spans located in the YAML document rather than in their
+// expressions, so that editors of the document can mark them. Diagnostics found at a path of the document lose it and
+// span their whole expression when they have no span of their own, the others keep their path but lose their span,
+// which would not be relative to the document.
+func LocateDiagnostics(document []byte, diagnostics []Diagnostic) []Diagnostic {
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(document, root); err != nil {
+		root = nil
+	}
+	lines := DocumentLines(string(document))
+	located := make([]Diagnostic, 0, len(diagnostics))
+	for _, diagnostic := range diagnostics {
+		var node *yaml.Node
+		if root != nil && diagnostic.Path != "" {
+			node = FindNode(root, diagnostic.Path)
+		}
+		if node == nil || node.Kind != yaml.ScalarNode {
+			diagnostic.Start, diagnostic.End = nil, nil
+			located = append(located, diagnostic)
+			continue
+		}
+		positions := ScalarPositions(lines, node)
+		last := len(positions) - 1
+		start, end := 0, last
+		if diagnostic.Start != nil && diagnostic.End != nil {
+			start, end = Offset(node.Value, *diagnostic.Start), Offset(node.Value, *diagnostic.End)
+		}
+		start, end = min(max(start, 0), last), min(max(end, 0), last)
+		diagnostic.Path = ""
+		diagnostic.Start, diagnostic.End = &positions[start], &positions[end]
+		located = append(located, diagnostic)
+	}
+	return located
+}
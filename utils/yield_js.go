@@ -0,0 +1,71 @@
+// Copyright 2023 Undistro Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build js
+
+package utils
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// yieldProgramOptions yield periodically during evaluations, as the single-threaded runtime does not preempt them and
+// would otherwise never fire the timers which cancel their contexts on timeout.
+var yieldProgramOptions = []cel.ProgramOption{cel.CostTracking(yieldingEstimator{})}
+
+// yieldCallFrequency is the number of function calls between yields.
+const yieldCallFrequency = 1000
+
+// eventLoopYieldInterval is the longest evaluations run without giving back control to the JavaScript event loop, when
+// no blocking call is in progress.
+const eventLoopYieldInterval = 50 * time.Millisecond
+
+var (
+	calls int
+	// blockingCalls is the number of calls from JavaScript in progress, which block the event loop until they return.
+	blockingCalls      int
+	lastEventLoopYield time.Time
+)
+
+// BlockingCall marks a call from JavaScript as in progress until the returned function is called. Evaluations only
+// give back control to the event loop when no such call is in progress, as waiting for it within one deadlocks.
+func BlockingCall() func() {
+	blockingCalls++
+	return func() {
+		blockingCalls--
+	}
+}
+
+// yieldingEstimator yields to the other goroutines every yieldCallFrequency function calls, and to the event loop every
+// eventLoopYieldInterval when no blocking call is in progress, e.g. to run the abort of an asynchronous evaluation.
+// It keeps the default cost of every call.
+type yieldingEstimator struct{}
+
+func (yieldingEstimator) CallCost(function, overloadID string, args []ref.Val, result ref.Val) *uint64 {
+	if calls++; calls%yieldCallFrequency != 0 {
+		return nil
+	}
+	if blockingCalls == 0 && time.Since(lastEventLoopYield) > eventLoopYieldInterval {
+		// sleeping lets the runtime return to the event loop until its timer fires
+		time.Sleep(time.Millisecond)
+		lastEventLoopYield = time.Now()
+	} else {
+		runtime.Gosched()
+	}
+	return nil
+}
@@ -34,6 +34,9 @@ function createAccordionItemsByResults(name, result, index) {
   accordionContent.appendChild(createLabel(result, name, index));
   const costSpan = document.createElement("span");
   costSpan.innerHTML = `Cost: ${result?.cost ?? "-"}`;
+  if (result?.references)
+    costSpan.innerHTML += ` · References: ${result.references}`;
+  if (result?.type) costSpan.innerHTML += ` · Type: ${result.type}`;
   accordionContent.appendChild(costSpan);
 
   const expansibleContent = document.createElement("div");
@@ -49,6 +49,33 @@ class AceEditor {
     const mode = `ace/mode/${syntax}`;
     this.editor.getSession().setMode(mode);
   }
+
+  // setDiagnostics annotates the gutter and underlines the spans of the diagnostics located within the editor content,
+  // positions are 1-based and end columns are exclusive. The WASM module locates the diagnostics of the expressions of
+  // YAML documents in the documents, those left with a path could not be located.
+  setDiagnostics(diagnostics = []) {
+    const session = this.editor.getSession();
+    (session.diagnosticMarkers ?? []).forEach((id) => session.removeMarker(id));
+    const located = diagnostics.filter(({ path, start }) => !path && start);
+    const Range = ace.require("ace/range").Range;
+    session.diagnosticMarkers = located
+      .filter(({ end }) => end)
+      .map(({ start, end }) =>
+        session.addMarker(
+          new Range(start.line - 1, start.column - 1, end.line - 1, end.column - 1),
+          "ace_diagnostic-marker",
+          "text"
+        )
+      );
+    session.setAnnotations(
+      located.map(({ severity, message, start, rule, fix }) => ({
+        row: start.line - 1,
+        column: start.column - 1,
+        text: rule ? `${message} [${rule}]\nFix: ${fix}` : message,
+        type: severity === "error" ? "error" : severity === "warning" ? "warning" : "info",
+      }))
+    );
+  }
 }
 
 export { AceEditor };
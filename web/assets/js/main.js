@@ -20,7 +20,9 @@ import {
   hideAccordions,
 } from "./components/accordions/result.js";
 import { getRunValues } from "./utils/editor.js";
+import { AceEditor } from "./editor.js";
 import { getCurrentMode } from "./utils/localStorage.js";
+import { wasmReady } from "./services/wasm.js";
 
 // Add the following polyfill for Microsoft Edge 17/18 support:
 // <script src="https://cdn.jsdelivr.net/npm/text-encoding@0.7.0/lib/encoding.min.js"></script>
@@ -35,27 +37,54 @@ if (!WebAssembly.instantiateStreaming) {
 
 const output = document.getElementById("output");
 
-function run() {
+// evaluations taking longer, in milliseconds, are interrupted
+const evaluationTimeout = 5000;
+
+async function run() {
   const values = getRunValues();
   output.value = "Evaluating...";
   setCost("");
 
   try {
     const modeId = getCurrentMode();
-    const result = eval(modeId, values);
-    const { output: resultOutput, isError } = result;
+    const { result: obj, error, isError, diagnostics } = await evalAsync(
+      modeId,
+      { ...values, timeout: evaluationTimeout }
+    );
+    new AceEditor(modeId).setDiagnostics(diagnostics);
     if (isError) {
-      output.value = resultOutput;
+      output.value = error;
       output.style.color = "red";
       hideAccordions();
     } else {
-      const obj = JSON.parse(resultOutput);
       const resultCost = obj?.cost;
       delete obj.cost;
+      // failed expressions are already rendered with their results
+      delete obj.diagnostics;
 
-      if ("result" in obj) {
-        output.value = JSON.stringify(obj.result);
+      if (obj.residual) {
+        output.value = obj.residual;
+        output.title = "Residual expression";
+        output.style.color = "white";
+      } else if ("result" in obj) {
+        // ints and uints are encoded as strings to keep their precision
+        output.value =
+          obj.type === "int" || obj.type === "uint"
+            ? obj.result
+            : JSON.stringify(obj.result);
+        output.title = obj.type ? `Type: ${obj.type}` : "";
         output.style.color = "white";
+      } else if ("violations" in obj) {
+        // audits list the violating objects by namespace and message
+        handleRenderAccordions({
+          audit: [
+            { name: "summary", value: obj.summary },
+            ...obj.violations.map((violation) => ({
+              name: `${violation.namespace || "cluster"}: ${violation.message}`,
+              value: violation.objects,
+            })),
+          ],
+        });
       } else {
         handleRenderAccordions(obj);
       }
@@ -68,30 +97,27 @@ function run() {
   }
 }
 
-(async function loadAndRunGoWasm() {
-  const go = new Go();
-
-  const buffer = pako.ungzip(
-    await (await fetch("assets/main.wasm.gz")).arrayBuffer()
-  );
-
-  // A fetched response might be decompressed twice on Firefox.
-  // See https://bugzilla.mozilla.org/show_bug.cgi?id=610679
-  if (buffer[0] === 0x1f && buffer[1] === 0x8b) {
-    buffer = pako.ungzip(buffer);
+function formatExpression() {
+  const modeId = getCurrentMode();
+  const editor = new AceEditor(modeId);
+  const { output: formatted, isError, diagnostics } = format(modeId, {
+    [modeId]: editor.getValue(),
+  });
+  editor.setDiagnostics(diagnostics);
+  if (!isError) {
+    editor.setValue(formatted, -1);
   }
+}
 
-  WebAssembly.instantiate(buffer, go.importObject)
-    .then((result) => {
-      go.run(result.instance);
-      document.getElementById("run").disabled = false;
-      document.getElementById("output").placeholder =
-        "Press 'Run' to evaluate your CEL expression.";
-    })
-    .catch((err) => {
-      console.error(err);
-    });
-})();
+wasmReady
+  .then(() => {
+    document.getElementById("run").disabled = false;
+    document.getElementById("output").placeholder =
+      "Press 'Run' to evaluate your CEL expression.";
+  })
+  .catch((err) => {
+    console.error(err);
+  });
 
 const runButton = document.getElementById("run");
 
@@ -99,6 +125,13 @@ runButton.addEventListener("click", run);
 document.addEventListener("keydown", (event) => {
   if ((event.ctrlKey || event.metaKey) && event.code === "Enter") {
     run();
+  } else if (
+    (event.ctrlKey || event.metaKey) &&
+    event.shiftKey &&
+    event.code === "KeyF"
+  ) {
+    event.preventDefault();
+    formatExpression();
   }
 });
 
@@ -14,10 +14,11 @@
  * limitations under the License.
  */
 
+import { wasmReady } from "./wasm.js";
+
 async function getModes() {
-  const response = await fetch("../../assets/modes.json");
-  const modes = await response.json();
-  return modes;
+  await wasmReady;
+  return modes();
 }
 
 export const ModesService = {
@@ -0,0 +1,34 @@
+/**
+ * Copyright 2023 Undistro Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// wasmReady resolves once the functions of the WebAssembly module, such as evalAsync and modes, are defined.
+export const wasmReady = (async function loadAndRunGoWasm() {
+  const go = new Go();
+
+  let buffer = pako.ungzip(
+    await (await fetch("assets/main.wasm.gz")).arrayBuffer()
+  );
+
+  // A fetched response might be decompressed twice on Firefox.
+  // See https://bugzilla.mozilla.org/show_bug.cgi?id=610679
+  if (buffer[0] === 0x1f && buffer[1] === 0x8b) {
+    buffer = pako.ungzip(buffer);
+  }
+
+  const result = await WebAssembly.instantiate(buffer, go.importObject);
+  // the functions are defined as soon as the module runs, it never exits
+  go.run(result.instance);
+})();
@@ -74,7 +74,7 @@ export const renderSharedContent = (
         ?.forEach((editor) => {
           const containerId = editor.id;
           const inputEditor = new AceEditor(containerId);
-          inputEditor.setValue(object[containerId], -1);
+          inputEditor.setValue(object[containerId] ?? "", -1);
           setEditorTheme(inputEditor);
         });
     }
@@ -44,6 +44,8 @@ export function getRunValues() {
   setEditorTheme(exprEditor);
   let values = {
     [modeId]: exprEditor.getValue(),
+    // lint findings are shown as annotations of the expression editor
+    lint: true,
   };
 
   document.querySelectorAll(".editor__input.data__input").forEach((editor) => {
@@ -116,7 +116,7 @@ export function handleFillTabContent(mode, example) {
   mode.tabs.forEach((tab) => {
     const containerId = tab.id;
     const inputEditor = new AceEditor(containerId);
-    inputEditor.setValue(example[containerId], -1);
+    inputEditor.setValue(example[containerId] ?? "", -1);
     setEditorTheme(inputEditor);
   });
 }
@@ -128,7 +128,7 @@ export function renderExpressionContent(mode, examples) {
   const currentExample = getCurrentExample(mode, examples);
   const exprEditor = new AceEditor(mode.id);
   exprEditor.setSyntax(mode.mode);
-  exprEditor.setValue(currentExample?.[mode.id] ?? mode[mode.id], -1);
+  exprEditor.setValue(currentExample?.[mode.id] ?? mode.example ?? "", -1);
 }
 
 export function renderTabs(mode, examples) {
@@ -157,7 +157,7 @@ export function renderTabs(mode, examples) {
     const editorContainer = createEditorContainer(containerId);
     const inputEditor = new AceEditor(containerId);
     inputEditor.setSyntax(tab.mode);
-    inputEditor.setValue(currentExample[containerId], -1);
+    inputEditor.setValue(currentExample[containerId] ?? tab.example ?? "", -1);
 
     const tabButton = document.createElement("button");
     tabButton.innerHTML = `<span>${tab.name}</span>`;